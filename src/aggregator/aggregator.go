@@ -0,0 +1,201 @@
+package aggregator
+
+import (
+	"fmt"
+	"math"
+	"sync"
+	"time"
+
+	"github.com/coder-van/v-graphite/src/common"
+	statsd "github.com/coder-van/v-stats"
+	"github.com/coder-van/v-util/log"
+)
+
+type bucketKey struct {
+	metric string
+	start  int64 // timestamp bucket starts, aligned to rule frequency
+}
+
+type bucket struct {
+	rule  *Rule
+	sum   float64
+	min   float64
+	max   float64
+	count int64
+}
+
+func (b *bucket) add(v float64) {
+	if b.count == 0 || v < b.min {
+		b.min = v
+	}
+	if b.count == 0 || v > b.max {
+		b.max = v
+	}
+	b.sum += v
+	b.count++
+}
+
+func (b *bucket) value() float64 {
+	switch b.rule.Method {
+	case Avg:
+		return b.sum / float64(b.count)
+	case Min:
+		return b.min
+	case Max:
+		return b.max
+	case Count:
+		return float64(b.count)
+	}
+	return b.sum
+}
+
+// emittedBucket is the last bucket emitted of an output metric
+type emittedBucket struct {
+	end       int64 // timestamp bucket ends
+	frequency int64 // of the rule
+}
+
+const (
+	// an output is forgotten when its last emitted bucket ended this many rule
+	// frequencies before now - Lag, later points are not dropped as late then
+	emittedKeepBuckets = 3
+	// seconds between checks of outputs to forget
+	emittedPruneInterval = 60
+)
+
+// Aggregator buffer points match rules per output metric and time bucket,
+// emit aggregated points after bucket end plus Lag
+type Aggregator struct {
+	mu         sync.Mutex
+	rules      []*Rule
+	buckets    map[bucketKey]*bucket
+	emitted    map[string]emittedBucket // output metric -> last emitted bucket
+	lastPrune  int64                    // unix time emitted was pruned
+	Lag        int64                    // seconds waiting for late points before emit
+	KeepInputs bool                     // whether inputs go to cache as well
+	Emit       func(common.MetricPoint)
+	exit       chan bool
+
+	logger *log.Vlogger
+	stat   *statsd.BaseStat
+}
+
+func New(rules []*Rule, lag int64, keepInputs bool) *Aggregator {
+	return &Aggregator{
+		rules:      rules,
+		buckets:    make(map[bucketKey]*bucket),
+		emitted:    make(map[string]emittedBucket),
+		Lag:        lag,
+		KeepInputs: keepInputs,
+		exit:       make(chan bool),
+		logger:     log.GetLogger("aggregator", log.RotateModeMonth),
+		stat:       common.GetStat("aggregator"),
+	}
+}
+
+// Process feed one point to aggregator, return whether the point should
+// still go to cache
+func (agg *Aggregator) Process(mp common.MetricPoint) bool {
+	matched := false
+	agg.mu.Lock()
+	for _, rule := range agg.rules {
+		out, ok := rule.OutputName(mp.Key)
+		if !ok {
+			continue
+		}
+		matched = true
+		start := mp.Timestamp - mp.Timestamp%rule.Frequency
+		if start+rule.Frequency <= agg.emitted[out].end {
+			agg.stat.CounterInc("late-points-dropped", 1)
+			continue
+		}
+		key := bucketKey{out, start}
+		b, ok := agg.buckets[key]
+		if !ok {
+			b = &bucket{rule: rule}
+			agg.buckets[key] = b
+		}
+		b.add(mp.Value)
+	}
+	agg.mu.Unlock()
+
+	if !matched {
+		return true
+	}
+	agg.stat.CounterInc("points-matched", 1)
+	return agg.KeepInputs
+}
+
+// Flush emit buckets ended before now - Lag
+func (agg *Aggregator) Flush(now int64) {
+	ready := make([]common.MetricPoint, 0)
+	agg.mu.Lock()
+	for key, b := range agg.buckets {
+		end := key.start + b.rule.Frequency
+		if end+agg.Lag > now {
+			continue
+		}
+		v := b.value()
+		if !math.IsNaN(v) {
+			ready = append(ready, common.MetricPoint{Key: key.metric, Value: v, Timestamp: key.start})
+		}
+		if end > agg.emitted[key.metric].end {
+			agg.emitted[key.metric] = emittedBucket{end: end, frequency: b.rule.Frequency}
+		}
+		delete(agg.buckets, key)
+	}
+	agg.pruneEmitted(now)
+	agg.stat.GaugeUpdate("buckets", len(agg.buckets))
+	agg.stat.GaugeUpdate("emitted-outputs", len(agg.emitted))
+	agg.mu.Unlock()
+
+	for _, mp := range ready {
+		agg.Emit(mp)
+	}
+	agg.stat.CounterInc("points-emitted", len(ready))
+}
+
+// pruneEmitted forget outputs not emitted for a while, so emitted doesn't
+// keep every output ever seen, caller holds mu
+func (agg *Aggregator) pruneEmitted(now int64) {
+	if now-agg.lastPrune < emittedPruneInterval {
+		return
+	}
+	agg.lastPrune = now
+	for metric, e := range agg.emitted {
+		if e.end+emittedKeepBuckets*e.frequency <= now-agg.Lag {
+			delete(agg.emitted, metric)
+		}
+	}
+}
+
+func (agg *Aggregator) Run() {
+	ticker := time.NewTicker(time.Second)
+	defer ticker.Stop()
+	fmt.Println("* Aggregator started")
+	for {
+		select {
+		case <-ticker.C:
+			agg.Flush(time.Now().Unix())
+		case <-agg.exit:
+			fmt.Println("* Aggregator stopped")
+			return
+		}
+	}
+}
+
+func (agg *Aggregator) Start() {
+	fmt.Println("* Aggregator starting")
+	if agg.Emit == nil {
+		panic("Aggregator Emit func can't be nil")
+	}
+	agg.logger.Printf("aggregator started with %d rules \n", len(agg.rules))
+	go agg.Run()
+}
+
+// Stop emit all buckets no matter ended or not, so nothing lost
+func (agg *Aggregator) Stop() {
+	fmt.Println("* Aggregator stopping")
+	agg.exit <- true
+	agg.Flush(math.MaxInt64 - agg.Lag)
+}
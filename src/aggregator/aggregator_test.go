@@ -0,0 +1,89 @@
+package aggregator
+
+import (
+	"fmt"
+	"testing"
+
+	"github.com/coder-van/v-graphite/src/common"
+)
+
+func TestAggregator(t *testing.T) {
+	rules := make([]*Rule, 0)
+	for _, line := range []string{
+		"<host>.cpu.sum (60) = sum <host>.cpu.*",
+		"<host>.cpu.max (60) = max <host>.cpu.*",
+	} {
+		r, err := ParseRule(line)
+		if err != nil {
+			t.Fatal(err)
+		}
+		rules = append(rules, r)
+	}
+	agg := New(rules, 10, false)
+	got := make(map[string]float64)
+	agg.Emit = func(mp common.MetricPoint) {
+		got[fmt.Sprintf("%s@%d", mp.Key, mp.Timestamp)] = mp.Value
+	}
+
+	points := []common.MetricPoint{
+		{Key: "a.cpu.user", Value: 1, Timestamp: 1500000000},
+		{Key: "a.cpu.sys", Value: 2, Timestamp: 1500000059},
+		{Key: "a.cpu.user", Value: 4, Timestamp: 1500000060},
+	}
+	for _, mp := range points {
+		if agg.Process(mp) {
+			t.Errorf("%v should not go to cache", mp)
+		}
+	}
+	if !agg.Process(common.MetricPoint{Key: "a.mem", Value: 1, Timestamp: 1500000000}) {
+		t.Error("unmatched point should go to cache")
+	}
+
+	// first bucket ends at 1500000060, emitted after lag
+	agg.Flush(1500000069)
+	if len(got) != 0 {
+		t.Fatalf("emitted before lag, %v", got)
+	}
+	agg.Flush(1500000070)
+	want := map[string]float64{"a.cpu.sum@1500000000": 3, "a.cpu.max@1500000000": 2}
+	if len(got) != len(want) || got["a.cpu.sum@1500000000"] != 3 || got["a.cpu.max@1500000000"] != 2 {
+		t.Fatalf("got %v, want %v", got, want)
+	}
+
+	// late point of emitted bucket is dropped, not emitted again
+	agg.Process(common.MetricPoint{Key: "a.cpu.user", Value: 100, Timestamp: 1500000030})
+	agg.Flush(1500000130)
+	if got["a.cpu.sum@1500000000"] != 3 || got["a.cpu.sum@1500000060"] != 4 {
+		t.Fatalf("got %v", got)
+	}
+
+	// stop emits buckets not ended yet
+	agg.Process(common.MetricPoint{Key: "a.cpu.user", Value: 5, Timestamp: 1500000120})
+	agg.Flush(1500000130)
+	if _, ok := got["a.cpu.sum@1500000120"]; ok {
+		t.Fatal("emitted before bucket end")
+	}
+	agg.Flush(1 << 62)
+	if got["a.cpu.sum@1500000120"] != 5 {
+		t.Fatalf("got %v", got)
+	}
+
+	// output is forgotten some buckets after its last one, not kept forever
+	prune := New(rules[:1], 10, false)
+	prune.Emit = func(common.MetricPoint) {}
+	prune.Process(points[0])
+	prune.Flush(1500000070)
+	prune.Flush(1500000200)
+	if len(prune.emitted) != 1 {
+		t.Fatalf("forgot %v too early", prune.emitted)
+	}
+	prune.Flush(1500000260)
+	if len(prune.emitted) != 0 {
+		t.Fatalf("%v not forgotten", prune.emitted)
+	}
+
+	keep := New(rules, 0, true)
+	if !keep.Process(points[0]) {
+		t.Error("input should be kept")
+	}
+}
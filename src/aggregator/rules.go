@@ -0,0 +1,173 @@
+package aggregator
+
+/*
+Parser of aggregation-rules.conf, same syntax as carbon-aggregator:
+
+    output_template (frequency) = method input_pattern
+
+e.g.
+    <env>.applications.<app>.all.requests (60) = sum <env>.applications.<app>.*.requests
+
+In input_pattern <field> matches one path node, <<field>> matches any text
+including dots, * matches part of a node. Fields are filled in output_template.
+*/
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"os"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+type Method int
+
+const (
+	Sum Method = iota
+	Avg
+	Min
+	Max
+	Count
+)
+
+var (
+	ruleRegexp     = regexp.MustCompile(`^(\S+)\s+\((\d+)\)\s*=\s*(\w+)\s+(\S+)$`)
+	fieldRegexp    = regexp.MustCompile(`<<[^<>]+>>|<[^<>]+>`)
+	fieldNameRegex = regexp.MustCompile(`^[a-zA-Z_][a-zA-Z0-9_]*$`)
+)
+
+func ParseMethod(s string) (Method, error) {
+	switch s {
+	case "sum":
+		return Sum, nil
+	case "avg", "average":
+		return Avg, nil
+	case "min":
+		return Min, nil
+	case "max":
+		return Max, nil
+	case "count":
+		return Count, nil
+	}
+	return Sum, fmt.Errorf("unknown aggregation method '%s', should be one of: sum, avg, min, max, count", s)
+}
+
+type Rule struct {
+	Definition string
+	Output     string // output template
+	Frequency  int64  // seconds of bucket
+	Method     Method
+	pattern    *regexp.Regexp
+}
+
+// OutputName return metric name the input aggregated into, false if not match
+func (r *Rule) OutputName(metric string) (string, bool) {
+	m := r.pattern.FindStringSubmatch(metric)
+	if m == nil {
+		return "", false
+	}
+	fields := make(map[string]string)
+	for i, name := range r.pattern.SubexpNames() {
+		if name != "" {
+			fields[name] = m[i]
+		}
+	}
+	out := fieldRegexp.ReplaceAllStringFunc(r.Output, func(f string) string {
+		return fields[strings.Trim(f, "<>")]
+	})
+	return out, true
+}
+
+// ParseRule parse one line of aggregation-rules.conf
+func ParseRule(line string) (*Rule, error) {
+	m := ruleRegexp.FindStringSubmatch(strings.TrimSpace(line))
+	if m == nil {
+		return nil, fmt.Errorf("bad aggregation rule %#v", line)
+	}
+	freq, err := strconv.ParseInt(m[2], 10, 64)
+	if err != nil || freq <= 0 {
+		return nil, fmt.Errorf("bad frequency in aggregation rule %#v", line)
+	}
+	method, err := ParseMethod(m[3])
+	if err != nil {
+		return nil, fmt.Errorf("%s in aggregation rule %#v", err, line)
+	}
+	pattern, err := compileInputPattern(m[4])
+	if err != nil {
+		return nil, fmt.Errorf("%s in aggregation rule %#v", err, line)
+	}
+
+	known := make(map[string]bool)
+	for _, name := range pattern.SubexpNames() {
+		known[name] = true
+	}
+	for _, f := range fieldRegexp.FindAllString(m[1], -1) {
+		if !known[strings.Trim(f, "<>")] {
+			return nil, fmt.Errorf("field %s of output not in input pattern, rule %#v", f, line)
+		}
+	}
+
+	return &Rule{
+		Definition: line,
+		Output:     m[1],
+		Frequency:  freq,
+		Method:     method,
+		pattern:    pattern,
+	}, nil
+}
+
+func compileInputPattern(input string) (*regexp.Regexp, error) {
+	var buf bytes.Buffer
+	buf.WriteString("^")
+	last := 0
+	for _, loc := range fieldRegexp.FindAllStringIndex(input, -1) {
+		buf.WriteString(globToRegexp(input[last:loc[0]]))
+		field := input[loc[0]:loc[1]]
+		name := strings.Trim(field, "<>")
+		if !fieldNameRegex.MatchString(name) {
+			return nil, fmt.Errorf("bad field name %s", field)
+		}
+		if strings.HasPrefix(field, "<<") {
+			buf.WriteString("(?P<" + name + ">.+)")
+		} else {
+			buf.WriteString("(?P<" + name + ">[^.]+)")
+		}
+		last = loc[1]
+	}
+	buf.WriteString(globToRegexp(input[last:]))
+	buf.WriteString("$")
+	return regexp.Compile(buf.String())
+}
+
+func globToRegexp(s string) string {
+	return strings.Replace(regexp.QuoteMeta(s), `\*`, `[^.]*`, -1)
+}
+
+// ReadRules read rules file, empty lines and lines start with # are skipped
+func ReadRules(filePath string) ([]*Rule, error) {
+	file, err := os.Open(filePath)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	rules := make([]*Rule, 0)
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		rule, err := ParseRule(line)
+		if err != nil {
+			return nil, err
+		}
+		rules = append(rules, rule)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	return rules, nil
+}
@@ -0,0 +1,46 @@
+package aggregator
+
+import "testing"
+
+func TestParseRule(t *testing.T) {
+	tests := []struct {
+		rule   string
+		metric string
+		want   string // "" if not match
+	}{
+		{"<env>.applications.<app>.all.requests (60) = sum <env>.applications.<app>.*.requests",
+			"prod.applications.api.host1.requests", "prod.applications.api.all.requests"},
+		{"<env>.applications.<app>.all.requests (60) = sum <env>.applications.<app>.*.requests",
+			"prod.applications.api.host1.sub.requests", ""},
+		{"all.<<path>>.total (10) = count servers.*.<<path>>",
+			"servers.web01.cpu.user", "all.cpu.user.total"},
+		{"a.b.sum (10) = avg a.b-*", "a.b-1", "a.b.sum"},
+		// meta chars are literal
+		{"a.sum (10) = max a.(x)", "a.(x)", "a.sum"},
+		{"a.sum (10) = max a.(x)", "a.x", ""},
+	}
+	for _, tt := range tests {
+		r, err := ParseRule(tt.rule)
+		if err != nil {
+			t.Errorf("%q: %s", tt.rule, err)
+			continue
+		}
+		got, ok := r.OutputName(tt.metric)
+		if ok != (tt.want != "") || got != tt.want {
+			t.Errorf("%q %s: got %q %v, want %q", tt.rule, tt.metric, got, ok, tt.want)
+		}
+	}
+
+	bad := []string{
+		"a.sum = sum a.*",
+		"a.sum (0) = sum a.*",
+		"a.sum (60) = median a.*",
+		"<x>.sum (60) = sum a.*",
+		"<x>.sum (60) = sum a.<1x>",
+	}
+	for _, line := range bad {
+		if _, err := ParseRule(line); err == nil {
+			t.Errorf("expected error for %q", line)
+		}
+	}
+}
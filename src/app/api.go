@@ -1,8 +1,18 @@
 package app
 
 import (
+	"bytes"
+	"compress/gzip"
+	"encoding/json"
+	"errors"
 	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"strings"
 	"github.com/coder-van/v-graphite/src/persists"
+	"github.com/coder-van/v-graphite/src/persists/whisper"
+	"github.com/coder-van/v-graphite/src/receivers"
 	"github.com/coder-van/v-util/log"
 	"gopkg.in/gin-gonic/gin.v1"
 	"math"
@@ -30,6 +40,7 @@ type ApiServer struct {
 	CacheEnable bool
 	cache  *cache.Cache
 	pm     *persists.PersistManager
+	Writer *receivers.Writer // points of /metrics/write go through receiver manager
 	logger *log.Vlogger
 	stat          *statsd.BaseStat
 }
@@ -169,7 +180,15 @@ func (api *ApiServer) renderHandler(c *gin.Context) {
 	renderResponse := make([]*RenderTarget, 0)
 	for _, target := range targets {
 		fmt.Println(target)
-		wfs, err := api.pm.DbInstance.Match(target)
+		var wfs []string
+		exprs, isTagQuery, err := whisper.ParseSeriesByTag(target)
+		if err == nil {
+			if isTagQuery {
+				wfs, err = api.pm.DbInstance.MatchTags(exprs)
+			} else {
+				wfs, err = api.pm.DbInstance.Match(target)
+			}
+		}
 		if err != nil {
 			api.stat.OnErr("error-render-request-target-match", err)
 			c.JSON(400, gin.H{
@@ -248,7 +267,7 @@ func (api *ApiServer) cacheHandler(c *gin.Context) {
 		})
 	}
 	now := time.Now().Unix()
-	if ok, du, l := api.cache.GetMetricInfo(target); ok {
+	if ok, du, l, rule := api.cache.GetMetricInfo(target); ok {
 		if ok {
 			if interval > du {
 				c.JSON(200, "interval out cache")
@@ -260,6 +279,7 @@ func (api *ApiServer) cacheHandler(c *gin.Context) {
 						"datapoints": dps,
 						"count": l,
 						"duration": du,
+						"retention-rule": rule,
 					} )
 				}else {
 					c.JSON(200, "interval out cache")
@@ -296,6 +316,225 @@ func (api *ApiServer) statHandler(c *gin.Context) {
 	return
 }
 
+func (api *ApiServer) tagsHandler(c *gin.Context) {
+	// URL: /tags?filter=regexp
+	api.stat.CounterInc("tags-requests", 1)
+	c.Header("Access-Control-Allow-Origin", "*")
+
+	tags, err := api.pm.DbInstance.Tags.Tags(c.Query("filter"))
+	if err != nil {
+		c.JSON(400, gin.H{"error": err.Error()})
+		return
+	}
+	result := make([]gin.H, 0, len(tags))
+	for _, tag := range tags {
+		result = append(result, gin.H{"tag": tag})
+	}
+	c.JSON(200, result)
+}
+
+func (api *ApiServer) tagDetailHandler(c *gin.Context) {
+	// URL: /tags/<tag>?filter=regexp
+	//      /tags/autoComplete/tags?tagPrefix=&expr=&limit=
+	//      /tags/autoComplete/values?tag=&valuePrefix=&expr=&limit=
+	c.Header("Access-Control-Allow-Origin", "*")
+	tag := c.Param("tag")
+	sub := c.Param("sub")
+
+	if tag == "autoComplete" && sub != "" {
+		api.stat.CounterInc("tags-autocomplete-requests", 1)
+		exprs := c.QueryArray("expr")
+		limit, _ := strconv.Atoi(c.DefaultQuery("limit", "100"))
+
+		var result []string
+		var err error
+		switch sub {
+		case "tags":
+			result, err = api.pm.DbInstance.Tags.AutoCompleteTags(exprs, c.Query("tagPrefix"), limit)
+		case "values":
+			result, err = api.pm.DbInstance.Tags.AutoCompleteValues(exprs, c.Query("tag"),
+				c.Query("valuePrefix"), limit)
+		default:
+			c.JSON(404, gin.H{"error": "unknown autoComplete " + sub})
+			return
+		}
+		if err != nil {
+			c.JSON(400, gin.H{"error": err.Error()})
+			return
+		}
+		c.JSON(200, result)
+		return
+	}
+	if sub != "" {
+		c.JSON(404, gin.H{"error": "not found"})
+		return
+	}
+
+	api.stat.CounterInc("tags-requests", 1)
+	values, err := api.pm.DbInstance.Tags.Values(tag, c.Query("filter"))
+	if err != nil {
+		c.JSON(400, gin.H{"error": err.Error()})
+		return
+	}
+	c.JSON(200, gin.H{
+		"tag":    tag,
+		"values": values,
+	})
+}
+
+const maxWriteBodySize = 32 * 1024 * 1024
+
+type writePoint struct {
+	Name      string      `json:"name"`
+	Value     *float64    `json:"value"`
+	Timestamp json.Number `json:"timestamp"`
+}
+
+type writeRejected struct {
+	Line   int    `json:"line"`
+	Reason string `json:"reason"`
+}
+
+type writeResponse struct {
+	Accepted int             `json:"accepted"`
+	Rejected int             `json:"rejected"`
+	Limited  int             `json:"rate-limited"`
+	Dropped  int             `json:"dropped"` // by backpressure, cache can't keep up
+	Errors   []writeRejected `json:"errors"`
+}
+
+func (wr *writeResponse) reject(line int, reason string) {
+	wr.Rejected++
+	wr.Errors = append(wr.Errors, writeRejected{Line: line, Reason: reason})
+}
+
+// parseWriteLines parse plaintext protocol body, one point each line
+func parseWriteLines(body []byte, wr *writeResponse) []common.MetricPoint {
+	mps := make([]common.MetricPoint, 0)
+	for i, line := range bytes.Split(body, []byte{'\n'}) {
+		if len(bytes.TrimSpace(line)) == 0 {
+			continue
+		}
+		mp, err := common.ParseFromStr(string(line))
+		if err != nil {
+			wr.reject(i+1, err.Error())
+			continue
+		}
+		mps = append(mps, *mp)
+	}
+	return mps
+}
+
+// parseWriteJson parse body like [{"name": "a.b", "value": 1, "timestamp": 1500000000}],
+// timestamp is optional and set to now if missing
+func parseWriteJson(body []byte, wr *writeResponse) ([]common.MetricPoint, error) {
+	var points []writePoint
+	decoder := json.NewDecoder(bytes.NewReader(body))
+	decoder.UseNumber()
+	if err := decoder.Decode(&points); err != nil {
+		return nil, err
+	}
+
+	now := time.Now().Unix()
+	mps := make([]common.MetricPoint, 0, len(points))
+	for i, p := range points {
+		if p.Name == "" || strings.ContainsAny(p.Name, " \t\n") {
+			wr.reject(i+1, fmt.Sprintf("bad metric name %#v", p.Name))
+			continue
+		}
+		name, err := common.NormalizeTagged(p.Name)
+		if err != nil {
+			wr.reject(i+1, err.Error())
+			continue
+		}
+		if p.Value == nil || math.IsNaN(*p.Value) || math.IsInf(*p.Value, 0) {
+			wr.reject(i+1, "bad value for "+p.Name)
+			continue
+		}
+		ts := now
+		if p.Timestamp != "" {
+			f, err := p.Timestamp.Float64()
+			if err != nil || f < 0 {
+				wr.reject(i+1, fmt.Sprintf("bad timestamp %#v", p.Timestamp.String()))
+				continue
+			}
+			ts = int64(f)
+		}
+		mps = append(mps, common.MetricPoint{Key: name, Value: *p.Value, Timestamp: ts})
+	}
+	return mps, nil
+}
+
+func (api *ApiServer) writeHandler(c *gin.Context) {
+	// URL: /metrics/write  body: plaintext lines or json array, gzip allowed
+	api.stat.CounterInc("write-requests", 1)
+
+	var reader io.Reader = http.MaxBytesReader(c.Writer, c.Request.Body, maxWriteBodySize)
+	if strings.Contains(c.Request.Header.Get("Content-Encoding"), "gzip") {
+		gz, err := gzip.NewReader(reader)
+		if err != nil {
+			api.stat.OnErr("error-write-request-gzip", err)
+			c.JSON(400, gin.H{"error": "bad gzip body: " + err.Error()})
+			return
+		}
+		defer gz.Close()
+		// one more byte to tell a body of exactly max size from a larger one
+		reader = io.LimitReader(gz, maxWriteBodySize+1)
+	}
+
+	body, err := ioutil.ReadAll(reader)
+	var tooLarge *http.MaxBytesError
+	if errors.As(err, &tooLarge) || len(body) > maxWriteBodySize {
+		err = fmt.Errorf("body larger than %d bytes", maxWriteBodySize)
+		api.stat.OnErr("error-write-request-too-large", err)
+		c.JSON(413, gin.H{"error": err.Error()})
+		return
+	}
+	if err != nil {
+		api.stat.OnErr("error-write-request-read", err)
+		c.JSON(400, gin.H{"error": "read body fail: " + err.Error()})
+		return
+	}
+
+	wr := &writeResponse{Errors: make([]writeRejected, 0)}
+	var mps []common.MetricPoint
+	trimmed := bytes.TrimSpace(body)
+	if strings.HasPrefix(c.ContentType(), "application/json") ||
+		(len(trimmed) > 0 && trimmed[0] == '[') {
+		mps, err = parseWriteJson(trimmed, wr)
+		if err != nil {
+			api.stat.OnErr("error-write-request-json", err)
+			c.JSON(400, gin.H{"error": "bad json body: " + err.Error()})
+			return
+		}
+	} else {
+		mps = parseWriteLines(body, wr)
+	}
+
+	for _, mp := range mps {
+		switch api.Writer.Write(c.Request.RemoteAddr, mp) {
+		case nil:
+			wr.Accepted++
+		case receivers.ErrRateLimited:
+			wr.Limited++
+		default:
+			wr.Dropped++
+		}
+	}
+	api.stat.CounterInc("write-points-accepted", wr.Accepted)
+	api.stat.CounterInc("write-points-rejected", wr.Rejected)
+
+	code := 200
+	if wr.Accepted == 0 && wr.Limited > 0 {
+		code = 429
+	} else if wr.Accepted == 0 && wr.Dropped > 0 {
+		code = 503
+	} else if wr.Accepted == 0 && wr.Rejected > 0 {
+		code = 400
+	}
+	c.JSON(code, wr)
+}
+
 func (api *ApiServer) Stop() {
 
 }
@@ -315,6 +554,10 @@ func (api *ApiServer) RegisterRouter(addr string) {
 	router.POST("/render", api.renderHandler)
 	router.GET("/cache/", api.cacheHandler)
 	router.GET("/status/", api.statHandler)
+	router.POST("/metrics/write", api.writeHandler)
+	router.GET("/tags", api.tagsHandler)
+	router.GET("/tags/:tag", api.tagDetailHandler)
+	router.GET("/tags/:tag/:sub", api.tagDetailHandler)
 	router.GET("/", func(c *gin.Context) {
 		c.JSON(200, "ok")
 	})
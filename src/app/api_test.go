@@ -0,0 +1,123 @@
+package app
+
+import (
+	"bytes"
+	"compress/gzip"
+	"encoding/json"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/coder-van/v-graphite/src/common"
+	"github.com/coder-van/v-graphite/src/receivers"
+	"gopkg.in/gin-gonic/gin.v1"
+)
+
+func gzipped(t *testing.T, data []byte) []byte {
+	var buf bytes.Buffer
+	gz := gzip.NewWriter(&buf)
+	if _, err := gz.Write(data); err != nil {
+		t.Fatal(err)
+	}
+	if err := gz.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+func TestWriteHandler(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	lines := "a.b 1 1500000000\nbad line\n\n"
+	tooLarge := bytes.Repeat([]byte{'\n'}, maxWriteBodySize+1)
+	tests := []struct {
+		name     string
+		body     []byte
+		header   map[string]string
+		limited  int // limited.* points written before, rate limit is one point
+		queued   int // points queued before, queue holds two
+		code     int
+		want     writeResponse
+		rejected []int // lines rejected
+	}{
+		{"json", []byte(`[{"name": "a.b", "value": 1, "timestamp": 1500000000}, {"name": "a c", "value": 1},
+			{"name": "a.d"}, {"name": "a.e", "value": 1, "timestamp": -1}, {"name": "a.f", "value": 2}]`),
+			nil, 0, 0, 200, writeResponse{Accepted: 2, Rejected: 3}, []int{2, 3, 4}},
+		{"json content type", []byte(` {"name": "a.b"}`), map[string]string{"Content-Type": "application/json"},
+			0, 0, 400, writeResponse{}, nil},
+		{"plaintext", []byte(lines), nil, 0, 0, 200, writeResponse{Accepted: 1, Rejected: 1}, []int{2}},
+		{"gzip", gzipped(t, []byte(lines)), map[string]string{"Content-Encoding": "gzip"},
+			0, 0, 200, writeResponse{Accepted: 1, Rejected: 1}, []int{2}},
+		{"bad gzip", []byte(lines), map[string]string{"Content-Encoding": "gzip"}, 0, 0, 400, writeResponse{}, nil},
+		{"all rejected", []byte("bad line"), nil, 0, 0, 400, writeResponse{Rejected: 1}, []int{1}},
+		{"rate limited", []byte("limited.a 1 1500000000\nlimited.b 1 1500000000\na.b 1 1500000000"),
+			nil, 0, 0, 200, writeResponse{Accepted: 2, Limited: 1}, nil},
+		{"all rate limited", []byte("limited.a 1 1500000000"), nil, 1, 0, 429, writeResponse{Limited: 1}, nil},
+		{"backpressure", []byte("a.b 1 1500000000\na.c 1 1500000000"),
+			nil, 0, 1, 200, writeResponse{Accepted: 1, Dropped: 1}, nil},
+		{"all dropped", []byte("a.b 1 1500000000"), nil, 0, 2, 503, writeResponse{Dropped: 1}, nil},
+		{"too large", tooLarge, nil, 0, 0, 413, writeResponse{}, nil},
+		{"gzip too large", gzipped(t, tooLarge), map[string]string{"Content-Encoding": "gzip"},
+			0, 0, 413, writeResponse{}, nil},
+	}
+	for _, tt := range tests {
+		rm := &receivers.ReceiverManager{ChanPointBagsReceived: make(chan common.MetricPoint, 2)}
+		writer, err := rm.NewWriter("test", receivers.Config{
+			Backpressure:      "drop-newest",
+			RateLimitPrefixes: map[string]float64{"limited.": 0.001},
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		for i := 0; i < tt.limited; i++ {
+			writer.Write("127.0.0.1:1234", common.MetricPoint{Key: "limited.x", Value: 1, Timestamp: 1500000000})
+		}
+		for i := 0; i < tt.queued; i++ {
+			rm.ChanPointBagsReceived <- common.MetricPoint{Key: "queued", Value: 1, Timestamp: 1500000000}
+		}
+		api := NewApiServer(0, false, nil, nil)
+		api.Writer = writer
+		router := gin.New()
+		router.POST("/metrics/write", api.writeHandler)
+
+		req := httptest.NewRequest("POST", "/metrics/write", bytes.NewReader(tt.body))
+		for k, v := range tt.header {
+			req.Header.Set(k, v)
+		}
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, req)
+		if w.Code != tt.code {
+			t.Errorf("%s: status %d, want %d, body %s", tt.name, w.Code, tt.code, w.Body)
+			continue
+		}
+
+		var got writeResponse
+		if err := json.Unmarshal(w.Body.Bytes(), &got); err != nil {
+			t.Errorf("%s: bad response %s, %s", tt.name, w.Body, err)
+			continue
+		}
+		if got.Accepted != tt.want.Accepted || got.Rejected != tt.want.Rejected ||
+			got.Limited != tt.want.Limited || got.Dropped != tt.want.Dropped {
+			t.Errorf("%s: got %+v, want %+v", tt.name, got, tt.want)
+		}
+		if len(got.Errors) != len(tt.rejected) {
+			t.Errorf("%s: errors %+v, want lines %v", tt.name, got.Errors, tt.rejected)
+			continue
+		}
+		for i, line := range tt.rejected {
+			if got.Errors[i].Line != line || got.Errors[i].Reason == "" {
+				t.Errorf("%s: error %d %+v, want line %d", tt.name, i, got.Errors[i], line)
+			}
+		}
+
+		close(rm.ChanPointBagsReceived)
+		points := 0
+		for mp := range rm.ChanPointBagsReceived {
+			if !strings.HasPrefix(mp.Key, "queued") && !strings.HasPrefix(mp.Key, "limited.x") {
+				points++
+			}
+		}
+		if points != tt.want.Accepted {
+			t.Errorf("%s: %d points written, want %d", tt.name, points, tt.want.Accepted)
+		}
+	}
+}
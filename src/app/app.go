@@ -3,6 +3,7 @@ package app
 import (
 	"runtime"
 
+	"github.com/coder-van/v-graphite/src/aggregator"
 	"github.com/coder-van/v-graphite/src/cache"
 	"github.com/coder-van/v-graphite/src/persists"
 	"github.com/coder-van/v-graphite/src/receivers"
@@ -10,7 +11,7 @@ import (
 
 	"fmt"
 	"os"
-	"strings"
+	"path/filepath"
 	"time"
 	"github.com/coder-van/v-graphite/src/common"
 )
@@ -23,7 +24,10 @@ type App struct {
 	Cache           *cache.Cache
 	ReceiverManager *receivers.ReceiverManager
 	PersistManager  *persists.PersistManager
+	Aggregator      *aggregator.Aggregator
 	apiServer       *ApiServer
+	writer          *receivers.Writer
+	carbonlink      *CarbonlinkServer
 }
 
 // New App instance
@@ -50,20 +54,64 @@ func (app *App) Init() error {
 	
 	core := cache.New(cfg.Cache.MaxSize)
 	core.SetWriteStrategy(cfg.Cache.WriteStrategy)
+	if err := core.SetOverflowPolicy(cfg.Cache.OverflowPolicy); err != nil {
+		return err
+	}
+	if err := core.SetRetention(cfg.Cache.Retention, cfg.Cache.DefaultRetention); err != nil {
+		return err
+	}
+	core.SetMemoryBudget(cfg.Cache.MemoryBudget * cache.MB)
+	core.SetPointCompression(cfg.Cache.PointCompression)
+	core.SetIdleTTL(cfg.Cache.IdleTTL)
 	app.Cache = core
 
-	app.ReceiverManager = receivers.New()
+	app.ReceiverManager = receivers.New(cfg.ReceiverChannel.Size)
 	for name, r := range app.Config.Receivers {
-		listen := r.Listen
-		t := strings.SplitN(listen, ":", 2)[0]
-		port := strings.SplitN(listen, ":", 2)[1]
-		receiver, err := app.ReceiverManager.CreateNewReceiver(name, t, port, r.IsPickle)
+		receiver, err := app.ReceiverManager.CreateNewReceiver(name, r)
 		if err != nil {
 			return err
 		}
 		app.ReceiverManager.RegisterReceiver(receiver)
 	}
 	app.ReceiverManager.CachePB = core.Add
+	if app.writer, err = app.ReceiverManager.NewWriter("http", cfg.Api.Write); err != nil {
+		return err
+	}
+	if cfg.WAL.Enable {
+		wal, err := cache.NewWAL(cfg.WAL.Dir, cfg.WAL.SegmentSize*cache.MB,
+			time.Duration(cfg.WAL.SegmentAge)*time.Second, cfg.WAL.Fsync)
+		if err != nil {
+			return err
+		}
+		app.ReceiverManager.WAL = wal
+	}
+	tw := cfg.TimestampWindow
+	if tw.MaxFuture > 0 || tw.MaxPast > 0 || tw.ConvertMillis {
+		app.ReceiverManager.TimeWindow = &common.TimestampWindow{
+			MaxFuture:     tw.MaxFuture,
+			MaxPast:       tw.MaxPast,
+			ConvertMillis: tw.ConvertMillis,
+		}
+	}
+	if err := app.ReceiverManager.LoadFilter(
+		filepath.Join(app.ConfigDir, "whitelist.conf"),
+		filepath.Join(app.ConfigDir, "blacklist.conf")); err != nil {
+		return err
+	}
+	if err := app.ReceiverManager.LoadRewriteRules(
+		filepath.Join(app.ConfigDir, "rewrite-rules.conf")); err != nil {
+		return err
+	}
+
+	if cfg.Aggregator.Enable {
+		rules, err := aggregator.ReadRules(filepath.Join(app.ConfigDir, "aggregation-rules.conf"))
+		if err != nil {
+			return err
+		}
+		app.Aggregator = aggregator.New(rules, cfg.Aggregator.Lag, cfg.Aggregator.KeepInputs)
+		app.Aggregator.Emit = app.ReceiverManager.AddToCache
+		app.ReceiverManager.Aggregate = app.Aggregator.Process
+	}
 	
 	if app.Config.Persist.DataRoot != "" {
 		_, err := os.Stat(app.Config.Persist.DataRoot)
@@ -76,24 +124,44 @@ func (app *App) Init() error {
 
 // Start starts
 func (app *App) Start() (err error) {
-	app.Init()
+	if err = app.Init(); err != nil {
+		return err
+	}
 	conf := app.Config
 
 	runtime.GOMAXPROCS(conf.Common.MaxCPU)
 
+	// restored files are kept by wal until their points are stored
+	wal := app.ReceiverManager.WAL
 	if conf.Cache.DumpEnable {
-		app.Cache.RestoreAll(conf.Cache.DumpPath)
+		app.Cache.RestoreAll(conf.Cache.DumpPath, wal)
+	}
+	if conf.WAL.Enable && !(conf.Cache.DumpEnable && conf.WAL.Dir == conf.Cache.DumpPath) {
+		app.Cache.RestoreAll(conf.WAL.Dir, wal)
 	}
 
 	app.PersistManager = persists.NewPersistManager(app.Cache, time.Millisecond*200.0)
 	app.PersistManager.RegisterWhisper(app.Config.Persist.DataRoot, app.ConfigDir)
+	app.PersistManager.DbInstance.SetThrottle(conf.Persist.MaxUpdatesPerSecond, conf.Persist.MaxCreatesPerMinute)
+	if wal != nil {
+		app.PersistManager.OnPersisted = wal.Truncate
+	}
 	
 	app.PersistManager.Start()
+	if app.Aggregator != nil {
+		app.Aggregator.Start()
+	}
 	app.ReceiverManager.Start()
 
 	app.apiServer = NewApiServer(conf.Api.Port, conf.Api.CacheEnable, app.PersistManager, app.Cache)
+	app.apiServer.Writer = app.writer
 	app.apiServer.Start()
 	
+	if conf.Carbonlink.Listen != "" {
+		app.carbonlink = NewCarbonlinkServer(conf.Carbonlink.Listen, app.PersistManager, app.Cache)
+		app.carbonlink.Start()
+	}
+	
 	stat := NewStat(app.Cache, 5)
 	stat.Start()
 	return
@@ -101,12 +169,27 @@ func (app *App) Start() (err error) {
 
 func (app *App) Stop() {
 	fmt.Println("* app stopping")
-	if app.Config.Cache.DumpEnable {
-		app.Cache.Dump(app.Config.Cache.DumpPath, false)
-	}
+	// receivers and aggregator flush what they hold to cache before dump
 	if app.ReceiverManager != nil {
 		app.ReceiverManager.Stop()
 	}
+	if app.Aggregator != nil {
+		app.Aggregator.Stop()
+	}
+	if app.ReceiverManager != nil && app.ReceiverManager.WAL != nil {
+		app.ReceiverManager.WAL.Close()
+	}
+	if app.carbonlink != nil {
+		app.carbonlink.Stop()
+	}
+	if app.Config.Cache.DumpEnable {
+		err := app.Cache.Dump(app.Config.Cache.DumpPath, app.Config.Cache.DumpBinary)
+		// dump holds every point not stored yet, wal segments would only
+		// restore them twice
+		if err == nil && app.ReceiverManager != nil && app.ReceiverManager.WAL != nil {
+			app.ReceiverManager.WAL.Truncate(time.Now())
+		}
+	}
 
 	if app.PersistManager != nil {
 		app.PersistManager.Stop()
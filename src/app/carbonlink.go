@@ -0,0 +1,176 @@
+package app
+
+/*
+Carbonlink is how graphite-web asks carbon-cache for points not written to
+whisper yet. Requests and responses are pickled dicts framed by a 4 bytes big
+endian length, see carbon/lib/carbon/protocols.py CacheManagementHandler.
+*/
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net"
+	"strings"
+	"time"
+
+	"github.com/coder-van/v-graphite/src/cache"
+	"github.com/coder-van/v-graphite/src/common"
+	"github.com/coder-van/v-graphite/src/persists"
+	"github.com/coder-van/v-stats"
+	"github.com/coder-van/v-util/log"
+)
+
+const (
+	carbonlinkIdleTimeout  = 2 * time.Minute
+	carbonlinkMaxFrameSize = 1024 * 1024 // requests are small, bulk queries of many metrics included
+)
+
+type CarbonlinkServer struct {
+	Addr     string
+	cache    *cache.Cache
+	pm       *persists.PersistManager
+	listener net.Listener
+	logger   *log.Vlogger
+	stat     *statsd.BaseStat
+}
+
+func NewCarbonlinkServer(addr string, pm *persists.PersistManager, c *cache.Cache) *CarbonlinkServer {
+	return &CarbonlinkServer{
+		Addr:   addr,
+		cache:  c,
+		pm:     pm,
+		logger: log.GetLogger("carbonlink", log.RotateModeMonth),
+		stat:   common.GetStat("carbonlink"),
+	}
+}
+
+func (cl *CarbonlinkServer) Start() {
+	fmt.Println("* Carbonlink starting")
+	go cl.Listen()
+}
+
+// Listen 是阻塞的 需要调用时加 go
+func (cl *CarbonlinkServer) Listen() error {
+	ln, err := net.Listen("tcp", cl.Addr)
+	if err != nil {
+		cl.logger.Printf("carbonlink listen %s failed, %s \n", cl.Addr, err)
+		return err
+	}
+	cl.listener = ln
+	defer ln.Close()
+
+	fmt.Println("* Carbonlink started")
+	for {
+		conn, err := ln.Accept()
+		if err != nil {
+			if strings.Contains(err.Error(), "use of closed network connection") {
+				break
+			}
+			continue
+		}
+		go cl.handleConn(conn)
+	}
+	return nil
+}
+
+func (cl *CarbonlinkServer) Stop() {
+	fmt.Println("* Carbonlink closing")
+	if cl.listener != nil {
+		cl.listener.Close()
+	}
+	fmt.Println("* Carbonlink closed")
+}
+
+// handleConn answer requests of a connection one by one, graphite-web keeps
+// connections open between queries
+func (cl *CarbonlinkServer) handleConn(conn net.Conn) {
+	cl.stat.GaugeInc("active_conn", 1)
+	defer cl.stat.GaugeDec("active_conn", -1)
+	defer conn.Close()
+
+	c, _ := common.NewConn(conn, byte(4), binary.BigEndian)
+	c.MaxFrameSize = carbonlinkMaxFrameSize
+	for {
+		conn.SetReadDeadline(time.Now().Add(carbonlinkIdleTimeout))
+		data, err := c.ReadFrame()
+		if err != nil {
+			if err != io.EOF {
+				cl.logger.Printf("carbonlink conn %s read frame error %s \n", conn.RemoteAddr(), err)
+			}
+			return
+		}
+
+		var response map[string]interface{}
+		request, err := common.Unpickle(data)
+		if req, ok := request.(map[string]interface{}); err == nil && ok {
+			response = cl.handleRequest(req)
+		} else {
+			cl.stat.CounterInc("bad-requests", 1)
+			response = map[string]interface{}{"error": "Invalid request"}
+		}
+
+		out, err := common.Pickle(response)
+		if err != nil {
+			cl.stat.OnErr("error-carbonlink-pickle", err)
+			return
+		}
+		// responses of bulk queries may be bigger than MaxFrameSize of requests
+		frame := make([]byte, 4, 4+len(out))
+		binary.BigEndian.PutUint32(frame, uint32(len(out)))
+		if _, err = conn.Write(append(frame, out...)); err != nil {
+			cl.logger.Printf("carbonlink conn %s write error %s \n", conn.RemoteAddr(), err)
+			return
+		}
+	}
+}
+
+func (cl *CarbonlinkServer) handleRequest(req map[string]interface{}) map[string]interface{} {
+	reqType, _ := req["type"].(string)
+	metric, _ := req["metric"].(string)
+	cl.stat.CounterInc("requests", 1)
+
+	switch reqType {
+	case "cache-query":
+		return map[string]interface{}{"datapoints": cl.datapoints(metric)}
+	case "cache-query-bulk":
+		metrics, _ := req["metrics"].([]interface{})
+		byMetric := make(map[string]interface{}, len(metrics))
+		for _, m := range metrics {
+			if name, ok := m.(string); ok {
+				byMetric[name] = cl.datapoints(name)
+			}
+		}
+		return map[string]interface{}{"datapointsByMetric": byMetric}
+	case "get-metadata":
+		key, _ := req["key"].(string)
+		value, err := cl.pm.DbInstance.GetMetadata(metric, key)
+		if err != nil {
+			return map[string]interface{}{"error": err.Error()}
+		}
+		return map[string]interface{}{"value": value}
+	case "get-storageschema":
+		archives, ok := cl.pm.DbInstance.ArchiveConfig(metric)
+		if !ok {
+			return map[string]interface{}{"error": fmt.Sprintf("no storage schema for metric %s", metric)}
+		}
+		config := make([]interface{}, 0, len(archives))
+		for _, a := range archives {
+			config = append(config, common.PickleTuple{a[0], a[1]})
+		}
+		return map[string]interface{}{"archiveConfig": config}
+	}
+	cl.stat.CounterInc("bad-requests", 1)
+	return map[string]interface{}{"error": fmt.Sprintf("Invalid request type \"%s\"", reqType)}
+}
+
+// datapoints of metric in cache, stored by whisper or not, as list of
+// (timestamp, value) tuples
+func (cl *CarbonlinkServer) datapoints(metric string) []interface{} {
+	points := cl.cache.PointsWithPending(metric)
+	datapoints := make([]interface{}, 0, len(points))
+	for _, p := range points {
+		datapoints = append(datapoints, common.PickleTuple{p.Timestamp, p.Value})
+	}
+	return datapoints
+}
@@ -0,0 +1,136 @@
+package app
+
+import (
+	"encoding/binary"
+	"io"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/coder-van/v-graphite/src/cache"
+	"github.com/coder-van/v-graphite/src/common"
+	"github.com/coder-van/v-graphite/src/persists"
+	"github.com/coder-van/v-graphite/src/persists/whisper"
+)
+
+// carbonlinkCall send request in a frame and read the unpickled response
+func carbonlinkCall(t *testing.T, conn net.Conn, request []byte) interface{} {
+	frame := make([]byte, 4, 4+len(request))
+	binary.BigEndian.PutUint32(frame, uint32(len(request)))
+	if _, err := conn.Write(append(frame, request...)); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := io.ReadFull(conn, frame); err != nil {
+		t.Fatal(err)
+	}
+	out := make([]byte, binary.BigEndian.Uint32(frame))
+	if _, err := io.ReadFull(conn, out); err != nil {
+		t.Fatal(err)
+	}
+	response, err := common.Unpickle(out)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return response
+}
+
+func TestCarbonlink(t *testing.T) {
+	dir, err := ioutil.TempDir("", "carbonlink")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	schemas := "[default]\npattern = .*\nretentions = 60s:1d\n"
+	if err := ioutil.WriteFile(filepath.Join(dir, "storage-schemas.conf"), []byte(schemas), 0644); err != nil {
+		t.Fatal(err)
+	}
+	retentions, err := whisper.ParseRetentionMaps("60s:1d")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.MkdirAll(filepath.Join(dir, "a"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	wf, err := whisper.Create(whisper.MetricPath(dir, "a.b"), retentions, whisper.Max, 0.5)
+	if err != nil {
+		t.Fatal(err)
+	}
+	wf.Close()
+
+	// an old point out of cache retention and one handed to db, neither is
+	// stored yet, and one waiting for db
+	now := time.Now().Unix()
+	c := cache.New(0)
+	c.Add(common.MetricPoint{Key: "a.b", Value: 1, Timestamp: 1500000000})
+	c.Add(common.MetricPoint{Key: "a.b", Value: 2, Timestamp: now - 60})
+	c.MakeChanForDB()
+	for len(c.ChanForDB) > 0 {
+		<-c.ChanForDB
+	}
+	c.Add(common.MetricPoint{Key: "a.b", Value: 3, Timestamp: now})
+
+	pm := persists.NewPersistManager(c, time.Second)
+	pm.RegisterWhisper(dir, dir)
+	pm.DbInstance.Init()
+	cl := NewCarbonlinkServer("", pm, c)
+	client, server := net.Pipe()
+	defer client.Close()
+	go cl.handleConn(server)
+
+	datapoints := []interface{}{
+		[]interface{}{int64(1500000000), 1.0},
+		[]interface{}{now - 60, 2.0},
+		[]interface{}{now, 3.0},
+	}
+	tests := []struct {
+		request interface{}
+		want    map[string]interface{}
+	}{
+		{map[string]interface{}{"type": "cache-query", "metric": "a.b"},
+			map[string]interface{}{"datapoints": datapoints}},
+		{map[string]interface{}{"type": "cache-query", "metric": "x.y"},
+			map[string]interface{}{"datapoints": []interface{}{}}},
+		{map[string]interface{}{"type": "cache-query-bulk", "metrics": []interface{}{"a.b", "x.y"}},
+			map[string]interface{}{"datapointsByMetric": map[string]interface{}{
+				"a.b": datapoints,
+				"x.y": []interface{}{},
+			}}},
+		{map[string]interface{}{"type": "get-metadata", "metric": "a.b", "key": "aggregationMethod"},
+			map[string]interface{}{"value": "max"}},
+		{map[string]interface{}{"type": "get-storageschema", "metric": "a.b"},
+			map[string]interface{}{"archiveConfig": []interface{}{[]interface{}{int64(60), int64(1440)}}}},
+		{map[string]interface{}{"type": "drop-cache", "metric": "a.b"},
+			map[string]interface{}{"error": "Invalid request type \"drop-cache\""}},
+		{[]interface{}{"cache-query", "a.b"},
+			map[string]interface{}{"error": "Invalid request"}},
+	}
+	for _, tt := range tests {
+		got := carbonlinkCall(t, client, mustPickle(t, tt.request))
+		if !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("%v: got %#v, want %#v", tt.request, got, tt.want)
+		}
+	}
+
+	// errors are answered, connection is still usable
+	got := carbonlinkCall(t, client, []byte("not a pickle"))
+	if !reflect.DeepEqual(got, map[string]interface{}{"error": "Invalid request"}) {
+		t.Errorf("garbage: got %#v", got)
+	}
+	got = carbonlinkCall(t, client, mustPickle(t, map[string]interface{}{
+		"type": "get-metadata", "metric": "x.y", "key": "aggregationMethod"}))
+	if resp, ok := got.(map[string]interface{}); !ok || resp["error"] == nil {
+		t.Errorf("metadata of missing file: got %#v, want error", got)
+	}
+}
+
+func mustPickle(t *testing.T, v interface{}) []byte {
+	data, err := common.Pickle(v)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return data
+}
@@ -3,9 +3,10 @@ package app
 import (
 	"fmt"
 	"github.com/BurntSushi/toml"
+	"github.com/coder-van/v-graphite/src/cache"
+	"github.com/coder-van/v-graphite/src/receivers"
 	"os"
 	"path/filepath"
-	"strconv"
 )
 
 const FileName = "carbon.conf"
@@ -28,6 +29,9 @@ type loggingConfig struct {
 type whisperConfig struct {
 	DataRoot        string `toml:"data-dir"`
 	SchemasFilename string `toml:"schemas-file"`
+	// 0 means no limit, points of files not allowed to create stay in cache
+	MaxUpdatesPerSecond int `toml:"max-updates-per-second"`
+	MaxCreatesPerMinute int `toml:"max-creates-per-minute"`
 }
 
 type persist struct {
@@ -37,29 +41,52 @@ type persist struct {
 type cacheConfig struct {
 	MaxSize       int64  `toml:"max-size"`
 	WriteStrategy string `toml:"write-strategy"`
+	// drop-new, drop-persisted or block when cache reach max-size
+	OverflowPolicy string `toml:"overflow-policy"`
 	DumpPath      string `toml:"dump-path"`
 	DumpEnable    bool   `toml:"dump-enable"`
+	DumpBinary    bool   `toml:"dump-binary"` // binary dump is smaller and faster than text
+	// seconds metrics matched by none of retention rules stay in cache
+	DefaultRetention int64                 `toml:"default-retention"`
+	Retention        []cache.RetentionRule `toml:"retention"`
+	MemoryBudget     int64                 `toml:"memory-budget"` // MB, 0 means no limit
+	PointCompression bool                  `toml:"point-compression"` // keep points gorilla compressed, off by default
+	IdleTTL          int64                 `toml:"idle-ttl"` // seconds, 0 means metrics are never evicted
+}
+
+type walConfig struct {
+	Enable      bool   `toml:"enable"`
+	Dir         string `toml:"dir"`          // default dump-path of cache, where segments are replayed
+	SegmentSize int64  `toml:"segment-size"` // MB
+	SegmentAge  int64  `toml:"segment-age"`  // seconds
+	Fsync       string `toml:"fsync"`        // always, interval or never
 }
 
 type cacheQueryConfig struct {
-	Listen   string `toml:"listen"`
+	Listen   string `toml:"listen"` // host:port of carbonlink, empty means disabled
 	IsPickle bool   `toml:"is-pickle"`
 }
 
-type receiverConfig struct {
-	Listen   string `toml:"listen"`
-	IsPickle bool   `toml:"is-pickle"`
+type receiverChannelConfig struct {
+	Size int `toml:"size"`
+}
+
+type timestampWindowConfig struct {
+	MaxFuture     int64 `toml:"max-future"` // seconds, 0 means no limit
+	MaxPast       int64 `toml:"max-past"`   // seconds, 0 means no limit
+	ConvertMillis bool  `toml:"convert-millis"`
+}
+
+type aggregatorConfig struct {
+	Enable     bool  `toml:"enable"`
+	Lag        int64 `toml:"lag"`         // seconds to wait late points after bucket end
+	KeepInputs bool  `toml:"keep-inputs"` // also cache points matched by rules
 }
 
 type apiConfig struct {
 	Port        int `toml:"port"`
 	CacheEnable bool   `toml:"cache-enable"`
-}
-
-func (c *receiverConfig) String() string {
-	str := "Listen string =" + string(c.Listen)
-	str += "IsPickle  bool=" + strconv.FormatBool(c.IsPickle)
-	return str
+	Write       receivers.Config `toml:"write"` // rate limits and backpressure of /metrics/write
 }
 
 // Config ...
@@ -68,9 +95,14 @@ type Config struct {
 	Dir        string
 	Common     commConfig                `toml:"util"`
 	Cache      cacheConfig               `toml:"cache"`
+	WAL        walConfig                 `toml:"wal"`
+	Carbonlink cacheQueryConfig          `toml:"carbonlink"`
 	Persist    whisperConfig             `toml:"whisper"`
 	Logging    loggingConfig             `toml:"logging"`
-	Receivers  map[string]receiverConfig `toml:"receivers"`
+	Receivers  map[string]receivers.Config `toml:"receivers"`
+	ReceiverChannel receiverChannelConfig `toml:"receiver-channel"`
+	TimestampWindow timestampWindowConfig `toml:"timestamp-window"`
+	Aggregator aggregatorConfig          `toml:"aggregator"`
 	Api        apiConfig                 `toml:"api"`
 }
 
@@ -82,6 +114,21 @@ func NewConfig() *Config {
 		Cache: cacheConfig{
 			MaxSize:       1000000,
 			WriteStrategy: "max",
+			OverflowPolicy: "drop-persisted",
+			DumpBinary:     true,
+			DefaultRetention: cache.DefaultRetention,
+		},
+		WAL: walConfig{
+			SegmentSize: 64,
+			SegmentAge:  60,
+			Fsync:       "interval",
+		},
+		ReceiverChannel: receiverChannelConfig{
+			Size: receivers.DefaultChannelSize,
+		},
+		Aggregator: aggregatorConfig{
+			Lag:        5,
+			KeepInputs: true,
 		},
 	}
 
@@ -135,6 +182,10 @@ func (c *Config) Check() {
 		c.Cache.MaxSize = 1024*1024
 	}
 	
+	if c.WAL.Dir == "" {
+		c.WAL.Dir = c.Cache.DumpPath
+	}
+	
 	if c.Api.Port <= 0 {
 		c.Api.Port = 8080
 	}
@@ -5,6 +5,7 @@ Based on https://github.com/orcaman/concurrent-map
 */
 
 import (
+	"sort"
 	"sync"
 	"sync/atomic"
 
@@ -23,53 +24,143 @@ const (
 	TimeSortedStrategy
 )
 
+// OverflowPolicy is what Cache.Add does when cache reach SizeLimit
+type OverflowPolicy int
+
+const (
+	OverflowDropNew       OverflowPolicy = iota // drop the incoming point
+	OverflowDropPersisted                       // delete oldest points already persisted to make room
+	OverflowBlock                               // wait until persisted points can be deleted
+)
+
 const shardCount = 1024
 
+// when overflow, persisted points are deleted until cache size is under
+// SizeLimit * overflowLowWatermark, so eviction doesn't run for every point
+const overflowLowWatermark = 0.9
+
+const overflowBlockInterval = 10 * time.Millisecond
+
 type CachePointBag struct {
 	sync.RWMutex
-	common.PointBag
+	Metric      string
+	points      pointStore
 	// persistTime  int64  // time record persist
 	PointsToDb  []common.Point
 	duration    int64  // seconds from now point cache, for cache hit
+	rule        *RetentionRule
+	trimmedUntil int64 // points before it may have been evicted, cache can't answer for them
+	lastAdd     int64  // unix time last point added
+	pendingSince int64 // unix nano the oldest point of PointsToDb added, 0 if none
+	// bags handed to db and not done yet, with pendingSince when handed
+	inflight    map[*common.PointBag]int64
 }
 
 // Add point to list with sort by timestamp
 func (cpb *CachePointBag) Add(point common.Point) (expiredNum int) {
-	// first delete point expired
-	now := time.Now().Unix()
-	var index int = 0
-	for i, p := range cpb.Data {
-		if p.Timestamp >= now - cpb.duration {
-			break
-		}
-		index = i
-	}
 	cpb.Lock()
-	
-	if index > 0 {
-		cpb.Data = cpb.Data[index:]
-	}
-	expiredNum = index
-	last := len(cpb.Data) -1
+	t := time.Now()
+	now := t.Unix()
+	cpb.lastAdd = now
+	// first delete point expired
+	expiredNum = cpb.expire(now)
 	
 	// push point at right location, maybe some point reach delay
-	cpb.Data = append(cpb.Data, point)
-	for i := last; i >0; i-- {
-		if cpb.Data[i].Timestamp < point.Timestamp {
-			break
-		}
-		cpb.Data[i+1] = cpb.Data[i]
-		cpb.Data[i] = point
-	}
+	cpb.points.Insert(point)
 	
 	if cpb.PointsToDb == nil {
 		cpb.PointsToDb = make([]common.Point, 0)
 	}
+	if len(cpb.PointsToDb) == 0 {
+		cpb.pendingSince = t.UnixNano()
+	}
 	cpb.PointsToDb = append(cpb.PointsToDb, point)
 	cpb.Unlock()
 	return
 }
 
+// expire delete points older than duration, caller holds the lock
+func (cpb *CachePointBag) expire(now int64) int {
+	return cpb.points.TrimBefore(now - cpb.duration)
+}
+
+// Idle report whether no point added for ttl seconds and all points are
+// stored by db, and how many points it keeps, ttl 0 means never idle
+func (cpb *CachePointBag) Idle(now, ttl int64) (bool, int) {
+	cpb.RLock()
+	defer cpb.RUnlock()
+	if ttl <= 0 || now-cpb.lastAdd < ttl || cpb.unpersisted() > 0 {
+		return false, 0
+	}
+	return true, cpb.points.Len()
+}
+
+// Expire delete points older than duration, return how many deleted
+func (cpb *CachePointBag) Expire(now int64) int {
+	cpb.Lock()
+	defer cpb.Unlock()
+	return cpb.expire(now)
+}
+
+// EvictPersisted delete the older half of points already stored by db,
+// points waiting for or handed to db are kept, return how many deleted
+func (cpb *CachePointBag) EvictPersisted() int {
+	cpb.Lock()
+	defer cpb.Unlock()
+
+	// points older than any point waiting for or handed to db are persisted
+	pending := false
+	var oldest int64
+	older := func(points []common.Point) {
+		for _, p := range points {
+			if !pending || p.Timestamp < oldest {
+				pending, oldest = true, p.Timestamp
+			}
+		}
+	}
+	older(cpb.PointsToDb)
+	for pb := range cpb.inflight {
+		older(pb.Data)
+	}
+	persisted := cpb.points.Len()
+	if pending {
+		persisted = cpb.points.CountBefore(oldest)
+	}
+
+	n := (persisted + 1) / 2
+	if n > 0 {
+		cpb.trimmedUntil = cpb.points.DeleteFirst(n) + 1
+	}
+	return n
+}
+
+// PointBag return a copy of cached points, not points waiting for db
+func (cpb *CachePointBag) PointBag() *common.PointBag {
+	cpb.RLock()
+	defer cpb.RUnlock()
+	return &common.PointBag{Metric: cpb.Metric, Data: cpb.points.Points()}
+}
+
+// PendingBag return a copy of points not stored by db yet, handed to db or
+// still waiting for it, no matter they are in retention or not
+func (cpb *CachePointBag) PendingBag() *common.PointBag {
+	cpb.RLock()
+	defer cpb.RUnlock()
+	pb := common.NewPointsBag(cpb.Metric)
+	for inflight := range cpb.inflight {
+		pb.Data = append(pb.Data, inflight.Data...)
+	}
+	pb.Data = append(pb.Data, cpb.PointsToDb...)
+	return pb
+}
+
+// Bytes return memory used by cached points
+func (cpb *CachePointBag) Bytes() int64 {
+	cpb.RLock()
+	defer cpb.RUnlock()
+	return cpb.points.Bytes() + int64(cap(cpb.PointsToDb))*pointBytes
+}
+
 //
 func (cpb *CachePointBag) GetPointBagForDb() *common.PointBag{
 	cpb.Lock()
@@ -83,19 +174,54 @@ func (cpb *CachePointBag) GetPointBagForDb() *common.PointBag{
 	for _, p := range cpb.PointsToDb {
 		pb.Append(p)
 	}
+	if len(pb.Data) > 0 {
+		if cpb.inflight == nil {
+			cpb.inflight = make(map[*common.PointBag]int64)
+		}
+		cpb.inflight[pb] = cpb.pendingSince
+	}
 	cpb.PointsToDb = nil
+	cpb.pendingSince = 0
 	return pb
 }
 
+// unpersistedSince return unix nano the oldest point not stored by db yet
+// was added, waiting or handed to db, 0 if all are stored
+func (cpb *CachePointBag) unpersistedSince() int64 {
+	cpb.RLock()
+	defer cpb.RUnlock()
+	return cpb.unpersisted()
+}
+
+// unpersisted is unpersistedSince, caller holds the lock
+func (cpb *CachePointBag) unpersisted() int64 {
+	since := cpb.pendingSince
+	for _, t := range cpb.inflight {
+		if since == 0 || t < since {
+			since = t
+		}
+	}
+	return since
+}
+
 // A "thread" safe map of type string:Anything.
 // To avoid lock bottlenecks this map is dived to several (shardCount) map shards.
 type Cache struct {
 	SizeLimit     int64  // limit when add pointBag ,if the pointBag data size over this limit, drop it
 	writeStrategy WriteStrategy
+	overflowPolicy OverflowPolicy
+	evictLock     sync.Mutex // one eviction at a time
 	data          []*Shard
 	ChanForDB     chan *common.PointBag
 	
 	size          int64
+	nameBytes     int64 // total length of metric names, for memory estimate
+	
+	MemoryBudget     int64 // bytes, 0 means no limit
+	IdleTTL          int64 // seconds, point bags without new points this long are evicted, 0 means never
+	compressPoints   bool  // keep points in gorilla chunks instead of slices
+	retention        []*RetentionRule
+	defaultRetention *RetentionRule
 	
 	logger        *log.Vlogger
 	stat          *statsd.BaseStat
@@ -113,11 +239,13 @@ type Shard struct {
 func New(sizeLimit int64) *Cache {
 	c := &Cache{
 		writeStrategy: TimeSortedStrategy,
+		overflowPolicy: OverflowDropPersisted,
 		SizeLimit:     sizeLimit, // default 1M
 		data:          make([]*Shard, shardCount),
 		ChanForDB:     make(chan *common.PointBag, 1024*1024), // 1M  // TODO set from config
 		stat:          common.GetStat("cache"),
 		logger:        log.GetLogger("cache", log.RotateMode16M),
+		defaultRetention: &RetentionRule{Pattern: "default", Duration: DefaultRetention},
 	}
 
 	for i := 0; i < shardCount; i++ {
@@ -145,13 +273,12 @@ func (c *Cache) Get(key string, from, util int64) (bool, []common.Point) {
 	shard.Lock()
 	defer shard.Unlock()
 	if p, exists := shard.items[key]; exists {
-		fmt.Println(time.Now().Unix() - p.duration)
-		if from >= time.Now().Unix() - p.duration {
-			for _, dp := range p.Data {
-				if dp.Timestamp >= from && dp.Timestamp <= util{
-					data = append(data, dp)
-				}
-			}
+		if from >= time.Now().Unix() - p.duration && from >= p.trimmedUntil {
+			p.RLock()
+			p.points.Range(from, util, func(dp common.Point) {
+				data = append(data, dp)
+			})
+			p.RUnlock()
 			return true, data
 			
 		}else{
@@ -161,36 +288,88 @@ func (c *Cache) Get(key string, from, util int64) (bool, []common.Point) {
 	}
 	return false, nil
 }
-func (c *Cache) GetMetricInfo(key string) (bool, int64, int) {
+// Points return all cached points of metric key in time order, nil if not
+// cached
+func (c *Cache) Points(key string) []common.Point {
 	c.stat.CounterInc("query-times", 1)
 	shard := c.GetShard(key)
 
 	shard.Lock()
 	defer shard.Unlock()
 	if p, exists := shard.items[key]; exists {
-		return true, p.duration, len(p.Data)
+		p.RLock()
+		defer p.RUnlock()
+		return p.points.Points()
 	}
-	return false, 0, 0
+	return nil
+}
+
+// PointsWithPending return cached points of metric key merged with points
+// not stored by db yet, which may be out of cache retention already, in time
+// order, for a timestamp the latest value wins, nil if not cached
+func (c *Cache) PointsWithPending(key string) []common.Point {
+	c.stat.CounterInc("query-times", 1)
+	shard := c.GetShard(key)
+
+	shard.Lock()
+	defer shard.Unlock()
+	p, exists := shard.items[key]
+	if !exists {
+		return nil
+	}
+	p.RLock()
+	defer p.RUnlock()
+
+	// handed to db before waiting ones, cached points have the latest values
+	values := make(map[int64]float64)
+	for inflight := range p.inflight {
+		for _, dp := range inflight.Data {
+			values[dp.Timestamp] = dp.Value
+		}
+	}
+	for _, dp := range p.PointsToDb {
+		values[dp.Timestamp] = dp.Value
+	}
+	for _, dp := range p.points.Points() {
+		values[dp.Timestamp] = dp.Value
+	}
+
+	points := make([]common.Point, 0, len(values))
+	for ts, v := range values {
+		points = append(points, common.Point{Timestamp: ts, Value: v})
+	}
+	sort.Slice(points, func(i, j int) bool { return points[i].Timestamp < points[j].Timestamp })
+	return points
+}
+
+// GetMetricInfo return retention duration, points count and pattern of the
+// retention rule of metric key
+func (c *Cache) GetMetricInfo(key string) (bool, int64, int, string) {
+	c.stat.CounterInc("query-times", 1)
+	shard := c.GetShard(key)
+
+	shard.Lock()
+	defer shard.Unlock()
+	if p, exists := shard.items[key]; exists {
+		p.RLock()
+		defer p.RUnlock()
+		return true, p.duration, p.points.Len(), p.rule.Pattern
+	}
+	return false, 0, 0, ""
 }
 
 // Sets the given value under the specified key.
 func (c *Cache) Add(p common.MetricPoint) {
 	c.logger.DebugFilter( fiterCpuTotal(p.Key), "Cache add ", p)
-	//if c.SizeLimit > 0 && c.Size() > c.SizeLimit {
-	//	c.stat.CounterInc("overflow-count", 1)
-	//	c.logger.DebugFilter( fiterCpuTotal(p.Key), "Cache add overflow", p)
-	//	return
-	//}
+	if c.SizeLimit > 0 && c.Size() >= c.SizeLimit && !c.overflow(p) {
+		return
+	}
 	// Get map shard.
 	shard := c.GetShard(p.Key)
 
 	shard.Lock()
 	if _, exists := shard.items[p.Key]; !exists {
-		shard.items[p.Key] = &CachePointBag{
-			PointBag:   *common.NewPointsBag(p.Key),
-			PointsToDb: make([]common.Point, 0),
-			duration:   3600,
-		}
+		shard.items[p.Key] = c.newPointBag(p.Key)
 	}
 	expiredNum := shard.items[p.Key].Add(common.Point{p.Value, p.Timestamp})
 	shard.Unlock()
@@ -203,6 +382,102 @@ func (c *Cache) Add(p common.MetricPoint) {
 	c.stat.GaugeUpdate("point-count", atomic.LoadInt64(&c.size))
 }
 
+// newPointBag create point bag of metric key with its retention rule
+func (c *Cache) newPointBag(key string) *CachePointBag {
+	rule := c.retentionOf(key)
+	atomic.AddInt64(&c.nameBytes, int64(len(key)))
+	return &CachePointBag{
+		Metric:     key,
+		points:     newPointStore(c.compressPoints, rule.Duration),
+		PointsToDb: make([]common.Point, 0),
+		duration:   rule.Duration,
+		rule:       rule,
+	}
+}
+
+// overflow apply overflow policy when cache is full, return false if p
+// should be dropped
+func (c *Cache) overflow(p common.MetricPoint) bool {
+	c.stat.CounterInc("overflow-count", 1)
+
+	switch c.overflowPolicy {
+	case OverflowDropPersisted:
+		if c.evictPersisted() {
+			return true
+		}
+	case OverflowBlock:
+		start := time.Now()
+		for !c.evictPersisted() {
+			time.Sleep(overflowBlockInterval)
+		}
+		c.stat.CounterInc("overflow-block-ms", int(time.Since(start)/time.Millisecond))
+		return true
+	}
+
+	c.stat.CounterInc("overflow-dropped", 1)
+	c.logger.DebugFilter( fiterCpuTotal(p.Key), "Cache add overflow", p)
+	return false
+}
+
+// evictPersisted delete oldest persisted points until size is under low
+// watermark, report whether there is room for a new point
+func (c *Cache) evictPersisted() bool {
+	c.evictLock.Lock()
+	defer c.evictLock.Unlock()
+
+	// another goroutine may have made room already
+	if c.Size() < c.SizeLimit {
+		return true
+	}
+
+	target := int64(float64(c.SizeLimit) * overflowLowWatermark)
+	for c.Size() > target {
+		removed := 0
+		for i := 0; i < shardCount && c.Size()-int64(removed) > target; i++ {
+			shard := c.data[i]
+			shard.Lock()
+			for _, cpb := range shard.items {
+				removed += cpb.EvictPersisted()
+			}
+			shard.Unlock()
+		}
+		if removed == 0 {
+			break
+		}
+		atomic.AddInt64(&c.size, 0-int64(removed))
+		c.stat.CounterInc("overflow-evicted", removed)
+	}
+	c.stat.GaugeUpdate("point-count", c.Size())
+	return c.Size() < c.SizeLimit
+}
+
+// SetPointCompression keep points of point bags created later compressed,
+// see gorilla.go
+func (c *Cache) SetPointCompression(on bool) {
+	c.compressPoints = on
+}
+
+// SetIdleTTL evict point bags of metrics not reporting for ttl seconds, once
+// their points are stored by db, 0 means never
+func (c *Cache) SetIdleTTL(ttl int64) {
+	c.IdleTTL = ttl
+}
+
+// SetOverflowPolicy ...
+func (c *Cache) SetOverflowPolicy(s string) error {
+	switch s {
+	case "drop-new":
+		c.overflowPolicy = OverflowDropNew
+	case "drop-persisted":
+		c.overflowPolicy = OverflowDropPersisted
+	case "block":
+		c.overflowPolicy = OverflowBlock
+	default:
+		return fmt.Errorf("Unknown overflow policy '%s', should be one of: drop-new, drop-persisted, block", s)
+	}
+	return nil
+}
+
 // SetAddSizeLimit  set limit when add point bag ,if data num of point-bag over the limit ,drop the point-bag
 func (c *Cache) SetAddSizeLimit(maxSize int64) {
 	c.SizeLimit = int64(maxSize)
@@ -222,7 +497,7 @@ func (c *Cache) Len() int32 {
 
 // Get the num of how much point in cache, note that one point-bag has many point
 func (c *Cache) Size() int64 {
-	return c.size
+	return atomic.LoadInt64(&c.size)
 }
 
 func fiterCpuTotal(key string) bool {
@@ -0,0 +1,107 @@
+package cache
+
+import (
+	"testing"
+	"time"
+
+	"github.com/coder-van/v-graphite/src/common"
+)
+
+// takeAll return bags sent to ChanForDB
+func takeAll(c *Cache) map[string]*common.PointBag {
+	bags := make(map[string]*common.PointBag)
+	for {
+		select {
+		case pb := <-c.ChanForDB:
+			bags[pb.Metric] = pb
+		default:
+			return bags
+		}
+	}
+}
+
+// cached report whether point p is in cache
+func cached(c *Cache, p common.MetricPoint) bool {
+	_, data := c.Get(p.Key, p.Timestamp, p.Timestamp)
+	return len(data) > 0
+}
+
+// fill add n points of metric a.x, not handed to db
+func fill(c *Cache, n int) {
+	now := time.Now().Unix()
+	for i := 0; i < n; i++ {
+		c.Add(common.MetricPoint{Key: "a.x", Value: float64(i), Timestamp: now - int64(n-i)})
+	}
+}
+
+func TestOverflowPolicy(t *testing.T) {
+	newPoint := common.MetricPoint{Key: "b.x", Value: 9, Timestamp: time.Now().Unix()}
+	tests := []struct {
+		policy   string
+		handed   bool // points handed to db before overflow
+		stored   bool // handed points stored by db
+		wantSize int64
+		wantNew  bool
+	}{
+		{"drop-new", true, true, 4, false},
+		// half of persisted points evicted
+		{"drop-persisted", true, true, 3, true},
+		// handed but not stored yet, nothing to evict
+		{"drop-persisted", true, false, 4, false},
+		// nothing persisted to evict
+		{"drop-persisted", false, false, 4, false},
+	}
+	for _, tt := range tests {
+		c := New(4)
+		if err := c.SetOverflowPolicy(tt.policy); err != nil {
+			t.Fatal(err)
+		}
+		fill(c, 4)
+		if tt.handed {
+			c.MakeChanForDB()
+			for _, pb := range takeAll(c) {
+				if tt.stored {
+					c.Done(pb, true)
+				}
+			}
+		}
+		c.Add(newPoint)
+		if c.Size() != tt.wantSize || cached(c, newPoint) != tt.wantNew {
+			t.Errorf("%s handed %v stored %v: size %d new %v, want %d %v", tt.policy, tt.handed,
+				tt.stored, c.Size(), cached(c, newPoint), tt.wantSize, tt.wantNew)
+		}
+	}
+
+	// block waits until points are stored by db
+	c := New(4)
+	c.SetOverflowPolicy("block")
+	fill(c, 4)
+	done := make(chan bool)
+	go func() {
+		c.Add(newPoint)
+		close(done)
+	}()
+	select {
+	case <-done:
+		t.Fatal("add should block when nothing can be evicted")
+	case <-time.After(50 * time.Millisecond):
+	}
+	c.MakeChanForDB()
+	bags := takeAll(c)
+	select {
+	case <-done:
+		t.Fatal("add should block until handed points are stored")
+	case <-time.After(50 * time.Millisecond):
+	}
+	for _, pb := range bags {
+		c.Done(pb, true)
+	}
+	<-done
+	if !cached(c, newPoint) {
+		t.Error("blocked point not added")
+	}
+
+	if err := c.SetOverflowPolicy("drop-old"); err == nil {
+		t.Error("expected error for unknown policy")
+	}
+}
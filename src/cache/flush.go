@@ -2,6 +2,7 @@ package cache
 
 import (
 	"sort"
+	"sync/atomic"
 	"time"
 
 	"github.com/coder-van/v-graphite/src/common"
@@ -38,8 +39,51 @@ func (c *Cache) SetWriteStrategy(s string) (err error) {
 	return nil
 }
 
-// todo add timer stat
-func (c *Cache) MakeChanForDB() {
+// Done is called by db for every bag sent to ChanForDB, if not finished its
+// points are put back to wait for db, they go to ChanForDB again next
+// MakeChanForDB
+func (c *Cache) Done(pb *common.PointBag, finished bool) {
+	shard := c.GetShard(pb.Metric)
+	shard.Lock()
+	defer shard.Unlock()
+
+	cpb, exists := shard.items[pb.Metric]
+	if !exists {
+		if finished {
+			return
+		}
+		// evicted meanwhile, its points are cached again, when they were
+		// added is lost, so nothing is truncated until they are stored
+		cpb = c.newPointBag(pb.Metric)
+		shard.items[pb.Metric] = cpb
+		for _, p := range pb.Data {
+			cpb.Add(p)
+		}
+		cpb.pendingSince = 1
+		atomic.AddInt64(&c.size, int64(len(pb.Data)))
+	}
+
+	cpb.Lock()
+	since, ok := cpb.inflight[pb]
+	delete(cpb.inflight, pb)
+	if !finished {
+		if exists {
+			cpb.PointsToDb = append(pb.Data, cpb.PointsToDb...)
+		}
+		if ok && (cpb.pendingSince == 0 || since < cpb.pendingSince) {
+			cpb.pendingSince = since
+		}
+	}
+	cpb.Unlock()
+
+	if !finished {
+		c.stat.CounterInc("requeued", len(pb.Data))
+	}
+}
+
+// MakeChanForDB send points waiting for db to ChanForDB, return a time all
+// points added to cache before it have been stored by db
+func (c *Cache) MakeChanForDB() time.Time {
 
 	writeStrategy := c.writeStrategy
 	c.stat.CounterInc("queue-build-times", 1)
@@ -64,13 +108,32 @@ func (c *Cache) MakeChanForDB() {
 	l := c.Len() * 2  // point bag length
 	queuePB := make(queue, l)
 	index := int32(0)
+	now := start.Unix()
+	expired := 0
+	var storeBytes int64
+	live, evicted, evictedPoints := 0, 0, 0
+	persisted := start.UnixNano()
 
 	for i := 0; i < shardCount; i++ {
 		shard := c.data[i]
 		shard.Lock()
 
-		for _, cpb := range shard.items {
+		for key, cpb := range shard.items {
+			if idle, n := cpb.Idle(now, c.IdleTTL); idle {
+				delete(shard.items, key)
+				atomic.AddInt64(&c.nameBytes, 0-int64(len(key)))
+				evicted++
+				evictedPoints += n
+				continue
+			}
+			live++
+			// metrics not written any more expire here, not in Add
+			expired += cpb.Expire(now)
+			storeBytes += cpb.Bytes()
 			p := cpb.GetPointBagForDb()
+			if since := cpb.unpersistedSince(); since > 0 && since < persisted {
+				persisted = since
+			}
 			c.logger.DebugFilter(fiterCpuTotal(cpb.Metric),
 				"write data points ", p.Data)
 			len_data := len(p.Data)
@@ -93,6 +156,16 @@ func (c *Cache) MakeChanForDB() {
 
 	queuePB = queuePB[:index]
 
+	if expired+evictedPoints > 0 {
+		atomic.AddInt64(&c.size, 0-int64(expired+evictedPoints))
+	}
+	if evicted > 0 {
+		c.stat.CounterInc("series-evicted", evicted)
+	}
+	c.stat.GaugeUpdate("series-live", live)
+	c.checkMemoryBudget(live, storeBytes)
+	c.stat.GaugeUpdate("point-count", c.Size())
+
 	switch writeStrategy {
 	case MaxStrategy:
 		sort.Sort(sort.Reverse(byOrderKey(queuePB)))
@@ -102,7 +175,7 @@ func (c *Cache) MakeChanForDB() {
 
 	
 	if l == 0 || size == 0{
-		return
+		return time.Unix(0, persisted)
 	}
 
 	for _, queueItem := range queuePB {
@@ -112,5 +185,5 @@ func (c *Cache) MakeChanForDB() {
 	
 	logger := log.GetLogger("cache", log.RotateModeMonth)
 	logger.Printf("make %d to queue, use: %s \n", size, time.Since(start))
-
+	return time.Unix(0, persisted)
 }
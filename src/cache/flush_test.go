@@ -0,0 +1,77 @@
+package cache
+
+import (
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/coder-van/v-graphite/src/common"
+)
+
+func TestMakeChanForDBPersisted(t *testing.T) {
+	c := New(0)
+	before := time.Now()
+	c.Add(common.MetricPoint{Key: "a.x", Value: 1, Timestamp: 1500000000})
+	c.Add(common.MetricPoint{Key: "b.x", Value: 1, Timestamp: 1500000000})
+	after := time.Now()
+
+	if w := c.MakeChanForDB(); w.Before(before) || !w.Before(after) {
+		t.Fatalf("watermark %v, want at add of a.x", w)
+	}
+	bags := takeAll(c)
+	if len(bags) != 2 {
+		t.Fatalf("got %d bags, want 2", len(bags))
+	}
+
+	// bags finish out of order, a.x still blocks
+	c.Done(bags["b.x"], true)
+	if w := c.MakeChanForDB(); w.Before(before) || !w.Before(after) {
+		t.Fatalf("watermark %v passed a.x in flight", w)
+	}
+	c.Done(bags["a.x"], true)
+	if w := c.MakeChanForDB(); w.Before(after) {
+		t.Fatalf("watermark %v, want after all stored", w)
+	}
+
+	// a new metric deferred every interval doesn't hold watermark back
+	// forever, it waits only for the one deferred in previous interval
+	marks := make([]time.Time, 0)
+	for i := 0; i < 5; i++ {
+		marks = append(marks, time.Now())
+		key := fmt.Sprintf("new.%d", i)
+		c.Add(common.MetricPoint{Key: key, Value: 1, Timestamp: 1500000000})
+		w := c.MakeChanForDB()
+		if i > 0 && (w.Before(marks[i-1]) || !w.Before(marks[i])) {
+			t.Fatalf("interval %d: watermark %v, want at add of new.%d", i, w, i-1)
+		}
+		for _, pb := range takeAll(c) {
+			c.Done(pb, pb.Metric != key)
+		}
+	}
+}
+
+func TestIdleEviction(t *testing.T) {
+	c := New(0)
+	c.SetIdleTTL(60)
+	c.Add(common.MetricPoint{Key: "a.x", Value: 1, Timestamp: time.Now().Unix()})
+	c.GetShard("a.x").items["a.x"].lastAdd -= 120
+
+	// handed to db but not stored yet
+	c.MakeChanForDB()
+	bags := takeAll(c)
+	c.MakeChanForDB()
+	if c.Len() != 1 {
+		t.Fatal("evicted before stored")
+	}
+
+	c.Done(bags["a.x"], false)
+	c.MakeChanForDB()
+	if c.Len() != 1 {
+		t.Fatal("evicted after store failed")
+	}
+	c.Done(takeAll(c)["a.x"], true)
+	c.MakeChanForDB()
+	if c.Len() != 0 || c.Size() != 0 {
+		t.Fatalf("%d series %d points left, want evicted", c.Len(), c.Size())
+	}
+}
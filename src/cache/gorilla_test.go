@@ -0,0 +1,134 @@
+package cache
+
+import (
+	"fmt"
+	"math"
+	"math/rand"
+	"testing"
+
+	"github.com/coder-van/v-graphite/src/common"
+)
+
+func TestGorillaStore(t *testing.T) {
+	r := rand.New(rand.NewSource(1))
+	values := []float64{0, 1, -1, 1.5, math.MaxFloat64, math.SmallestNonzeroFloat64, math.Inf(1), math.NaN()}
+
+	g := newGorillaStore(3600)
+	s := &sliceStore{}
+	ts := int64(1500000000)
+	for i := 0; i < 2000; i++ {
+		ts += int64(r.Intn(3)+1) * 10 // regular and irregular steps
+		if i%100 == 0 {
+			ts += 100000 // dod bigger than 12 bits
+		}
+		p := common.Point{Value: float64(r.Intn(100)) / 4, Timestamp: ts}
+		if i%7 == 0 {
+			p.Value = values[r.Intn(len(values))]
+		}
+		if i%50 == 0 {
+			p.Timestamp -= int64(r.Intn(60))*10 + 5 // out of order
+		}
+		g.Insert(p)
+		s.Insert(p)
+	}
+
+	equal := func(got, want []common.Point) {
+		if len(got) != len(want) {
+			t.Fatalf("got %d points, want %d", len(got), len(want))
+		}
+		for i := range want {
+			if got[i].Timestamp != want[i].Timestamp ||
+				math.Float64bits(got[i].Value) != math.Float64bits(want[i].Value) {
+				t.Fatalf("point %d: got %v, want %v", i, got[i], want[i])
+			}
+		}
+	}
+	equal(g.Points(), s.Points())
+
+	from, until := s.data[300].Timestamp, s.data[900].Timestamp
+	var got, want []common.Point
+	g.Range(from, until, func(p common.Point) { got = append(got, p) })
+	s.Range(from, until, func(p common.Point) { want = append(want, p) })
+	equal(got, want)
+
+	if g.CountBefore(from) != s.CountBefore(from) {
+		t.Fatalf("CountBefore got %d, want %d", g.CountBefore(from), s.CountBefore(from))
+	}
+	if g.DeleteFirst(123) != s.DeleteFirst(123) {
+		t.Fatal("DeleteFirst returned different timestamps")
+	}
+	equal(g.Points(), s.Points())
+
+	// chunks are trimmed as a whole, so at least as many points are kept
+	n := g.TrimBefore(from)
+	if n > s.CountBefore(from) || g.Len() != len(g.Points()) {
+		t.Fatalf("TrimBefore deleted %d points, %d points older", n, s.CountBefore(from))
+	}
+}
+
+// regular 10 seconds points of a gauge
+func benchPoints(n int) []common.Point {
+	r := rand.New(rand.NewSource(1))
+	points := make([]common.Point, n)
+	v := 50.0
+	for i := range points {
+		v += float64(r.Intn(5) - 2)
+		points[i] = common.Point{Value: v, Timestamp: 1500000000 + int64(i)*10}
+	}
+	return points
+}
+
+func benchmarkInsert(b *testing.B, compress bool) {
+	points := benchPoints(360) // an hour
+	var bytes int64
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		s := newPointStore(compress, 3600)
+		for _, p := range points {
+			s.Insert(p)
+		}
+		bytes = s.Bytes()
+	}
+	b.ReportMetric(float64(bytes)/float64(len(points)), "bytes/point")
+}
+
+func benchmarkRange(b *testing.B, compress bool) {
+	points := benchPoints(360)
+	s := newPointStore(compress, 3600)
+	for _, p := range points {
+		s.Insert(p)
+	}
+	from, until := points[180].Timestamp, points[359].Timestamp
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		n := 0
+		s.Range(from, until, func(common.Point) { n++ })
+	}
+}
+
+func BenchmarkSliceInsert(b *testing.B)   { benchmarkInsert(b, false) }
+func BenchmarkGorillaInsert(b *testing.B) { benchmarkInsert(b, true) }
+func BenchmarkSliceRange(b *testing.B)    { benchmarkRange(b, false) }
+func BenchmarkGorillaRange(b *testing.B)  { benchmarkRange(b, true) }
+
+func benchmarkCache(b *testing.B, compress bool) {
+	c := New(1 << 30)
+	c.SetPointCompression(compress)
+	metrics := make([]string, 1000)
+	for i := range metrics {
+		metrics[i] = fmt.Sprintf("bench.host%d.metric%d", i%26, i/26)
+	}
+	points := benchPoints(360)
+	b.ResetTimer()
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		p := points[i/len(metrics)%len(points)]
+		c.Add(common.MetricPoint{Key: metrics[i%len(metrics)], Value: p.Value, Timestamp: p.Timestamp})
+		if i%len(metrics) == 0 {
+			c.Get(metrics[i%len(metrics)], p.Timestamp-600, p.Timestamp)
+		}
+	}
+}
+
+func BenchmarkSliceCacheAddGet(b *testing.B)   { benchmarkCache(b, false) }
+func BenchmarkGorillaCacheAddGet(b *testing.B) { benchmarkCache(b, true) }
@@ -19,10 +19,6 @@ import (
 	"github.com/coder-van/v-graphite/src/common"
 )
 
-const (
-	isDumpInBinary = false
-)
-
 type SyncWriter struct {
 	sync.Mutex
 	w *bufio.Writer
@@ -39,8 +35,9 @@ func (s *SyncWriter) Flush() error {
 	return s.w.Flush()
 }
 
-// Dump
-func (c *Cache) Dump(dumpPath string, isDumpInBinary bool) {
+// Dump write points not stored by db yet to a new file in dumpPath, a file
+// failed to write is removed, so nil error means all points are dumped
+func (c *Cache) Dump(dumpPath string, isDumpInBinary bool) error {
 
 	logger := log.GetLogger("dump_restore", log.RotateModeMonth)
 	logger.Println("---------------------- Dump start ---------------------")
@@ -55,31 +52,39 @@ func (c *Cache) Dump(dumpPath string, isDumpInBinary bool) {
 	dump, err := os.Create(dumpFilename)
 	if err != nil {
 		logger.Printf("dump create file error, %s \n", err)
+		return err
 	}
 	dumpWriter := bufio.NewWriterSize(dump, 1024*1024) // 1Mb
 
 	// dump cache
-	if ! isDumpInBinary {
-		c.DumpInStr(dumpWriter)
+	if isDumpInBinary {
+		err = c.DumpBinary(dumpWriter)
+	} else {
+		err = c.DumpInStr(dumpWriter)
 	}
 	
 	if err != nil {
 		logger.Printf("dump write fail, %s \n", err)
-	}
-
-	if err = dumpWriter.Flush() ; err != nil {
+	} else if err = dumpWriter.Flush(); err != nil {
 		logger.Printf("dump flush fail, %s \n", err)
 	}
 
-	if err = dump.Close(); err != nil {
-		logger.Printf("dumped but fail to close writer, %s \n", err)
+	if e := dump.Close(); e != nil && err == nil {
+		logger.Printf("dumped but fail to close writer, %s \n", e)
+		err = e
+	}
+	if err != nil {
+		os.Remove(dumpFilename)
+		return err
 	}
 
 	logger.Printf("cache dump finished points count: %d \n", int(cacheSize))
 	logger.Println("--------------------- Dump finished --------------------")
+	return nil
 }
 
-// TODO
+// DumpInStr write points not stored by db yet in text format, points only
+// kept for queries are in whisper already
 func (c *Cache) DumpInStr(w io.Writer) error {
 	for i := 0; i < shardCount; i++ {
 		shard := c.data[i]
@@ -96,7 +101,7 @@ func (c *Cache) DumpInStr(w io.Writer) error {
 		}
 		
 		for _, p := range shard.items {
-			if _, err := WriteTo(&p.PointBag, w); err != nil {
+			if _, err := WriteTo(p.PendingBag(), w); err != nil {
 				shard.Unlock()
 				return err
 			}
@@ -109,8 +114,15 @@ func (c *Cache) DumpInStr(w io.Writer) error {
 }
 
 
-// RestoreFromFile read and parse data from single file
-func (c *Cache) RestoreFromFile(filename string) {
+// corruptSuffix is appended to dump and wal files failed to restore, they
+// are kept for inspection and not restored again
+const corruptSuffix = ".corrupt"
+
+// RestoreFromFile read and parse data from single file, points before an
+// error are kept and the file is renamed with corruptSuffix. A restored file
+// is handed to wal to be deleted once its points are stored, or deleted now
+// if wal is nil
+func (c *Cache) RestoreFromFile(filename string, wal *WAL) {
 	var pointsCount int
 	startTime := time.Now()
 
@@ -123,14 +135,24 @@ func (c *Cache) RestoreFromFile(filename string) {
 		c.Add(p)
 	})
 	
-	if err != nil {
-		logger.Printf("error in RestoreFromFile, %s \n", err)
-		panic("RestoreFromFile error")
+	if err == ErrUnfinishedLine {
+		// points before the torn line are good
+		logger.Printf("last line of %s is unfinished, skipped \n", filename)
+	} else if err != nil {
+		logger.Printf("error in RestoreFromFile, %d points restored before, %s \n", pointsCount, err)
+		if err = os.Rename(filename, filename+corruptSuffix); err != nil {
+			logger.Printf("failed to rename corrupt file %s, %s \n", filename, err)
+		}
+		return
 	}
 
 	logger.Printf("restore %d points, use %s s from file: %s finished",
 			pointsCount, time.Since(startTime), filename)
 	
+	if wal != nil {
+		wal.Adopt(filename, time.Now())
+		return
+	}
 	err = os.Remove(filename)
 	if err != nil {
 		logger.Error("failed to remove file",  filename, zap.Error(err))
@@ -139,8 +161,9 @@ func (c *Cache) RestoreFromFile(filename string) {
 	
 }
 
-// RestoreFromDir cache and input dumps from disk to memory
-func (c *Cache) RestoreAll(dumpDir string) {
+// RestoreAll restore cache and input dumps from disk to memory, see
+// RestoreFromFile for wal
+func (c *Cache) RestoreAll(dumpDir string, wal *WAL) {
 	startTime := time.Now()
 
 	logger := log.GetLogger("dump_restore", log.RotateModeMonth)
@@ -162,7 +185,7 @@ func (c *Cache) RestoreAll(dumpDir string) {
 
 FilesLoop:
 	for _, file := range files {
-		if file.IsDir() {
+		if file.IsDir() || strings.HasSuffix(file.Name(), corruptSuffix) {
 			continue
 		}
 
@@ -198,40 +221,44 @@ FilesLoop:
 
 	for _, fn := range list {
 		filename := path.Join(dumpDir, fn)
-		c.RestoreFromFile(filename)
+		c.RestoreFromFile(filename, wal)
 	}
 	
 	logger.Printf("restore finished use %s \n", time.Since(startTime))
 	logger.Println("------------------------ restore finished ------------------------")
 }
 
-//func (c *Cache) DumpBinary(w io.Writer) error {
-//	for i := 0; i < shardCount; i++ {
-//		shard := c.data[i]
-//		shard.Lock()
-//
-//		for _, p := range shard.notConfirmed[:shard.notConfirmedUsed] {
-//			if p == nil {
-//				continue
-//			}
-//			if _, err := p.WriteBinaryTo(w); err != nil {
-//				shard.Unlock()
-//				return err
-//			}
-//		}
-//
-//		for _, p := range shard.items {
-//			if _, err := p.WriteBinaryTo(w); err != nil {
-//				shard.Unlock()
-//				return err
-//			}
-//		}
-//
-//		shard.Unlock()
-//	}
-//
-//	return nil
-//}
+// DumpBinary write points not stored by db yet in binary dump format, see
+// wr.go
+func (c *Cache) DumpBinary(w io.Writer) error {
+	bw, err := NewBinaryWriter(w)
+	if err != nil {
+		return err
+	}
+
+	for i := 0; i < shardCount; i++ {
+		shard := c.data[i]
+		shard.Lock()
+
+		for _, p := range shard.notConfirmed[:shard.notConfirmedUsed] {
+			if p == nil {
+				continue
+			}
+			if err := bw.WriteBinaryTo(p); err != nil {
+				shard.Unlock()
+				return err
+			}
+		}
 
+		for _, p := range shard.items {
+			if err := bw.WriteBinaryTo(p.PendingBag()); err != nil {
+				shard.Unlock()
+				return err
+			}
+		}
 
+		shard.Unlock()
+	}
 
+	return bw.Close()
+}
@@ -0,0 +1,104 @@
+package cache
+
+import (
+	"fmt"
+	"regexp"
+	"sync/atomic"
+)
+
+const DefaultRetention = 3600 // seconds
+
+// rough memory cost used by memory budget, an uncompressed point is two
+// 8 bytes fields, a point bag costs map entry, struct and slices headers
+// besides its name
+const (
+	pointBytes         = 16
+	pointBagBytes      = 256
+	budgetLowWatermark = 0.9
+)
+
+// RetentionRule keep points of metrics matched by Pattern Duration seconds
+// in cache, rules are tried in order and the first match wins
+type RetentionRule struct {
+	Pattern  string `toml:"pattern"`
+	Duration int64  `toml:"duration"` // seconds
+
+	re *regexp.Regexp
+}
+
+// SetRetention compile rules, metrics matched by none of them keep
+// defaultDuration seconds, only point bags created later are affected
+func (c *Cache) SetRetention(rules []RetentionRule, defaultDuration int64) error {
+	compiled := make([]*RetentionRule, 0, len(rules))
+	for i := range rules {
+		r := rules[i]
+		if r.Duration <= 0 {
+			return fmt.Errorf("bad duration %d of cache retention rule '%s'", r.Duration, r.Pattern)
+		}
+		re, err := regexp.Compile(r.Pattern)
+		if err != nil {
+			return fmt.Errorf("bad pattern of cache retention rule '%s', %s", r.Pattern, err)
+		}
+		r.re = re
+		compiled = append(compiled, &r)
+	}
+	if defaultDuration <= 0 {
+		defaultDuration = DefaultRetention
+	}
+	c.retention = compiled
+	c.defaultRetention = &RetentionRule{Pattern: "default", Duration: defaultDuration}
+	return nil
+}
+
+// retentionOf return the rule a new point bag of metric should follow
+func (c *Cache) retentionOf(metric string) *RetentionRule {
+	for _, r := range c.retention {
+		if r.re.MatchString(metric) {
+			return r
+		}
+	}
+	return c.defaultRetention
+}
+
+// SetMemoryBudget limit estimated memory of cached points, 0 means no limit
+func (c *Cache) SetMemoryBudget(bytes int64) {
+	c.MemoryBudget = bytes
+}
+
+// checkMemoryBudget delete oldest persisted points until estimated memory
+// is under low watermark of budget, called after expiring in MakeChanForDB
+// with memory used by points of all point bags
+func (c *Cache) checkMemoryBudget(bags int, storeBytes int64) {
+	perPoint := float64(pointBytes)
+	if size := c.Size(); size > 0 {
+		perPoint = float64(storeBytes) / float64(size)
+	}
+	estimate := func() int64 {
+		return int64(float64(c.Size())*perPoint) + int64(bags)*pointBagBytes + atomic.LoadInt64(&c.nameBytes)
+	}
+	c.stat.GaugeUpdate("memory-estimate-bytes", int(estimate()))
+	if c.MemoryBudget <= 0 || estimate() <= c.MemoryBudget {
+		return
+	}
+
+	c.evictLock.Lock()
+	defer c.evictLock.Unlock()
+
+	target := int64(float64(c.MemoryBudget) * budgetLowWatermark)
+	for estimate() > target {
+		removed := 0
+		for i := 0; i < shardCount && estimate()-int64(float64(removed)*perPoint) > target; i++ {
+			shard := c.data[i]
+			shard.Lock()
+			for _, cpb := range shard.items {
+				removed += cpb.EvictPersisted()
+			}
+			shard.Unlock()
+		}
+		if removed == 0 {
+			break
+		}
+		atomic.AddInt64(&c.size, 0-int64(removed))
+		c.stat.CounterInc("memory-budget-evicted", removed)
+	}
+}
@@ -0,0 +1,62 @@
+package cache
+
+import (
+	"testing"
+	"time"
+
+	"github.com/coder-van/v-graphite/src/common"
+)
+
+func TestRetention(t *testing.T) {
+	c := New(0)
+	rules := []RetentionRule{
+		{Pattern: `^dashboard\.`, Duration: 60},
+		{Pattern: `^dashboard\.slow\.`, Duration: 86400}, // shadowed by the first
+		{Pattern: `\.daily$`, Duration: 86400},
+	}
+	if err := c.SetRetention(rules, 600); err != nil {
+		t.Fatal(err)
+	}
+
+	now := time.Now().Unix()
+	tests := []struct {
+		metric   string
+		duration int64
+		pattern  string
+	}{
+		{"dashboard.a", 60, `^dashboard\.`},
+		{"dashboard.slow.a", 60, `^dashboard\.`},
+		{"servers.a.daily", 86400, `\.daily$`},
+		{"servers.a.cpu", 600, "default"},
+	}
+	for _, tt := range tests {
+		c.Add(common.MetricPoint{Key: tt.metric, Value: 1, Timestamp: now - 120})
+		c.Add(common.MetricPoint{Key: tt.metric, Value: 2, Timestamp: now})
+		ok, duration, count, pattern := c.GetMetricInfo(tt.metric)
+		if !ok || duration != tt.duration || pattern != tt.pattern {
+			t.Errorf("%s: got %d %s, want %d %s", tt.metric, duration, pattern, tt.duration, tt.pattern)
+		}
+		// point older than retention is expired
+		wantCount := 2
+		if tt.duration < 120 {
+			wantCount = 1
+		}
+		if count != wantCount {
+			t.Errorf("%s: %d points, want %d", tt.metric, count, wantCount)
+		}
+		// cache can't answer for time before retention
+		if hit, _ := c.Get(tt.metric, now-tt.duration-10, now); hit {
+			t.Errorf("%s: hit before retention", tt.metric)
+		}
+	}
+
+	bad := [][]RetentionRule{
+		{{Pattern: "a", Duration: 0}},
+		{{Pattern: "(", Duration: 60}},
+	}
+	for _, rules := range bad {
+		if err := c.SetRetention(rules, 600); err == nil {
+			t.Errorf("expected error for %v", rules)
+		}
+	}
+}
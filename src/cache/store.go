@@ -0,0 +1,92 @@
+package cache
+
+import (
+	"github.com/coder-van/v-graphite/src/common"
+)
+
+// pointStore keep points of one metric sorted by timestamp, callers hold
+// the lock of CachePointBag
+type pointStore interface {
+	// Insert point at right location, maybe some point reach delay
+	Insert(p common.Point)
+	Len() int
+	// Range call fn for points with from <= timestamp <= until in order
+	Range(from, until int64, fn func(common.Point))
+	// CountBefore return how many points have timestamp < ts
+	CountBefore(ts int64) int
+	// TrimBefore delete points with timestamp < ts, a store may keep some of
+	// them for a while, return how many deleted
+	TrimBefore(ts int64) int
+	// DeleteFirst delete n oldest points, return timestamp of last deleted
+	DeleteFirst(n int) int64
+	// Points return a copy of all points
+	Points() []common.Point
+	// Bytes return memory used by points
+	Bytes() int64
+}
+
+func newPointStore(compress bool, duration int64) pointStore {
+	if compress {
+		return newGorillaStore(duration)
+	}
+	return &sliceStore{data: make([]common.Point, 0)}
+}
+
+// sliceStore keep points uncompressed, 16 bytes per point
+type sliceStore struct {
+	data []common.Point
+}
+
+func (s *sliceStore) Insert(point common.Point) {
+	last := len(s.data) - 1
+	s.data = append(s.data, point)
+	for i := last; i >= 0; i-- {
+		if s.data[i].Timestamp < point.Timestamp {
+			break
+		}
+		s.data[i+1] = s.data[i]
+		s.data[i] = point
+	}
+}
+
+func (s *sliceStore) Len() int {
+	return len(s.data)
+}
+
+func (s *sliceStore) Range(from, until int64, fn func(common.Point)) {
+	for _, dp := range s.data {
+		if dp.Timestamp >= from && dp.Timestamp <= until {
+			fn(dp)
+		}
+	}
+}
+
+func (s *sliceStore) CountBefore(ts int64) int {
+	n := 0
+	for n < len(s.data) && s.data[n].Timestamp < ts {
+		n++
+	}
+	return n
+}
+
+func (s *sliceStore) TrimBefore(ts int64) int {
+	n := s.CountBefore(ts)
+	if n > 0 {
+		s.data = s.data[n:]
+	}
+	return n
+}
+
+func (s *sliceStore) DeleteFirst(n int) int64 {
+	last := s.data[n-1].Timestamp
+	s.data = s.data[n:]
+	return last
+}
+
+func (s *sliceStore) Points() []common.Point {
+	return append([]common.Point(nil), s.data...)
+}
+
+func (s *sliceStore) Bytes() int64 {
+	return int64(cap(s.data)) * pointBytes
+}
@@ -0,0 +1,226 @@
+package cache
+
+/*
+Write-ahead log of points going to cache. Points are appended in text dump
+format to segment files named input.<pid>.<nanotimestamp> in dump dir, so that
+RestoreAll replays segments left by a crash in order with cache dumps.
+
+Points are logged after aggregation, inputs only aggregated are not logged but
+aggregated points are, so replay gives the cache what it had. Inputs still in
+aggregator buckets at a crash are lost.
+
+A segment is rotated by size or age, and deleted by Truncate once all points
+written before it was closed have been stored to whisper. Dumps and segments
+restored at start are kept the same way until their points are stored.
+*/
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"path"
+	"sync"
+	"time"
+
+	"github.com/coder-van/v-graphite/src/common"
+	statsd "github.com/coder-van/v-stats"
+	"github.com/coder-van/v-util/log"
+)
+
+// fsync policies of WAL
+const (
+	WALFsyncAlways   = "always"   // fsync after every point, safest and slowest
+	WALFsyncInterval = "interval" // fsync on every Tick, lose up to one second on power loss
+	WALFsyncNever    = "never"    // leave it to os, survive process crash only
+)
+
+type walSegment struct {
+	path   string
+	closed time.Time
+}
+
+// WAL is an append-only log of points, safe for concurrent use
+type WAL struct {
+	Dir         string
+	SegmentSize int64         // bytes
+	SegmentAge  time.Duration // segment open longer than this is rotated
+	Fsync       string
+
+	mu     sync.Mutex // guards current segment, held while a point goes to cache
+	file   *os.File
+	w      *bufio.Writer
+	size   int64
+	opened time.Time
+
+	closedMu sync.Mutex // guards closed, so Truncate never waits for a Write
+	closed   []walSegment
+
+	logger *log.Vlogger
+	stat   *statsd.BaseStat
+}
+
+func NewWAL(dir string, segmentSize int64, segmentAge time.Duration, fsync string) (*WAL, error) {
+	switch fsync {
+	case WALFsyncAlways, WALFsyncInterval, WALFsyncNever:
+	default:
+		return nil, fmt.Errorf("Unknown wal fsync policy '%s', should be one of: always, interval, never", fsync)
+	}
+	if err := os.MkdirAll(dir, os.ModeDir|os.ModePerm); err != nil {
+		return nil, err
+	}
+	return &WAL{
+		Dir:         dir,
+		SegmentSize: segmentSize,
+		SegmentAge:  segmentAge,
+		Fsync:       fsync,
+		closed:      make([]walSegment, 0),
+		logger:      log.GetLogger("wal", log.RotateModeMonth),
+		stat:        common.GetStat("wal"),
+	}, nil
+}
+
+// open create a new segment, the first segment is opened on first Write so
+// that RestoreAll at start never sees it
+func (w *WAL) open(now time.Time) error {
+	name := fmt.Sprintf("input.%d.%d", os.Getpid(), now.UnixNano())
+	f, err := os.OpenFile(path.Join(w.Dir, name), os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		return err
+	}
+	w.file = f
+	w.w = bufio.NewWriterSize(f, MB)
+	w.size = 0
+	w.opened = now
+	return nil
+}
+
+// closeSegment flush, fsync and close current segment, caller holds mu
+func (w *WAL) closeSegment(now time.Time) error {
+	if w.file == nil {
+		return nil
+	}
+	err := w.sync(true)
+	if e := w.file.Close(); err == nil {
+		err = e
+	}
+	w.closedMu.Lock()
+	w.closed = append(w.closed, walSegment{path: w.file.Name(), closed: now})
+	w.closedMu.Unlock()
+	w.file, w.w = nil, nil
+	return err
+}
+
+// sync flush buffer to file, and fsync if needed, caller holds mu
+func (w *WAL) sync(fsync bool) error {
+	if w.file == nil {
+		return nil
+	}
+	if err := w.w.Flush(); err != nil {
+		return err
+	}
+	if !fsync || w.Fsync == WALFsyncNever {
+		return nil
+	}
+	start := time.Now()
+	err := w.file.Sync()
+	w.stat.CounterInc("fsync-ms", int(time.Since(start)/time.Millisecond))
+	return err
+}
+
+// Write append a point then call apply with it, even if logging failed,
+// segment is rotated before writing if it is too big. apply is called before
+// the segment can be closed, so points of a closed segment have all gone to
+// cache
+func (w *WAL) Write(p common.MetricPoint, apply func(common.MetricPoint)) error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	err := w.write(p)
+	if apply != nil {
+		apply(p)
+	}
+	return err
+}
+
+// write append a point, caller holds mu
+func (w *WAL) write(p common.MetricPoint) error {
+	now := time.Now()
+	if w.file != nil && w.SegmentSize > 0 && w.size >= w.SegmentSize {
+		w.stat.CounterInc("segments-rotated", 1)
+		if err := w.closeSegment(now); err != nil {
+			w.stat.OnErr("error-wal-rotate", err)
+		}
+	}
+	if w.file == nil {
+		if err := w.open(now); err != nil {
+			w.stat.OnErr("error-wal-open", err)
+			return err
+		}
+	}
+
+	n, err := fmt.Fprintf(w.w, "%s %v %v\n", p.Key, p.Value, p.Timestamp)
+	w.size += int64(n)
+	if err == nil && w.Fsync == WALFsyncAlways {
+		err = w.sync(true)
+	}
+	if err != nil {
+		w.stat.OnErr("error-wal-write", err)
+		return err
+	}
+	w.stat.CounterInc("points-written", 1)
+	return nil
+}
+
+// Tick rotate segment by age and fsync, should be called every second
+func (w *WAL) Tick(now time.Time) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	if w.file == nil {
+		return
+	}
+	if w.SegmentAge > 0 && now.Sub(w.opened) >= w.SegmentAge {
+		w.stat.CounterInc("segments-rotated", 1)
+		if err := w.closeSegment(now); err != nil {
+			w.stat.OnErr("error-wal-rotate", err)
+		}
+		return
+	}
+	if err := w.sync(w.Fsync == WALFsyncInterval); err != nil {
+		w.stat.OnErr("error-wal-sync", err)
+	}
+}
+
+// Truncate delete segments closed before t, points added to cache before t
+// must have been stored to whisper
+func (w *WAL) Truncate(t time.Time) {
+	w.closedMu.Lock()
+	defer w.closedMu.Unlock()
+
+	i := 0
+	for ; i < len(w.closed) && w.closed[i].closed.Before(t); i++ {
+		if err := os.Remove(w.closed[i].path); err != nil && !os.IsNotExist(err) {
+			w.stat.OnErr("error-wal-truncate", err)
+			w.logger.Printf("remove wal segment %s failed, %s \n", w.closed[i].path, err)
+			break
+		}
+		w.stat.CounterInc("segments-truncated", 1)
+	}
+	w.closed = w.closed[i:]
+}
+
+// Adopt take a file restored to cache as a closed segment, so it is deleted
+// by Truncate once its points are stored, a crash before that restores it
+// again
+func (w *WAL) Adopt(path string, restored time.Time) {
+	w.closedMu.Lock()
+	defer w.closedMu.Unlock()
+	w.closed = append(w.closed, walSegment{path: path, closed: restored})
+}
+
+// Close flush and close current segment, segments are kept for replay
+func (w *WAL) Close() error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	return w.closeSegment(time.Now())
+}
@@ -0,0 +1,83 @@
+package cache
+
+import (
+	"io/ioutil"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/coder-van/v-graphite/src/common"
+)
+
+func TestWAL(t *testing.T) {
+	dir, err := ioutil.TempDir("", "wal")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	w, err := NewWAL(dir, 30, 0, WALFsyncNever)
+	if err != nil {
+		t.Fatal(err)
+	}
+	c := New(0)
+	now := time.Now().Unix()
+	points := []common.MetricPoint{
+		{Key: "a.b", Value: 1, Timestamp: now},
+		{Key: "a.b", Value: 2, Timestamp: now + 60},
+		// segment is over 30 bytes, rotated before this one
+		{Key: "c.d", Value: 3, Timestamp: now},
+	}
+	for _, p := range points {
+		if err := w.Write(p, c.Add); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if c.Size() != 3 {
+		t.Fatalf("cache size %d, want 3", c.Size())
+	}
+	files := func() int {
+		fs, _ := ioutil.ReadDir(dir)
+		return len(fs)
+	}
+	if n := files(); n != 2 {
+		t.Fatalf("%d segments, want 2", n)
+	}
+
+	// nothing closed after watermark is deleted
+	w.Truncate(time.Unix(0, 0))
+	mid := time.Now()
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+	w.Truncate(mid)
+	if n := files(); n != 1 {
+		t.Fatalf("%d segments after truncate, want 1", n)
+	}
+
+	// segment left is replayed as it went to cache, and kept by the new wal
+	// until replayed points are stored
+	replayed := New(0)
+	next, err := NewWAL(dir, 30, 0, WALFsyncNever)
+	if err != nil {
+		t.Fatal(err)
+	}
+	replayed.RestoreAll(dir, next)
+	if replayed.Size() != 1 {
+		t.Fatalf("replayed %d points, want 1", replayed.Size())
+	}
+	if got := replayed.Points("c.d"); len(got) != 1 || got[0].Value != 3 {
+		t.Errorf("replayed %v, want c.d 3", got)
+	}
+	next.Truncate(replayed.MakeChanForDB())
+	if n := files(); n != 1 {
+		t.Fatalf("replayed segment removed before stored")
+	}
+	for _, pb := range takeAll(replayed) {
+		replayed.Done(pb, true)
+	}
+	next.Truncate(replayed.MakeChanForDB())
+	if n := files(); n != 0 {
+		t.Fatalf("%d segments left after replayed points stored", n)
+	}
+}
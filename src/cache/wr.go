@@ -3,8 +3,12 @@ package cache
 import (
 	"io"
 	"bufio"
+	"bytes"
+	"encoding/binary"
 	"errors"
 	"fmt"
+	"hash/crc32"
+	"math"
 	"os"
 	
 	"github.com/coder-van/v-graphite/src/common"
@@ -12,6 +16,10 @@ import (
 
 const MB = 1048576
 
+// ErrUnfinishedLine is returned by ReadLines if the last line has no '\n',
+// what a crash in the middle of writing a wal segment leaves
+var ErrUnfinishedLine = errors.New("unfinished line in file")
+
 func ReadLines(r io.Reader, callbackCacheAdd func(point common.MetricPoint)) error {
 	reader := bufio.NewReaderSize(r, MB)
 	
@@ -27,7 +35,7 @@ func ReadLines(r io.Reader, callbackCacheAdd func(point common.MetricPoint)) err
 		}
 		
 		if line[len(line)-1] != '\n' {
-			return errors.New("unfinished line in file")
+			return ErrUnfinishedLine
 		}
 		
 		p, err := common.ParseFromStr(string(line))
@@ -48,11 +56,13 @@ func ReadFrom(filename string, callbackCacheAdd func(point common.MetricPoint))
 	}
 	defer file.Close()
 	
-	//if strings.HasSuffix(strings.ToLower(filename), ".bin") {
-	//	return ReadBinary(file, callback)
-	//}
-	
-	return ReadLines(file, callbackCacheAdd)
+	// text and binary dumps are told by the magic header
+	reader := bufio.NewReaderSize(file, MB)
+	head, err := reader.Peek(len(binaryDumpMagic))
+	if err == nil && bytes.Equal(head, binaryDumpMagic) {
+		return ReadBinary(reader, callbackCacheAdd)
+	}
+	return ReadLines(reader, callbackCacheAdd)
 }
 
 
@@ -68,115 +78,188 @@ func WriteTo(p *common.PointBag, w io.Writer) (n int64, err error) {
 	return
 }
 
-//func ReadBinary(r io.Reader, callback func(point *common.PointBag)) error {
-//	reader := bufio.NewReaderSize(r, MB)
-//	var pb *common.PointBag
-//	buf := make([]byte, MB)
-//
-//	flush := func() {
-//		if &pb != nil {
-//			callback(pb)
-//			pb = nil
-//		}
-//	}
-//	defer flush()
-//
-//	for {
-//		flush()
-//
-//		l, err := binary.ReadVarint(reader)
-//		if l > MB {
-//			return fmt.Errorf("metric name too long: %d", l)
-//		}
-//
-//		if err == io.EOF {
-//			break
-//		}
-//
-//		if err != nil {
-//			return err
-//		}
-//
-//		io.ReadAtLeast(reader, buf[:l], int(l))
-//
-//		cnt, err := binary.ReadVarint(reader)
-//
-//		var v, t, v0, t0 int64
-//
-//		for i := int64(0); i < cnt; i++ {
-//			v0, err = binary.ReadVarint(reader)
-//			if err != nil {
-//				return err
-//			}
-//			v += v0
-//
-//			t0, err = binary.ReadVarint(reader)
-//			if err != nil {
-//				return err
-//			}
-//			t += t0
-//
-//			if i == int64(0) {
-//				metric := string(buf[:l])
-//				pb = common.NewPointsBag(metric)
-//			}
-//			pb.Append(common.Point{math.Float64frombits(uint64(v)), t})
-//		}
-//	}
-//
-//	return nil
-//}
-
-//func encodeIntValue(value int64) []byte {
-//	var buf [10]byte
-//	l := binary.PutVarint(buf[:], value)
-//	return buf[:l]
-//}
-
-//func WriteBinaryTo(p *common.PointBag, w io.Writer) (n int, err error) {
-//	var c int
-//
-//	writeIntValue := func(value int64) bool {
-//
-//		c, err = w.Write(encodeIntValue(value))
-//		n += c
-//		if err != nil {
-//			return false
-//		}
-//		return true
-//	}
-//
-//	if !writeIntValue(int64(len(p.Metric))) {
-//		return
-//	}
-//
-//	c, err = io.WriteString(w, p.Metric)
-//	n += c
-//	if err != nil {
-//		return
-//	}
-//
-//	if !writeIntValue(int64(len(p.Data))) {
-//		return
-//	}
-//
-//	if len(p.Data) > 0 {
-//		if !writeIntValue(int64(math.Float64bits(p.Data[0].Value))) {
-//			return
-//		}
-//		if !writeIntValue(p.Data[0].Timestamp) {
-//			return
-//		}
-//	}
-//
-//	for i := 1; i < len(p.Data); i++ {
-//		if !writeIntValue(int64(math.Float64bits(p.Data[i].Value)) - int64(math.Float64bits(p.Data[i-1].Value))) {
-//			return
-//		}
-//		if !writeIntValue(p.Data[i].Timestamp - p.Data[i-1].Timestamp) {
-//			return
-//		}
-//	}
-//
-//	return
-//}
+/*
+Binary dump format, all integers are varint unless noted
+
+    header:  "VGCD" version(1 byte)
+    block:   payload-length(uvarint) payload crc32-of-payload(4 bytes big endian)
+    end:     a block with payload-length 0 and no crc
+
+payload is a list of point bags:
+
+    name-length name point-count (value-bits timestamp)...
+
+value bits (math.Float64bits) and timestamp of the first point are written
+as is, following points as delta to the previous one.
+*/
+
+var binaryDumpMagic = []byte("VGCD")
+
+const (
+	binaryDumpVersion   = 1
+	binaryDumpBlockSize = 64 * 1024 // payload is written out when bigger than this
+	binaryDumpMaxBlock  = 64 * MB
+)
+
+// BinaryWriter write point bags in binary dump format, Close must be called
+// to write out the last block and the end mark
+type BinaryWriter struct {
+	w   io.Writer
+	buf bytes.Buffer
+	tmp [binary.MaxVarintLen64]byte
+}
+
+func NewBinaryWriter(w io.Writer) (*BinaryWriter, error) {
+	header := append(append([]byte{}, binaryDumpMagic...), binaryDumpVersion)
+	if _, err := w.Write(header); err != nil {
+		return nil, err
+	}
+	return &BinaryWriter{w: w}, nil
+}
+
+func (bw *BinaryWriter) putVarint(v int64) {
+	n := binary.PutVarint(bw.tmp[:], v)
+	bw.buf.Write(bw.tmp[:n])
+}
+
+func (bw *BinaryWriter) putUvarint(v uint64) {
+	n := binary.PutUvarint(bw.tmp[:], v)
+	bw.buf.Write(bw.tmp[:n])
+}
+
+// WriteBinaryTo append a point bag to current block
+func (bw *BinaryWriter) WriteBinaryTo(p *common.PointBag) error {
+	if len(p.Data) == 0 {
+		return nil
+	}
+	bw.putUvarint(uint64(len(p.Metric)))
+	bw.buf.WriteString(p.Metric)
+	bw.putUvarint(uint64(len(p.Data)))
+
+	var v0, t0 int64
+	for _, d := range p.Data {
+		v := int64(math.Float64bits(d.Value))
+		bw.putVarint(v - v0)
+		bw.putVarint(d.Timestamp - t0)
+		v0, t0 = v, d.Timestamp
+	}
+
+	if bw.buf.Len() >= binaryDumpBlockSize {
+		return bw.flushBlock()
+	}
+	return nil
+}
+
+func (bw *BinaryWriter) flushBlock() error {
+	if bw.buf.Len() == 0 {
+		return nil
+	}
+	payload := bw.buf.Bytes()
+	n := binary.PutUvarint(bw.tmp[:], uint64(len(payload)))
+	if _, err := bw.w.Write(bw.tmp[:n]); err != nil {
+		return err
+	}
+	if _, err := bw.w.Write(payload); err != nil {
+		return err
+	}
+	var sum [4]byte
+	binary.BigEndian.PutUint32(sum[:], crc32.ChecksumIEEE(payload))
+	if _, err := bw.w.Write(sum[:]); err != nil {
+		return err
+	}
+	bw.buf.Reset()
+	return nil
+}
+
+// Close write out the last block and the end mark, not close the underlying writer
+func (bw *BinaryWriter) Close() error {
+	if err := bw.flushBlock(); err != nil {
+		return err
+	}
+	_, err := bw.w.Write([]byte{0})
+	return err
+}
+
+// ReadBinary read a binary dump, a block failing checksum stops reading
+// so that no garbage goes to cache
+func ReadBinary(r io.Reader, callbackCacheAdd func(point common.MetricPoint)) error {
+	reader := bufio.NewReaderSize(r, MB)
+
+	header := make([]byte, len(binaryDumpMagic)+1)
+	if _, err := io.ReadFull(reader, header); err != nil {
+		return err
+	}
+	if !bytes.Equal(header[:len(binaryDumpMagic)], binaryDumpMagic) {
+		return errors.New("not a binary dump")
+	}
+	if header[len(binaryDumpMagic)] != binaryDumpVersion {
+		return fmt.Errorf("unknown binary dump version %d", header[len(binaryDumpMagic)])
+	}
+
+	for {
+		size, err := binary.ReadUvarint(reader)
+		if err != nil {
+			if err == io.EOF {
+				return errors.New("binary dump truncated, end mark not found")
+			}
+			return err
+		}
+		if size == 0 {
+			return nil
+		}
+		if size > binaryDumpMaxBlock {
+			return fmt.Errorf("binary dump block too big: %d", size)
+		}
+
+		payload := make([]byte, size+4)
+		if _, err := io.ReadFull(reader, payload); err != nil {
+			return fmt.Errorf("binary dump truncated, %s", err)
+		}
+		sum := binary.BigEndian.Uint32(payload[size:])
+		payload = payload[:size]
+		if crc32.ChecksumIEEE(payload) != sum {
+			return errors.New("binary dump block checksum mismatch")
+		}
+		if err := readBinaryBlock(payload, callbackCacheAdd); err != nil {
+			return err
+		}
+	}
+}
+
+func readBinaryBlock(payload []byte, callbackCacheAdd func(point common.MetricPoint)) error {
+	r := bytes.NewReader(payload)
+	for r.Len() > 0 {
+		l, err := binary.ReadUvarint(r)
+		if err != nil {
+			return err
+		}
+		if l > uint64(r.Len()) {
+			return fmt.Errorf("metric name too long: %d", l)
+		}
+		name := make([]byte, l)
+		io.ReadFull(r, name)
+		metric := string(name)
+
+		cnt, err := binary.ReadUvarint(r)
+		if err != nil {
+			return err
+		}
+
+		var v, t int64
+		for i := uint64(0); i < cnt; i++ {
+			dv, err := binary.ReadVarint(r)
+			if err != nil {
+				return err
+			}
+			dt, err := binary.ReadVarint(r)
+			if err != nil {
+				return err
+			}
+			v += dv
+			t += dt
+			callbackCacheAdd(common.MetricPoint{
+				Key: metric, Value: math.Float64frombits(uint64(v)), Timestamp: t})
+		}
+	}
+	return nil
+}
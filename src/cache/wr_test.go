@@ -0,0 +1,136 @@
+package cache
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/coder-van/v-graphite/src/common"
+)
+
+func TestBinaryDump(t *testing.T) {
+	bags := []*common.PointBag{
+		{Metric: "a.b.c", Data: []common.Point{
+			{Value: 1.5, Timestamp: 1500000000},
+			{Value: -2, Timestamp: 1500000060},
+			{Value: 1e300, Timestamp: 1500000120},
+		}},
+		{Metric: "x;tag=v", Data: []common.Point{{Value: 0, Timestamp: 1500000000}}},
+	}
+
+	var buf bytes.Buffer
+	bw, err := NewBinaryWriter(&buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, pb := range bags {
+		if err := bw.WriteBinaryTo(pb); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := bw.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	got := make([]common.MetricPoint, 0)
+	if err := ReadBinary(bytes.NewReader(buf.Bytes()), func(p common.MetricPoint) {
+		got = append(got, p)
+	}); err != nil {
+		t.Fatal(err)
+	}
+	i := 0
+	for _, pb := range bags {
+		for _, d := range pb.Data {
+			want := common.MetricPoint{Key: pb.Metric, Value: d.Value, Timestamp: d.Timestamp}
+			if i >= len(got) || got[i] != want {
+				t.Fatalf("point %d: got %v, want %v", i, got, want)
+			}
+			i++
+		}
+	}
+
+	corrupted := append([]byte{}, buf.Bytes()...)
+	corrupted[10] ^= 0xff
+	if err := ReadBinary(bytes.NewReader(corrupted), func(common.MetricPoint) {}); err == nil {
+		t.Error("corrupted dump should fail checksum")
+	}
+	if err := ReadBinary(bytes.NewReader(buf.Bytes()[:buf.Len()-1]), func(common.MetricPoint) {}); err == nil {
+		t.Error("truncated dump should fail")
+	}
+}
+
+func TestRestoreCorrupt(t *testing.T) {
+	dir, err := ioutil.TempDir("", "restore")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	var buf bytes.Buffer
+	bw, _ := NewBinaryWriter(&buf)
+	bw.WriteBinaryTo(&common.PointBag{Metric: "a.b", Data: []common.Point{{Value: 1, Timestamp: 1500000000}}})
+	bw.Close()
+	corrupted := buf.Bytes()
+	corrupted[10] ^= 0xff
+	name := filepath.Join(dir, "cache.1.1500000000.bin")
+	if err := ioutil.WriteFile(name, corrupted, 0644); err != nil {
+		t.Fatal(err)
+	}
+	good := filepath.Join(dir, "input.1.1500000001")
+	if err := ioutil.WriteFile(good, []byte("x.y 2 1500000000\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	c := New(1000)
+	c.RestoreAll(dir, nil)
+	if _, err := os.Stat(name + corruptSuffix); err != nil {
+		t.Errorf("corrupt dump not renamed, %s", err)
+	}
+	if _, err := os.Stat(good); !os.IsNotExist(err) {
+		t.Errorf("restored file not removed, %v", err)
+	}
+	if c.Size() != 1 {
+		t.Errorf("cache size %d, want 1", c.Size())
+	}
+
+	// renamed file is not restored again
+	c.RestoreAll(dir, nil)
+	if _, err := os.Stat(name + corruptSuffix); err != nil {
+		t.Errorf("corrupt dump should be kept, %s", err)
+	}
+}
+
+func TestDumpPending(t *testing.T) {
+	c := New(0)
+	c.SetRetention(nil, 60)
+	now := time.Now().Unix()
+	c.Add(common.MetricPoint{Key: "a.b", Value: 1, Timestamp: now - 3600})
+	c.Add(common.MetricPoint{Key: "a.b", Value: 2, Timestamp: now})
+	// handed to db, the old point is out of retention
+	c.MakeChanForDB()
+	bags := takeAll(c)
+	c.Add(common.MetricPoint{Key: "a.b", Value: 3, Timestamp: now + 1})
+
+	dumped := func() []float64 {
+		var buf bytes.Buffer
+		if err := c.DumpBinary(&buf); err != nil {
+			t.Fatal(err)
+		}
+		values := make([]float64, 0)
+		ReadBinary(bytes.NewReader(buf.Bytes()), func(p common.MetricPoint) {
+			values = append(values, p.Value)
+		})
+		return values
+	}
+	if got := dumped(); len(got) != 3 {
+		t.Errorf("dumped %v, want all 3 points not stored", got)
+	}
+	// stored points are not dumped even if still kept for queries
+	c.Done(bags["a.b"], true)
+	if got := dumped(); len(got) != 1 || got[0] != 3 {
+		t.Errorf("dumped %v, want [3]", got)
+	}
+}
@@ -0,0 +1,528 @@
+package common
+
+/*
+A minimal pickle decoder, only supports what carbon senders and carbonlink
+clients produce: lists, tuples and dicts of strings, ints, longs and floats.
+Opcodes that build objects (GLOBAL, REDUCE, BUILD ...) are rejected,
+so a malicious payload can't do anything more than fail to decode.
+*/
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"math/big"
+	"strconv"
+)
+
+const (
+	opMark           = '('
+	opStop           = '.'
+	opPop            = '0'
+	opPopMark        = '1'
+	opDup            = '2'
+	opFloat          = 'F'
+	opInt            = 'I'
+	opBinInt         = 'J'
+	opBinInt1        = 'K'
+	opLong           = 'L'
+	opBinInt2        = 'M'
+	opNone           = 'N'
+	opString         = 'S'
+	opBinString      = 'T'
+	opShortBinString = 'U'
+	opUnicode        = 'V'
+	opBinUnicode     = 'X'
+	opAppend         = 'a'
+	opGet            = 'g'
+	opBinGet         = 'h'
+	opLongBinGet     = 'j'
+	opList           = 'l'
+	opEmptyList      = ']'
+	opPut            = 'p'
+	opBinPut         = 'q'
+	opLongBinPut     = 'r'
+	opTuple          = 't'
+	opEmptyTuple     = ')'
+	opAppends        = 'e'
+	opBinFloat       = 'G'
+	opEmptyDict      = '}'
+	opDict           = 'd'
+	opSetItem        = 's'
+	opSetItems       = 'u'
+
+	// protocol 2
+	opProto    = '\x80'
+	opTuple1   = '\x85'
+	opTuple2   = '\x86'
+	opTuple3   = '\x87'
+	opNewTrue  = '\x88'
+	opNewFalse = '\x89'
+	opLong1    = '\x8a'
+	opLong4    = '\x8b'
+
+	// protocol 3
+	opBinBytes      = 'B'
+	opShortBinBytes = 'C'
+
+	// protocol 4
+	opShortBinUnicode = '\x8c'
+	opBinUnicode8     = '\x8d'
+	opBinBytes8       = '\x8e'
+	opMemoize         = '\x94'
+	opFrame           = '\x95'
+)
+
+// ErrPickleUnsupported is returned when the pickle stream uses an opcode
+// the decoder doesn't handle.
+var ErrPickleUnsupported = errors.New("unsupported pickle opcode")
+
+// MaxPickleItemSize limits a single string/bytes item inside a pickle
+var MaxPickleItemSize = 1024 * 1024
+
+// MaxPickleStackSize limits items on stack and in memo, every opcode pushes
+// at most one item, so a frame of marks or dups can't take 16 bytes per byte
+var MaxPickleStackSize = 1024 * 1024
+
+type pickleMark struct{}
+
+type unpickler struct {
+	r     *bufio.Reader
+	stack []interface{}
+	memo  map[int]interface{}
+}
+
+// Unpickle decodes a single pickled object from data. Lists and tuples are
+// both returned as []interface{}, dicts as map[string]interface{}, strings
+// as string, integers as int64 or *big.Int and floats as float64.
+func Unpickle(data []byte) (interface{}, error) {
+	u := &unpickler{
+		r:     bufio.NewReader(bytes.NewReader(data)),
+		stack: make([]interface{}, 0, 16),
+		memo:  make(map[int]interface{}),
+	}
+	return u.load()
+}
+
+func (u *unpickler) push(v interface{}) {
+	u.stack = append(u.stack, v)
+}
+
+func (u *unpickler) pop() (interface{}, error) {
+	if len(u.stack) == 0 {
+		return nil, errors.New("pickle stack underflow")
+	}
+	v := u.stack[len(u.stack)-1]
+	u.stack = u.stack[:len(u.stack)-1]
+	return v, nil
+}
+
+func (u *unpickler) top() (interface{}, error) {
+	if len(u.stack) == 0 {
+		return nil, errors.New("pickle stack underflow")
+	}
+	return u.stack[len(u.stack)-1], nil
+}
+
+// popMark pops everything above the topmost mark, and the mark itself
+func (u *unpickler) popMark() ([]interface{}, error) {
+	for i := len(u.stack) - 1; i >= 0; i-- {
+		if _, ok := u.stack[i].(pickleMark); ok {
+			items := make([]interface{}, len(u.stack)-i-1)
+			copy(items, u.stack[i+1:])
+			u.stack = u.stack[:i]
+			return items, nil
+		}
+	}
+	return nil, errors.New("pickle mark not found")
+}
+
+func (u *unpickler) readN(n int) ([]byte, error) {
+	if n < 0 || n > MaxPickleItemSize {
+		return nil, fmt.Errorf("pickle item size %d out of range", n)
+	}
+	buf := make([]byte, n)
+	if _, err := io.ReadFull(u.r, buf); err != nil {
+		return nil, err
+	}
+	return buf, nil
+}
+
+func (u *unpickler) readLine() (string, error) {
+	line, err := u.r.ReadString('\n')
+	if err != nil {
+		return "", err
+	}
+	return line[:len(line)-1], nil
+}
+
+func (u *unpickler) readUint(size int) (uint64, error) {
+	b, err := u.readN(size)
+	if err != nil {
+		return 0, err
+	}
+	switch size {
+	case 1:
+		return uint64(b[0]), nil
+	case 2:
+		return uint64(binary.LittleEndian.Uint16(b)), nil
+	case 4:
+		return uint64(binary.LittleEndian.Uint32(b)), nil
+	default:
+		return binary.LittleEndian.Uint64(b), nil
+	}
+}
+
+func (u *unpickler) memoPut(key int) error {
+	if len(u.memo) >= MaxPickleStackSize {
+		return errors.New("pickle memo too large")
+	}
+	v, err := u.top()
+	if err != nil {
+		return err
+	}
+	u.memo[key] = v
+	return nil
+}
+
+func (u *unpickler) memoGet(key int) error {
+	v, ok := u.memo[key]
+	if !ok {
+		return fmt.Errorf("pickle memo key %d not found", key)
+	}
+	u.push(v)
+	return nil
+}
+
+func (u *unpickler) appendTo(items ...interface{}) error {
+	v, err := u.pop()
+	if err != nil {
+		return err
+	}
+	list, ok := v.([]interface{})
+	if !ok {
+		return errors.New("pickle append to non list")
+	}
+	u.push(append(list, items...))
+	return nil
+}
+
+// setItems set key value pairs to the dict on top of stack
+func (u *unpickler) setItems(items []interface{}) error {
+	if len(items)%2 != 0 {
+		return errors.New("pickle odd number of dict items")
+	}
+	v, err := u.top()
+	if err != nil {
+		return err
+	}
+	dict, ok := v.(map[string]interface{})
+	if !ok {
+		return errors.New("pickle set item to non dict")
+	}
+	for i := 0; i < len(items); i += 2 {
+		key, ok := items[i].(string)
+		if !ok {
+			return errors.New("pickle dict key is not string")
+		}
+		dict[key] = items[i+1]
+	}
+	return nil
+}
+
+func (u *unpickler) load() (interface{}, error) {
+	for {
+		op, err := u.r.ReadByte()
+		if err != nil {
+			return nil, err
+		}
+		if len(u.stack) >= MaxPickleStackSize {
+			return nil, errors.New("pickle stack too deep")
+		}
+
+		switch op {
+		case opStop:
+			v, err := u.pop()
+			if err != nil {
+				return nil, err
+			}
+			return v, nil
+		case opProto:
+			if _, err = u.r.ReadByte(); err != nil {
+				return nil, err
+			}
+		case opFrame:
+			_, err = u.readUint(8)
+		case opMark:
+			u.push(pickleMark{})
+		case opPop:
+			_, err = u.pop()
+		case opPopMark:
+			_, err = u.popMark()
+		case opDup:
+			var v interface{}
+			if v, err = u.top(); err == nil {
+				u.push(v)
+			}
+		case opNone:
+			u.push(nil)
+		case opNewTrue:
+			u.push(true)
+		case opNewFalse:
+			u.push(false)
+
+		case opInt:
+			var line string
+			if line, err = u.readLine(); err != nil {
+				break
+			}
+			switch line {
+			case "00":
+				u.push(false)
+			case "01":
+				u.push(true)
+			default:
+				var i int64
+				if i, err = strconv.ParseInt(line, 10, 64); err == nil {
+					u.push(i)
+				}
+			}
+		case opBinInt:
+			var v uint64
+			if v, err = u.readUint(4); err == nil {
+				u.push(int64(int32(v)))
+			}
+		case opBinInt1:
+			var v uint64
+			if v, err = u.readUint(1); err == nil {
+				u.push(int64(v))
+			}
+		case opBinInt2:
+			var v uint64
+			if v, err = u.readUint(2); err == nil {
+				u.push(int64(v))
+			}
+		case opLong:
+			var line string
+			if line, err = u.readLine(); err != nil {
+				break
+			}
+			if len(line) > 0 && line[len(line)-1] == 'L' {
+				line = line[:len(line)-1]
+			}
+			u.push(parseLong(line))
+		case opLong1, opLong4:
+			var n uint64
+			size := 1
+			if op == opLong4 {
+				size = 4
+			}
+			if n, err = u.readUint(size); err != nil {
+				break
+			}
+			var b []byte
+			if b, err = u.readN(int(n)); err == nil {
+				u.push(decodeLong(b))
+			}
+		case opFloat:
+			var line string
+			if line, err = u.readLine(); err != nil {
+				break
+			}
+			var f float64
+			if f, err = strconv.ParseFloat(line, 64); err == nil {
+				u.push(f)
+			}
+		case opBinFloat:
+			var b []byte
+			if b, err = u.readN(8); err == nil {
+				u.push(math.Float64frombits(binary.BigEndian.Uint64(b)))
+			}
+
+		case opString:
+			var line string
+			if line, err = u.readLine(); err != nil {
+				break
+			}
+			var s string
+			if s, err = strconv.Unquote(pythonQuoteToGo(line)); err == nil {
+				u.push(s)
+			}
+		case opUnicode:
+			var line string
+			if line, err = u.readLine(); err == nil {
+				u.push(line)
+			}
+		case opShortBinString, opShortBinBytes, opShortBinUnicode:
+			err = u.loadSized(1)
+		case opBinString, opBinBytes, opBinUnicode:
+			err = u.loadSized(4)
+		case opBinUnicode8, opBinBytes8:
+			err = u.loadSized(8)
+
+		case opEmptyList:
+			u.push(make([]interface{}, 0))
+		case opEmptyTuple:
+			u.push(make([]interface{}, 0))
+		case opList, opTuple:
+			var items []interface{}
+			if items, err = u.popMark(); err == nil {
+				u.push(items)
+			}
+		case opTuple1, opTuple2, opTuple3:
+			n := int(op-opTuple1) + 1
+			if len(u.stack) < n {
+				err = errors.New("pickle stack underflow")
+				break
+			}
+			items := make([]interface{}, n)
+			copy(items, u.stack[len(u.stack)-n:])
+			u.stack = u.stack[:len(u.stack)-n]
+			u.push(items)
+		case opAppend:
+			var v interface{}
+			if v, err = u.pop(); err == nil {
+				err = u.appendTo(v)
+			}
+		case opAppends:
+			var items []interface{}
+			if items, err = u.popMark(); err == nil {
+				err = u.appendTo(items...)
+			}
+
+		case opEmptyDict:
+			u.push(make(map[string]interface{}))
+		case opDict:
+			var items []interface{}
+			if items, err = u.popMark(); err == nil {
+				u.push(make(map[string]interface{}))
+				err = u.setItems(items)
+			}
+		case opSetItem:
+			var items []interface{}
+			if len(u.stack) < 3 {
+				err = errors.New("pickle stack underflow")
+				break
+			}
+			items = append(items, u.stack[len(u.stack)-2:]...)
+			u.stack = u.stack[:len(u.stack)-2]
+			err = u.setItems(items)
+		case opSetItems:
+			var items []interface{}
+			if items, err = u.popMark(); err == nil {
+				err = u.setItems(items)
+			}
+
+		case opPut:
+			var line string
+			if line, err = u.readLine(); err != nil {
+				break
+			}
+			var key int
+			if key, err = strconv.Atoi(line); err == nil {
+				err = u.memoPut(key)
+			}
+		case opBinPut, opLongBinPut:
+			size := 1
+			if op == opLongBinPut {
+				size = 4
+			}
+			var key uint64
+			if key, err = u.readUint(size); err == nil {
+				err = u.memoPut(int(key))
+			}
+		case opMemoize:
+			err = u.memoPut(len(u.memo))
+		case opGet:
+			var line string
+			if line, err = u.readLine(); err != nil {
+				break
+			}
+			var key int
+			if key, err = strconv.Atoi(line); err == nil {
+				err = u.memoGet(key)
+			}
+		case opBinGet, opLongBinGet:
+			size := 1
+			if op == opLongBinGet {
+				size = 4
+			}
+			var key uint64
+			if key, err = u.readUint(size); err == nil {
+				err = u.memoGet(int(key))
+			}
+
+		default:
+			return nil, fmt.Errorf("%s: 0x%x", ErrPickleUnsupported, op)
+		}
+
+		if err != nil {
+			return nil, err
+		}
+	}
+}
+
+func (u *unpickler) loadSized(size int) error {
+	n, err := u.readUint(size)
+	if err != nil {
+		return err
+	}
+	b, err := u.readN(int(n))
+	if err != nil {
+		return err
+	}
+	u.push(string(b))
+	return nil
+}
+
+// pythonQuoteToGo turns a python repr string ('abc' or "abc") into a go quoted string
+func pythonQuoteToGo(s string) string {
+	if len(s) >= 2 && s[0] == '\'' && s[len(s)-1] == '\'' {
+		inner := s[1 : len(s)-1]
+		inner = string(bytes.Replace([]byte(inner), []byte(`"`), []byte(`\"`), -1))
+		inner = string(bytes.Replace([]byte(inner), []byte(`\'`), []byte(`'`), -1))
+		return `"` + inner + `"`
+	}
+	return s
+}
+
+func parseLong(s string) interface{} {
+	if i, err := strconv.ParseInt(s, 10, 64); err == nil {
+		return i
+	}
+	b, ok := new(big.Int).SetString(s, 10)
+	if !ok {
+		return nil
+	}
+	return b
+}
+
+// decodeLong decodes a little endian two's complement integer
+func decodeLong(b []byte) interface{} {
+	if len(b) == 0 {
+		return int64(0)
+	}
+	if len(b) <= 8 {
+		var v uint64
+		for i := len(b) - 1; i >= 0; i-- {
+			v = v<<8 | uint64(b[i])
+		}
+		if b[len(b)-1]&0x80 != 0 && len(b) < 8 {
+			v -= 1 << uint(8*len(b))
+		}
+		return int64(v)
+	}
+	be := make([]byte, len(b))
+	for i := range b {
+		be[len(b)-1-i] = b[i]
+	}
+	v := new(big.Int).SetBytes(be)
+	if b[len(b)-1]&0x80 != 0 {
+		v.Sub(v, new(big.Int).Lsh(big.NewInt(1), uint(8*len(b))))
+	}
+	return v
+}
@@ -0,0 +1,105 @@
+package common
+
+/*
+A minimal pickle encoder in protocol 2, for carbonlink responses graphite-web
+reads with its restricted unpickler.
+*/
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"math"
+	"sort"
+)
+
+// PickleTuple is pickled as tuple, []interface{} as list
+type PickleTuple []interface{}
+
+// Pickle encodes v, which is nil, bool, int, int64, float64, string,
+// PickleTuple, []interface{}, or map[string]interface{} of them.
+func Pickle(v interface{}) ([]byte, error) {
+	var buf bytes.Buffer
+	buf.Write([]byte{opProto, 2})
+	if err := pickleTo(&buf, v); err != nil {
+		return nil, err
+	}
+	buf.WriteByte(opStop)
+	return buf.Bytes(), nil
+}
+
+func pickleTo(buf *bytes.Buffer, v interface{}) error {
+	b := make([]byte, 8)
+	switch v := v.(type) {
+	case nil:
+		buf.WriteByte(opNone)
+	case bool:
+		if v {
+			buf.WriteByte(opNewTrue)
+		} else {
+			buf.WriteByte(opNewFalse)
+		}
+	case int:
+		return pickleTo(buf, int64(v))
+	case int64:
+		if v >= math.MinInt32 && v <= math.MaxInt32 {
+			buf.WriteByte(opBinInt)
+			binary.LittleEndian.PutUint32(b, uint32(v))
+			buf.Write(b[:4])
+		} else {
+			buf.Write([]byte{opLong1, 8})
+			binary.LittleEndian.PutUint64(b, uint64(v))
+			buf.Write(b)
+		}
+	case float64:
+		buf.WriteByte(opBinFloat)
+		binary.BigEndian.PutUint64(b, math.Float64bits(v))
+		buf.Write(b)
+	case string:
+		buf.WriteByte(opBinUnicode)
+		binary.LittleEndian.PutUint32(b, uint32(len(v)))
+		buf.Write(b[:4])
+		buf.WriteString(v)
+	case PickleTuple:
+		buf.WriteByte(opMark)
+		for _, item := range v {
+			if err := pickleTo(buf, item); err != nil {
+				return err
+			}
+		}
+		buf.WriteByte(opTuple)
+	case []interface{}:
+		buf.WriteByte(opEmptyList)
+		if len(v) == 0 {
+			break
+		}
+		buf.WriteByte(opMark)
+		for _, item := range v {
+			if err := pickleTo(buf, item); err != nil {
+				return err
+			}
+		}
+		buf.WriteByte(opAppends)
+	case map[string]interface{}:
+		buf.WriteByte(opEmptyDict)
+		if len(v) == 0 {
+			break
+		}
+		keys := make([]string, 0, len(v))
+		for k := range v {
+			keys = append(keys, k)
+		}
+		sort.Strings(keys)
+		buf.WriteByte(opMark)
+		for _, k := range keys {
+			pickleTo(buf, k)
+			if err := pickleTo(buf, v[k]); err != nil {
+				return err
+			}
+		}
+		buf.WriteByte(opSetItems)
+	default:
+		return fmt.Errorf("can't pickle %T", v)
+	}
+	return nil
+}
@@ -1,11 +1,10 @@
 package common
 
 import (
-	// "bytes"
-	// "errors"
+	"errors"
 	"fmt"
-	// "github.com/hydrogen18/stalecucumber"
 	"math"
+	"math/big"
 	"strconv"
 	"strings"
 )
@@ -74,76 +73,103 @@ func ParseFromStr(line string) (*MetricPoint, error) {
 		return nil, fmt.Errorf("bad message: %#v", line)
 	}
 	
-	key := fields[0]
+	key, err := NormalizeTagged(fields[0])
+	if err != nil {
+		return nil, fmt.Errorf("bad message: %#v, %s", line, err)
+	}
 	value, err := strconv.ParseFloat(fields[1], 64)
-	timestamp, err := strconv.ParseFloat(fields[2], 64)
+	if err != nil || math.IsNaN(value) {
+		return nil, fmt.Errorf("bad message: %#v", line)
+	}
 
-	if err != nil || math.IsNaN(value) || math.IsNaN(timestamp){
+	if isNowTimestamp(fields[2]) {
+		return &MetricPoint{Key: key, Value: value, Timestamp: nowTimestamp()}, nil
+	}
+	timestamp, err := strconv.ParseFloat(fields[2], 64)
+	if err != nil || math.IsNaN(timestamp) || math.IsInf(timestamp, 0) {
 		return nil, fmt.Errorf("bad message: %#v", line)
 	}
 	
 	return &MetricPoint{Key: key, Value: value, Timestamp: int64(timestamp)}, nil
 }
 
-//func ParseFromBytes(pkt []byte) ([]MetricPoint, error) {
-//	result, err := stalecucumber.Unpickle(bytes.NewReader(pkt))
-//
-//	list, err := stalecucumber.ListOrTuple(result, err)
-//	if err != nil {
-//		return nil, err
-//	}
-//
-//	pointsBagList := []MetricPoint{}
-//	for i := 0; i < len(list); i++ {
-//
-//		metric, err := stalecucumber.ListOrTuple(list[i], nil)
-//		if err != nil {
-//			return nil, err
-//		}
-//
-//		if len(metric) < 2 {
-//			return nil, errors.New("Unexpected array length while unpickling metric")
-//		}
-//
-//		name, err := stalecucumber.String(metric[0], nil)
-//		if err != nil {
-//			return nil, err
-//		}
-//
-//		var mp MetricPoint
-//		for j := 1; j < len(metric); j++ {
-//			v, err := stalecucumber.ListOrTuple(metric[j], nil)
-//			if err != nil {
-//				return nil, err
-//			}
-//			if len(v) != 2 {
-//				return nil, errors.New("Unexpected array length while unpickling data point")
-//			}
-//			timestamp, err := stalecucumber.Int(v[0], nil)
-//			if err != nil {
-//				timestampFloat, err := stalecucumber.Float(v[0], nil)
-//				if err != nil {
-//					return nil, err
-//				}
-//				timestamp = int64(timestampFloat)
-//			}
-//			if timestamp > math.MaxUint32 || timestamp < 0 {
-//				err = errors.New("Unexpected value for timestamp, cannot be cast to uint32")
-//				return nil, err
-//			}
-//
-//			value, err := stalecucumber.Float(v[1], nil)
-//			if err != nil {
-//				valueInt, err := stalecucumber.Int(v[1], nil)
-//				if err != nil {
-//					return nil, err
-//				}
-//				value = float64(valueInt)
-//			}
-//			mp = MetricPoint{Key: name, Value: value, Timestamp: timestamp}
-//
-//		}
-//		pointsBagList = append(pointsBagList, mp)
-//	}
-//	return pointsBagList, nil
-//}
+// ParseFromBytes parse a carbon pickle message, which is a list of
+// (metric, (timestamp, value)) tuples, one tuple may carry more than one datapoint
+func ParseFromBytes(pkt []byte) ([]MetricPoint, error) {
+	result, err := Unpickle(pkt)
+	if err != nil {
+		return nil, err
+	}
+
+	list, ok := result.([]interface{})
+	if !ok {
+		return nil, errors.New("Unexpected type while unpickling, list expected")
+	}
+
+	pointsBagList := make([]MetricPoint, 0, len(list))
+	for i := 0; i < len(list); i++ {
+		metric, ok := list[i].([]interface{})
+		if !ok {
+			return nil, errors.New("Unexpected type while unpickling metric")
+		}
+
+		if len(metric) < 2 {
+			return nil, errors.New("Unexpected array length while unpickling metric")
+		}
+
+		name, ok := metric[0].(string)
+		if !ok || name == "" {
+			return nil, errors.New("Unexpected metric name while unpickling metric")
+		}
+		name, err := NormalizeTagged(name)
+		if err != nil {
+			return nil, err
+		}
+
+		for j := 1; j < len(metric); j++ {
+			v, ok := metric[j].([]interface{})
+			if !ok || len(v) != 2 {
+				return nil, errors.New("Unexpected array length while unpickling data point")
+			}
+			timestamp, err := pickleNumber(v[0])
+			if err != nil {
+				return nil, err
+			}
+			if timestamp > math.MaxUint32 || timestamp < 0 {
+				return nil, errors.New("Unexpected value for timestamp, cannot be cast to uint32")
+			}
+
+			value, err := pickleNumber(v[1])
+			if err != nil {
+				return nil, err
+			}
+			if math.IsNaN(value) {
+				return nil, fmt.Errorf("bad value for metric %s", name)
+			}
+			pointsBagList = append(pointsBagList,
+				MetricPoint{Key: name, Value: value, Timestamp: int64(timestamp)})
+		}
+	}
+	return pointsBagList, nil
+}
+
+// pickleNumber converts a unpickled int, long, float or numeric string to float64
+func pickleNumber(v interface{}) (float64, error) {
+	switch n := v.(type) {
+	case int64:
+		return float64(n), nil
+	case float64:
+		return n, nil
+	case *big.Int:
+		f, _ := new(big.Float).SetInt(n).Float64()
+		return f, nil
+	case bool:
+		if n {
+			return 1, nil
+		}
+		return 0, nil
+	case string:
+		return strconv.ParseFloat(n, 64)
+	}
+	return 0, fmt.Errorf("Unexpected type %T while unpickling number", v)
+}
@@ -1 +1,164 @@
 package common
+
+import (
+	"testing"
+	"time"
+)
+
+func TestParseFromBytes(t *testing.T) {
+	expected := []MetricPoint{
+		{Key: "a.b.c", Value: 1.5, Timestamp: 1500000000},
+		{Key: "x.y", Value: 42, Timestamp: 1500000060},
+	}
+	pickles := map[string]string{
+		"protocol 0": "(lp0\n(Va.b.c\np1\n(I1500000000\nF1.5\ntp2\ntp3\na(Vx.y\np4\n(I1500000060\nI42\ntp5\ntp6\na.",
+		"protocol 2": "\x80\x02]q\x00(X\x05\x00\x00\x00a.b.cq\x01J\x00/hYG?\xf8\x00\x00\x00\x00\x00\x00\x86q\x02\x86q\x03X\x03\x00\x00\x00x.yq\x04J</hYK*\x86q\x05\x86q\x06e.",
+		"protocol 4": "\x80\x04\x950\x00\x00\x00\x00\x00\x00\x00]\x94(\x8c\x05a.b.c\x94J\x00/hYG?\xf8\x00\x00\x00\x00\x00\x00\x86\x94\x86\x94\x8c\x03x.y\x94J</hYK*\x86\x94\x86\x94e.",
+	}
+
+	for name, pkt := range pickles {
+		mps, err := ParseFromBytes([]byte(pkt))
+		if err != nil {
+			t.Fatalf("%s: %s", name, err)
+		}
+		if len(mps) != len(expected) {
+			t.Fatalf("%s: expected %d points, got %d", name, len(expected), len(mps))
+		}
+		for i := range expected {
+			if mps[i] != expected[i] {
+				t.Errorf("%s: expected %v, got %v", name, expected[i], mps[i])
+			}
+		}
+	}
+}
+
+func TestParseFromBytesMalformed(t *testing.T) {
+	bad := []string{
+		"",
+		"\x80\x02]q\x00(X\xff\xff\xff\x7fa.b.c",
+		"\x80\x02]q\x00(X\x05\x00\x00\x00a.b.cq\x01J\x00/hY",
+		"cos\nsystem\n(S'ls'\ntR.",
+		"(lp0\n(Va.b.c\nI1\ntp1\na.",
+		"e.",
+	}
+	for _, pkt := range bad {
+		if _, err := ParseFromBytes([]byte(pkt)); err == nil {
+			t.Errorf("expected error for %q", pkt)
+		}
+	}
+}
+
+// every truncation and single byte change of valid pickles must fail or
+// decode, never panic
+func TestParseFromBytesMutated(t *testing.T) {
+	pickles := []string{
+		"(lp0\n(Va.b.c\np1\n(I1500000000\nF1.5\ntp2\ntp3\na(Vx.y\np4\n(I1500000060\nI42\ntp5\ntp6\na.",
+		"\x80\x02]q\x00(X\x05\x00\x00\x00a.b.cq\x01J\x00/hYG?\xf8\x00\x00\x00\x00\x00\x00\x86q\x02\x86q\x03X\x03\x00\x00\x00x.yq\x04J</hYK*\x86q\x05\x86q\x06e.",
+		"\x80\x04\x950\x00\x00\x00\x00\x00\x00\x00]\x94(\x8c\x05a.b.c\x94J\x00/hYG?\xf8\x00\x00\x00\x00\x00\x00\x86\x94\x86\x94\x8c\x03x.y\x94J</hYK*\x86\x94\x86\x94e.",
+	}
+	for _, pkt := range pickles {
+		for i := 0; i < len(pkt); i++ {
+			ParseFromBytes([]byte(pkt[:i]))
+			for b := 0; b < 256; b++ {
+				m := []byte(pkt)
+				m[i] = byte(b)
+				ParseFromBytes(m)
+			}
+		}
+	}
+
+	// a frame of marks only is stopped at MaxPickleStackSize
+	marks := make([]byte, MaxPickleStackSize+1)
+	for i := range marks {
+		marks[i] = '('
+	}
+	if _, err := ParseFromBytes(marks); err == nil || err.Error() != "pickle stack too deep" {
+		t.Errorf("expected stack too deep, got %v", err)
+	}
+}
+
+func TestPickleDict(t *testing.T) {
+	// carbonlink requests of graphite-web
+	requests := []string{
+		"(dp0\nVtype\np1\nVcache-query\np2\nsVmetric\np3\nVa.b\np4\ns.",
+		"\x80\x04\x959\x00\x00\x00\x00\x00\x00\x00}\x94(\x8c\x04type\x94\x8c\x10cache-query-bulk\x94\x8c\x07metrics\x94]\x94(\x8c\x03a.b\x94\x8c\x03x.y\x94eu.",
+	}
+	for _, pkt := range requests {
+		v, err := Unpickle([]byte(pkt))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if req, ok := v.(map[string]interface{}); !ok || req["type"] == nil {
+			t.Errorf("expected request dict, got %#v", v)
+		}
+	}
+
+	response := map[string]interface{}{
+		"datapoints": []interface{}{PickleTuple{int64(1500000000), 1.5}, PickleTuple{int64(1 << 40), -2.0}},
+		"error":      nil,
+	}
+	data, err := Pickle(response)
+	if err != nil {
+		t.Fatal(err)
+	}
+	v, err := Unpickle(data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	dps := v.(map[string]interface{})["datapoints"].([]interface{})
+	if len(dps) != 2 || dps[1].([]interface{})[0] != int64(1<<40) || dps[1].([]interface{})[1] != -2.0 {
+		t.Errorf("unexpected datapoints %#v", dps)
+	}
+}
+
+func TestParseFromStrTagged(t *testing.T) {
+	mp, err := ParseFromStr("cpu.load;host=a;dc=eu 1.5 1500000000\n")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if mp.Key != "cpu.load;dc=eu;host=a" {
+		t.Errorf("tags not sorted: %s", mp.Key)
+	}
+
+	for _, line := range []string{"cpu.load;host 1 1500000000", ";host=a 1 1500000000", "cpu;host=~a 1 1"} {
+		if _, err := ParseFromStr(line); err == nil {
+			t.Errorf("expected error for %q", line)
+		}
+	}
+}
+
+func TestParseFromStrNow(t *testing.T) {
+	for _, ts := range []string{"-1", "N"} {
+		before := time.Now().Unix()
+		mp, err := ParseFromStr("a.b 1 " + ts)
+		if err != nil {
+			t.Fatalf("%s: %s", ts, err)
+		}
+		if mp.Timestamp < before || mp.Timestamp > time.Now().Unix() {
+			t.Errorf("%s: timestamp %d is not now", ts, mp.Timestamp)
+		}
+	}
+}
+
+func TestTimestampWindow(t *testing.T) {
+	w := &TimestampWindow{MaxFuture: 600, MaxPast: 86400, ConvertMillis: true}
+	now := int64(1500000000)
+	cases := []struct {
+		ts     int64
+		want   int64
+		reason string
+	}{
+		{now, now, ""},
+		{now + 600, now + 600, ""},
+		{now + 601, now + 601, TimestampTooNew},
+		{now - 86401, now - 86401, TimestampTooOld},
+		{now * 1000, now, ""},
+		{-1, -1, TimestampNegative},
+	}
+	for _, c := range cases {
+		mp := &MetricPoint{Key: "a", Timestamp: c.ts}
+		if reason := w.Check(mp, now); reason != c.reason || mp.Timestamp != c.want {
+			t.Errorf("%d: got %d %#v, want %d %#v", c.ts, mp.Timestamp, reason, c.want, c.reason)
+		}
+	}
+}
@@ -0,0 +1,72 @@
+package common
+
+/*
+Graphite 1.1 style tagged series, e.g. cpu.load;host=a;dc=eu
+see http://graphite.readthedocs.io/en/latest/tags.html
+*/
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+)
+
+// IsTagged report whether metric name carries tags
+func IsTagged(name string) bool {
+	return strings.IndexByte(name, ';') >= 0
+}
+
+// ParseTagged split a tagged series name to metric name and tags, the
+// returned tags also has the metric name under key "name" like graphite does
+func ParseTagged(series string) (string, map[string]string, error) {
+	parts := strings.Split(series, ";")
+	name := parts[0]
+	if name == "" {
+		return "", nil, fmt.Errorf("empty metric name in tagged series %#v", series)
+	}
+
+	tags := make(map[string]string, len(parts))
+	for _, part := range parts[1:] {
+		kv := strings.SplitN(part, "=", 2)
+		if len(kv) != 2 {
+			return "", nil, fmt.Errorf("bad tag %#v in series %#v", part, series)
+		}
+		tag, value := kv[0], kv[1]
+		if tag == "" || strings.ContainsAny(tag, "!^=") {
+			return "", nil, fmt.Errorf("bad tag name %#v in series %#v", tag, series)
+		}
+		if value == "" || strings.HasPrefix(value, "~") {
+			return "", nil, fmt.Errorf("bad value of tag %s in series %#v", tag, series)
+		}
+		tags[tag] = value
+	}
+	tags["name"] = name
+	return name, tags, nil
+}
+
+// NormalizeTagged sort tags of a tagged series name by tag, so that one series
+// always has the same name. Later value wins if a tag repeats. Name without
+// tags is returned as is.
+func NormalizeTagged(series string) (string, error) {
+	if !IsTagged(series) {
+		return series, nil
+	}
+	name, tags, err := ParseTagged(series)
+	if err != nil {
+		return "", err
+	}
+	delete(tags, "name")
+
+	keys := make([]string, 0, len(tags))
+	for k := range tags {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	parts := make([]string, 0, len(keys)+1)
+	parts = append(parts, name)
+	for _, k := range keys {
+		parts = append(parts, k+"="+tags[k])
+	}
+	return strings.Join(parts, ";"), nil
+}
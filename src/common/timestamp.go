@@ -0,0 +1,50 @@
+package common
+
+import "time"
+
+// reasons a point is rejected by TimestampWindow
+const (
+	TimestampTooNew   = "future"
+	TimestampTooOld   = "past"
+	TimestampNegative = "negative"
+)
+
+// millisecond timestamps are found by size, 1e11 seconds is year 5138 while
+// 1e11 milliseconds is 1973
+const millisTimestampThreshold = 1e11
+
+// TimestampWindow reject points dated too far from now, a client with a
+// broken clock may write 1970 or 2090 which whisper drops or misplaces
+type TimestampWindow struct {
+	MaxFuture     int64 // seconds, 0 means no limit
+	MaxPast       int64 // seconds, 0 means no limit
+	ConvertMillis bool  // convert millisecond timestamps to seconds
+}
+
+// Check fix timestamp of mp if it is in milliseconds and ConvertMillis set,
+// then return reason if mp is out of window, empty string if accepted
+func (w *TimestampWindow) Check(mp *MetricPoint, now int64) string {
+	if mp.Timestamp < 0 {
+		return TimestampNegative
+	}
+	if w.ConvertMillis && mp.Timestamp >= millisTimestampThreshold {
+		mp.Timestamp /= 1000
+	}
+	if w.MaxFuture > 0 && mp.Timestamp > now+w.MaxFuture {
+		return TimestampTooNew
+	}
+	if w.MaxPast > 0 && mp.Timestamp < now-w.MaxPast {
+		return TimestampTooOld
+	}
+	return ""
+}
+
+// isNowTimestamp report whether a plaintext timestamp means "now", several
+// agents send -1 or N when they don't know the time
+func isNowTimestamp(s string) bool {
+	return s == "-1" || s == "N"
+}
+
+func nowTimestamp() int64 {
+	return time.Now().Unix()
+}
@@ -22,11 +22,15 @@ type PersistManager struct {
 	DbInstance    *whisper.Whisper
 	FlushInterval time.Duration
 	cache         *cache.Cache
+	// OnPersisted is called with a time, all points added to cache before it
+	// have been stored, nil if nobody cares
+	OnPersisted   func(time.Time)
 	exit chan bool
 }
 
 func (pm *PersistManager) RegisterWhisper(rPath, cPath string) {
 	pm.DbInstance = whisper.NewWhisper(rPath, cPath, pm.cache.ChanForDB)
+	pm.DbInstance.Done = pm.cache.Done
 }
 
 func (pm *PersistManager) FindMetricList() []string {
@@ -49,7 +53,10 @@ func (pm *PersistManager) Run() {
 	for {
 		select {
 		case <-ticker.C:
-			pm.cache.MakeChanForDB()
+			persisted := pm.cache.MakeChanForDB()
+			if pm.OnPersisted != nil {
+				pm.OnPersisted(persisted)
+			}
 			pm.DbInstance.Flush()
 		case <-pm.exit:
 			fmt.Println("* PersistManager stopped")
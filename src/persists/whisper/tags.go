@@ -0,0 +1,343 @@
+package whisper
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/coder-van/v-graphite/src/common"
+)
+
+// MetricPath map metric to whisper file path under root, tagged series are
+// stored like upstream carbon: _tagged/<sha256[0:3]>/<sha256[3:6]>/<name with . as _DOT_>.wsp
+func MetricPath(root, metric string) string {
+	if common.IsTagged(metric) {
+		sum := sha256.Sum256([]byte(metric))
+		h := hex.EncodeToString(sum[:])
+		return filepath.Join(root, "_tagged", h[0:3], h[3:6],
+			strings.Replace(metric, ".", "_DOT_", -1)+".wsp")
+	}
+	return filepath.Join(root, strings.Replace(metric, ".", "/", -1)+".wsp")
+}
+
+// TagIndex index tagged series by tag and value
+type TagIndex struct {
+	sync.RWMutex
+	tags map[string]map[string]map[string]bool // tag -> value -> series set
+}
+
+func NewTagIndex() *TagIndex {
+	return &TagIndex{
+		tags: make(map[string]map[string]map[string]bool),
+	}
+}
+
+// Add index one series, series without tags is ignored
+func (ti *TagIndex) Add(series string) {
+	if !common.IsTagged(series) {
+		return
+	}
+	_, tags, err := common.ParseTagged(series)
+	if err != nil {
+		return
+	}
+
+	ti.Lock()
+	defer ti.Unlock()
+	for tag, value := range tags {
+		values, ok := ti.tags[tag]
+		if !ok {
+			values = make(map[string]map[string]bool)
+			ti.tags[tag] = values
+		}
+		set, ok := values[value]
+		if !ok {
+			set = make(map[string]bool)
+			values[value] = set
+		}
+		set[series] = true
+	}
+}
+
+// Tags return sorted tag names match filter, empty filter matches all
+func (ti *TagIndex) Tags(filter string) ([]string, error) {
+	pattern, err := compileFilter(filter)
+	if err != nil {
+		return nil, err
+	}
+
+	ti.RLock()
+	defer ti.RUnlock()
+	tags := make([]string, 0)
+	for tag := range ti.tags {
+		if pattern == nil || pattern.MatchString(tag) {
+			tags = append(tags, tag)
+		}
+	}
+	sort.Strings(tags)
+	return tags, nil
+}
+
+// TagValue is one value of tag, and how many series has it
+type TagValue struct {
+	Value string `json:"value"`
+	Count int    `json:"count"`
+}
+
+// Values return sorted values of tag match filter
+func (ti *TagIndex) Values(tag, filter string) ([]TagValue, error) {
+	pattern, err := compileFilter(filter)
+	if err != nil {
+		return nil, err
+	}
+
+	ti.RLock()
+	defer ti.RUnlock()
+	values := make([]TagValue, 0)
+	for value, set := range ti.tags[tag] {
+		if pattern == nil || pattern.MatchString(value) {
+			values = append(values, TagValue{Value: value, Count: len(set)})
+		}
+	}
+	sort.Slice(values, func(i, j int) bool { return values[i].Value < values[j].Value })
+	return values, nil
+}
+
+// AutoCompleteTags return tags start with prefix, of series match exprs if any
+func (ti *TagIndex) AutoCompleteTags(exprs []string, prefix string, limit int) ([]string, error) {
+	result := make([]string, 0)
+	if len(exprs) == 0 {
+		tags, _ := ti.Tags("")
+		for _, tag := range tags {
+			if strings.HasPrefix(tag, prefix) {
+				result = append(result, tag)
+			}
+		}
+		return limitStrings(result, limit), nil
+	}
+
+	series, err := ti.Match(exprs)
+	if err != nil {
+		return nil, err
+	}
+	exclude := make(map[string]bool)
+	for _, expr := range exprs {
+		if te, err := parseTagExpr(expr); err == nil {
+			exclude[te.tag] = true
+		}
+	}
+	set := make(map[string]bool)
+	for _, s := range series {
+		_, tags, _ := common.ParseTagged(s)
+		for tag := range tags {
+			if !exclude[tag] && strings.HasPrefix(tag, prefix) {
+				set[tag] = true
+			}
+		}
+	}
+	for tag := range set {
+		result = append(result, tag)
+	}
+	sort.Strings(result)
+	return limitStrings(result, limit), nil
+}
+
+// AutoCompleteValues return values of tag start with prefix, of series match exprs if any
+func (ti *TagIndex) AutoCompleteValues(exprs []string, tag, prefix string, limit int) ([]string, error) {
+	result := make([]string, 0)
+	if len(exprs) == 0 {
+		values, _ := ti.Values(tag, "")
+		for _, v := range values {
+			if strings.HasPrefix(v.Value, prefix) {
+				result = append(result, v.Value)
+			}
+		}
+		return limitStrings(result, limit), nil
+	}
+
+	series, err := ti.Match(exprs)
+	if err != nil {
+		return nil, err
+	}
+	set := make(map[string]bool)
+	for _, s := range series {
+		_, tags, _ := common.ParseTagged(s)
+		if v, ok := tags[tag]; ok && strings.HasPrefix(v, prefix) {
+			set[v] = true
+		}
+	}
+	for v := range set {
+		result = append(result, v)
+	}
+	sort.Strings(result)
+	return limitStrings(result, limit), nil
+}
+
+type tagExpr struct {
+	tag     string
+	op      string // =, !=, =~, !=~
+	value   string
+	pattern *regexp.Regexp
+}
+
+// match report whether a series with tags matches, a missing tag has empty value
+func (te *tagExpr) match(tags map[string]string) bool {
+	v := tags[te.tag]
+	switch te.op {
+	case "=":
+		return v == te.value
+	case "!=":
+		return v != te.value
+	case "=~":
+		return te.pattern.MatchString(v)
+	case "!=~":
+		return !te.pattern.MatchString(v)
+	}
+	return false
+}
+
+func parseTagExpr(expr string) (*tagExpr, error) {
+	i := strings.Index(expr, "=")
+	if i <= 0 {
+		return nil, fmt.Errorf("bad tag expression %#v", expr)
+	}
+	te := &tagExpr{}
+	rest := expr[i+1:]
+	if expr[i-1] == '!' {
+		te.tag = expr[:i-1]
+		te.op = "!="
+	} else {
+		te.tag = expr[:i]
+		te.op = "="
+	}
+	if strings.HasPrefix(rest, "~") {
+		te.op += "~"
+		rest = rest[1:]
+		// graphite regexps match from start of value
+		p, err := regexp.Compile("^(?:" + rest + ")")
+		if err != nil {
+			return nil, fmt.Errorf("bad regexp in tag expression %#v, %s", expr, err)
+		}
+		te.pattern = p
+	}
+	if te.tag == "" {
+		return nil, fmt.Errorf("bad tag expression %#v", expr)
+	}
+	te.value = rest
+	return te, nil
+}
+
+// Match return sorted series match all exprs like seriesByTag() does,
+// at least one expr must not match empty value
+func (ti *TagIndex) Match(exprs []string) ([]string, error) {
+	tes := make([]*tagExpr, 0, len(exprs))
+	var first *tagExpr
+	for _, expr := range exprs {
+		te, err := parseTagExpr(expr)
+		if err != nil {
+			return nil, err
+		}
+		if first == nil && !te.match(map[string]string{}) {
+			first = te
+		}
+		tes = append(tes, te)
+	}
+	if first == nil {
+		return nil, fmt.Errorf("at least one tag expression must not match empty value")
+	}
+
+	ti.RLock()
+	candidates := make(map[string]bool)
+	for value, set := range ti.tags[first.tag] {
+		if first.match(map[string]string{first.tag: value}) {
+			for s := range set {
+				candidates[s] = true
+			}
+		}
+	}
+	ti.RUnlock()
+
+	result := make([]string, 0)
+Candidates:
+	for s := range candidates {
+		_, tags, err := common.ParseTagged(s)
+		if err != nil {
+			continue
+		}
+		for _, te := range tes {
+			if !te.match(tags) {
+				continue Candidates
+			}
+		}
+		result = append(result, s)
+	}
+	sort.Strings(result)
+	return result, nil
+}
+
+// ParseSeriesByTag parse render target seriesByTag('tag=value', ...) to
+// tag expressions, ok is false if target is not a seriesByTag call
+func ParseSeriesByTag(target string) (exprs []string, ok bool, err error) {
+	target = strings.TrimSpace(target)
+	if !strings.HasPrefix(target, "seriesByTag(") {
+		return nil, false, nil
+	}
+	if !strings.HasSuffix(target, ")") {
+		return nil, true, fmt.Errorf("bad seriesByTag target %#v", target)
+	}
+	args := target[len("seriesByTag(") : len(target)-1]
+
+	// split by comma outside of quotes, regexps may have comma like {1,3}
+	exprs = make([]string, 0)
+	var quote byte
+	var cur []byte
+	closed := false
+	for i := 0; i < len(args); i++ {
+		c := args[i]
+		switch {
+		case quote != 0 && c == quote:
+			quote = 0
+			closed = true
+		case quote != 0:
+			cur = append(cur, c)
+		case c == '\'' || c == '"':
+			if closed || len(cur) > 0 {
+				return nil, true, fmt.Errorf("bad seriesByTag target %#v", target)
+			}
+			quote = c
+		case c == ',':
+			if !closed {
+				return nil, true, fmt.Errorf("bad seriesByTag target %#v", target)
+			}
+			exprs = append(exprs, string(cur))
+			cur, closed = nil, false
+		case c == ' ' || c == '\t':
+		default:
+			return nil, true, fmt.Errorf("bad seriesByTag target %#v", target)
+		}
+	}
+	if quote != 0 || !closed {
+		return nil, true, fmt.Errorf("bad seriesByTag target %#v", target)
+	}
+	exprs = append(exprs, string(cur))
+	return exprs, true, nil
+}
+
+func compileFilter(filter string) (*regexp.Regexp, error) {
+	if filter == "" {
+		return nil, nil
+	}
+	return regexp.Compile(filter)
+}
+
+func limitStrings(s []string, limit int) []string {
+	if limit > 0 && len(s) > limit {
+		return s[:limit]
+	}
+	return s
+}
@@ -0,0 +1,105 @@
+package whisper
+
+import (
+	"io/ioutil"
+	"os"
+	"path"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// newTestWhisper start a whisper like at startup, with metric list of series
+// stored by a previous run
+func newTestWhisper(t *testing.T, dir string, series []string) *Whisper {
+	schemas := "[default]\npattern = .*\nretentions = 60s:1d\n"
+	if err := ioutil.WriteFile(filepath.Join(dir, "storage-schemas.conf"), []byte(schemas), 0644); err != nil {
+		t.Fatal(err)
+	}
+	list := strings.Join(series, "\n") + "\n"
+	if err := ioutil.WriteFile(path.Join(dir, "metirc-directory"), []byte(list), 0644); err != nil {
+		t.Fatal(err)
+	}
+	w := NewWhisper(dir, dir, nil)
+	w.Init()
+	return w
+}
+
+func TestTagIndex(t *testing.T) {
+	dir, err := ioutil.TempDir("", "tags")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	// index is rebuilt from metric list at startup
+	w := newTestWhisper(t, dir, []string{
+		"cpu;dc=east;host=a",
+		"cpu;dc=west;host=b",
+		"cpu;host=c",
+		"mem;dc=east;host=a",
+		"servers.a.cpu",
+	})
+
+	tests := []struct {
+		exprs []string
+		want  []string
+	}{
+		{[]string{"name=cpu"}, []string{"cpu;dc=east;host=a", "cpu;dc=west;host=b", "cpu;host=c"}},
+		{[]string{"name=cpu", "dc=east"}, []string{"cpu;dc=east;host=a"}},
+		{[]string{"name=cpu", "dc!=east"}, []string{"cpu;dc=west;host=b", "cpu;host=c"}},
+		{[]string{"host=~[ab]"}, []string{"cpu;dc=east;host=a", "cpu;dc=west;host=b", "mem;dc=east;host=a"}},
+		// regexps match from start of value
+		{[]string{"name=~pu"}, []string{}},
+		{[]string{"name=~c", "dc!=~w"}, []string{"cpu;dc=east;host=a", "cpu;host=c"}},
+		// missing tag has empty value
+		{[]string{"name=cpu", "dc="}, []string{"cpu;host=c"}},
+		{[]string{"host=x"}, []string{}},
+	}
+	for _, tt := range tests {
+		got, err := w.MatchTags(tt.exprs)
+		if err != nil {
+			t.Errorf("%v: %s", tt.exprs, err)
+			continue
+		}
+		if !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("%v: got %v, want %v", tt.exprs, got, tt.want)
+		}
+	}
+
+	for _, exprs := range [][]string{{"dc!=east"}, {"dc=~.*"}, {"dc"}, {"dc=~("}} {
+		if _, err := w.MatchTags(exprs); err == nil {
+			t.Errorf("%v: expected error", exprs)
+		}
+	}
+
+	values, err := w.Tags.Values("dc", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(values, []TagValue{{"east", 2}, {"west", 1}}) {
+		t.Errorf("values of dc: got %v", values)
+	}
+
+	// tagged series are found by seriesByTag only
+	matched, err := w.Match("*")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(matched, []string{"servers.a.cpu"}) {
+		t.Errorf("match: got %v, want untagged only", matched)
+	}
+	nodes, err := w.FindNodes("*")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, node := range nodes {
+		if strings.Contains(node.Metric, ";") || strings.HasPrefix(node.Metric, "cpu") {
+			t.Errorf("find nodes: got tagged %s", node.Metric)
+		}
+	}
+	if len(nodes) == 0 || nodes[len(nodes)-1].Metric != "servers.a.cpu" {
+		t.Errorf("find nodes: servers.a.cpu not found in %v", nodes)
+	}
+}
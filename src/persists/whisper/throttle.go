@@ -0,0 +1,99 @@
+package whisper
+
+import (
+	"sync"
+	"time"
+
+	statsd "github.com/coder-van/v-stats"
+)
+
+// throttle is a token bucket like carbon's, nil throttle allows everything
+type throttle struct {
+	mu       sync.Mutex
+	rate     float64 // tokens per second
+	capacity float64
+	tokens   float64
+	last     time.Time
+}
+
+// newThrottle return nil if rate <= 0, bucket starts full
+func newThrottle(rate, capacity float64) *throttle {
+	if rate <= 0 {
+		return nil
+	}
+	if capacity < 1 {
+		capacity = 1
+	}
+	return &throttle{
+		rate:     rate,
+		capacity: capacity,
+		tokens:   capacity,
+		last:     time.Now(),
+	}
+}
+
+// take a token if there is one, else return how long until there is
+func (t *throttle) take() time.Duration {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	now := time.Now()
+	t.tokens += now.Sub(t.last).Seconds() * t.rate
+	if t.tokens > t.capacity {
+		t.tokens = t.capacity
+	}
+	t.last = now
+	if t.tokens >= 1 {
+		t.tokens--
+		return 0
+	}
+	return time.Duration((1 - t.tokens) / t.rate * float64(time.Second))
+}
+
+// Allow take a token without waiting
+func (t *throttle) Allow() bool {
+	return t == nil || t.take() == 0
+}
+
+// Wait block until a token is taken, return time waited
+func (t *throttle) Wait() time.Duration {
+	if t == nil {
+		return 0
+	}
+	start := time.Now()
+	for d := t.take(); d > 0; d = t.take() {
+		time.Sleep(d)
+	}
+	return time.Since(start)
+}
+
+// persistThrottle limit whisper updates and creates like carbon's
+// MAX_UPDATES_PER_SECOND and MAX_CREATES_PER_MINUTE, 0 means no limit
+type persistThrottle struct {
+	updates *throttle
+	creates *throttle
+	stat    *statsd.BaseStat
+}
+
+func newPersistThrottle(maxUpdatesPerSecond, maxCreatesPerMinute int, stat *statsd.BaseStat) *persistThrottle {
+	return &persistThrottle{
+		updates: newThrottle(float64(maxUpdatesPerSecond), float64(maxUpdatesPerSecond)),
+		creates: newThrottle(float64(maxCreatesPerMinute)/60, float64(maxCreatesPerMinute)),
+		stat:    stat,
+	}
+}
+
+func (t *persistThrottle) allowCreate() bool {
+	if t.creates.Allow() {
+		return true
+	}
+	t.stat.CounterInc("creates-deferred", 1)
+	return false
+}
+
+func (t *persistThrottle) waitUpdate() {
+	if d := t.updates.Wait(); d > time.Millisecond {
+		t.stat.CounterInc("updates-throttled", 1)
+		t.stat.CounterInc("updates-throttled-ms", int(d/time.Millisecond))
+	}
+}
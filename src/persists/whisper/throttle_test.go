@@ -0,0 +1,134 @@
+package whisper
+
+import (
+	"errors"
+	"io/ioutil"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/coder-van/v-graphite/src/common"
+)
+
+func TestThrottle(t *testing.T) {
+	var nilThrottle *throttle
+	if !nilThrottle.Allow() || nilThrottle.Wait() != 0 {
+		t.Error("nil throttle should allow everything")
+	}
+	if newThrottle(0, 10) != nil {
+		t.Error("rate 0 should give nil throttle")
+	}
+
+	th := newThrottle(10, 3)
+	allowed := 0
+	for i := 0; i < 10; i++ {
+		if th.Allow() {
+			allowed++
+		}
+	}
+	if allowed != 3 {
+		t.Errorf("allowed %d, want burst of 3", allowed)
+	}
+	if d := th.Wait(); d < 50*time.Millisecond {
+		t.Errorf("waited %s, want about 100ms", d)
+	}
+}
+
+func TestStoreCreateDeferred(t *testing.T) {
+	dir, err := ioutil.TempDir("", "whisper")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	retentions, err := ParseRetentionMaps("60s:1d")
+	if err != nil {
+		t.Fatal(err)
+	}
+	now := time.Now().Unix()
+	bag := common.PointBag{Metric: "a.b", Data: []common.Point{{Value: 1, Timestamp: now}}}
+	stat := common.GetStat("test_db")
+	// one create a minute, used up by the first file
+	th := newPersistThrottle(0, 1, stat)
+	for i, metric := range []string{"a.b", "c.d"} {
+		swf := &SynsWhisperFile{
+			schema: Schema{Retentions: retentions},
+			aggr:   NewWhisperAggregation().Match(metric),
+		}
+		bag.Metric = metric
+		err := swf.Store(dir, bag, th)
+		_, statErr := os.Stat(MetricPath(dir, metric))
+		if i == 0 && (err != nil || statErr != nil) {
+			t.Fatalf("%s: store %v, stat %v", metric, err, statErr)
+		}
+		if i == 1 && (err != errCreateDeferred || !os.IsNotExist(statErr)) {
+			t.Fatalf("%s: store %v, stat %v, want creation deferred", metric, err, statErr)
+		}
+	}
+
+	// existing file is updated without taking a create token
+	swf := &SynsWhisperFile{schema: Schema{Retentions: retentions}, aggr: NewWhisperAggregation().Match("a.b")}
+	bag.Metric = "a.b"
+	bag.Data[0].Value = 2
+	if err := swf.Store(dir, bag, th); err != nil {
+		t.Fatal(err)
+	}
+	wf, err := Open(MetricPath(dir, "a.b"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer wf.Close()
+	ts, err := wf.Fetch(int(now-60), int(now))
+	if err != nil {
+		t.Fatal(err)
+	}
+	found := false
+	for _, v := range ts.Values() {
+		found = found || v == 2
+	}
+	if !found {
+		t.Errorf("stored value not found in %v", ts.Values())
+	}
+}
+
+func TestStoreRetries(t *testing.T) {
+	dir, err := ioutil.TempDir("", "whisper")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	retentions, err := ParseRetentionMaps("60s:1d")
+	if err != nil {
+		t.Fatal(err)
+	}
+	// a directory where the file should be, never can be opened
+	if err := os.MkdirAll(MetricPath(dir, "a.b"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	swf := &SynsWhisperFile{schema: Schema{Retentions: retentions}, aggr: NewWhisperAggregation().Match("a.b")}
+	bag := common.PointBag{Metric: "a.b", Data: []common.Point{{Value: 1, Timestamp: time.Now().Unix()}}}
+	for i := 1; i <= maxStoreRetries; i++ {
+		err := swf.Store(dir, bag, nil)
+		if err == nil || err == errCreateDeferred {
+			t.Fatalf("store %v, want error", err)
+		}
+		if drop := swf.giveUp(err); drop != (i == maxStoreRetries) {
+			t.Fatalf("attempt %d: drop %v", i, drop)
+		}
+	}
+
+	// deferred creation is not a failure, success starts counting again
+	swf.giveUp(errors.New("store failed"))
+	for i := 0; i < 2*maxStoreRetries; i++ {
+		if swf.giveUp(errCreateDeferred) {
+			t.Fatal("dropped deferred creation")
+		}
+	}
+	swf.giveUp(nil)
+	for i := 1; i < maxStoreRetries; i++ {
+		if swf.giveUp(errors.New("store failed")) {
+			t.Fatalf("attempt %d: dropped before max retries", i)
+		}
+	}
+}
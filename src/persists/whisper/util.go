@@ -42,6 +42,22 @@ const (
 	Min
 )
 
+func (m AggregationMethod) String() string {
+	switch m {
+	case Average:
+		return "average"
+	case Sum:
+		return "sum"
+	case Last:
+		return "last"
+	case Max:
+		return "max"
+	case Min:
+		return "min"
+	}
+	return fmt.Sprintf("unknown(%d)", int(m))
+}
+
 // 将配置文件的retention 时间转换成秒
 func unitMultiplier(s string) (int, error) {
 	switch {
@@ -283,7 +299,9 @@ func (whisper *WhisperFile) Update(value float64, timestamp int) (err error) {
 	return nil
 }
 
-func (whisper *WhisperFile) UpdateMany(points []*TimeSeriesPoint) {
+// UpdateMany write points to archives covering them, the first write error
+// is returned
+func (whisper *WhisperFile) UpdateMany(points []*TimeSeriesPoint) error {
 	// sort the points, newest first
 	sort.Sort(timeSeriesPointsNewestFirst{points})
 
@@ -299,15 +317,18 @@ func (whisper *WhisperFile) UpdateMany(points []*TimeSeriesPoint) {
 		for i, j := 0, len(currentPoints)-1; i < j; i, j = i+1, j-1 {
 			currentPoints[i], currentPoints[j] = currentPoints[j], currentPoints[i]
 		}
-		whisper.archiveUpdateMany(&archive, currentPoints)
+		if err := whisper.archiveUpdateMany(&archive, currentPoints); err != nil {
+			return err
+		}
 
 		if len(points) == 0 { // nothing left to do
 			break
 		}
 	}
+	return nil
 }
 
-func (whisper *WhisperFile) archiveUpdateMany(archive *archiveInfo, points []*TimeSeriesPoint) {
+func (whisper *WhisperFile) archiveUpdateMany(archive *archiveInfo, points []*TimeSeriesPoint) error {
 	alignedPoints := alignPoints(archive, points)
 	intervals, packedBlocks := packSequences(archive, alignedPoints)
 
@@ -319,12 +340,17 @@ func (whisper *WhisperFile) archiveUpdateMany(archive *archiveInfo, points []*Ti
 	for i := range intervals {
 		myOffset := archive.PointOffset(baseInterval, intervals[i])
 		bytesBeyond := int(myOffset-archive.End()) + len(packedBlocks[i])
+		var err error
 		if bytesBeyond > 0 {
 			pos := len(packedBlocks[i]) - bytesBeyond
-			whisper.file.WriteAt(packedBlocks[i][:pos], myOffset)
-			whisper.file.WriteAt(packedBlocks[i][pos:], archive.Offset())
+			if _, err = whisper.file.WriteAt(packedBlocks[i][:pos], myOffset); err == nil {
+				_, err = whisper.file.WriteAt(packedBlocks[i][pos:], archive.Offset())
+			}
 		} else {
-			whisper.file.WriteAt(packedBlocks[i], myOffset)
+			_, err = whisper.file.WriteAt(packedBlocks[i], myOffset)
+		}
+		if err != nil {
+			return err
 		}
 	}
 
@@ -338,7 +364,7 @@ func (whisper *WhisperFile) archiveUpdateMany(archive *archiveInfo, points []*Ti
 			interval := point.interval - mod(point.interval, lower.secondsPerPoint)
 			if !seen[interval] {
 				if propagated, err := whisper.propagate(interval, &higher, &lower); err != nil {
-					panic("Failed to propagate")
+					return err
 				} else if propagated {
 					propagateFurther = true
 				}
@@ -349,6 +375,7 @@ func (whisper *WhisperFile) archiveUpdateMany(archive *archiveInfo, points []*Ti
 		}
 		higher = lower
 	}
+	return nil
 }
 
 func extractPoints(points []*TimeSeriesPoint, now int, maxRetention int) (currentPoints []*TimeSeriesPoint, remainingPoints []*TimeSeriesPoint) {
@@ -460,7 +487,9 @@ func (whisper *WhisperFile) propagate(timestamp int, higher, lower *archiveInfo)
 	} else {
 		aggregateValue := aggregate(whisper.aggregationMethod, knownValues)
 		point := dataPoint{lowerIntervalStart, aggregateValue}
-		whisper.file.WriteAt(point.Bytes(), whisper.getPointOffset(lowerIntervalStart, lower))
+		if _, err := whisper.file.WriteAt(point.Bytes(), whisper.getPointOffset(lowerIntervalStart, lower)); err != nil {
+			return false, err
+		}
 	}
 	return true, nil
 }
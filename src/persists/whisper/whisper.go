@@ -11,6 +11,7 @@ import (
 	"regexp"
 	"sort"
 	"sync"
+	"errors"
 	"time"
 	
 	"github.com/coder-van/v-graphite/src/common"
@@ -23,39 +24,84 @@ type SynsWhisperFile struct{
 	sync.Mutex
 	schema Schema
 	aggr *AggregationItem
+	missing bool // file not exists and creation was deferred, no need to try open
+	failures int // store errors in a row
 	*WhisperFile
 }
 
-func (swf *SynsWhisperFile) Store(RootPath string, bag common.PointBag) {
+// maxStoreRetries is how many times in a row points failed to store are
+// given back to cache, then they are dropped, so a broken file doesn't hold
+// wal truncation and cache forever
+const maxStoreRetries = 5
+
+// giveUp count a store error, report whether points failed to store should
+// be dropped instead of retried
+func (swf *SynsWhisperFile) giveUp(err error) bool {
+	swf.Lock()
+	defer swf.Unlock()
+	switch err {
+	case nil:
+		swf.failures = 0
+		return false
+	case errCreateDeferred:
+		return false
+	}
+	swf.failures++
+	if swf.failures < maxStoreRetries {
+		return false
+	}
+	swf.failures = 0
+	return true
+}
+
+// errCreateDeferred is returned by Store if the file not exists and creating
+// it is not allowed by throttle now
+var errCreateDeferred = errors.New("whisper file creation deferred")
+
+// Store write bag to whisper file, nil is returned only if all points are
+// written
+func (swf *SynsWhisperFile) Store(RootPath string, bag common.PointBag, t *persistThrottle) (err error) {
 	swf.Lock()
 	defer swf.Unlock()
 	
 	logger := log.GetLogger("whisper", log.RotateModeMonth)
 	
-	p := filepath.Join(RootPath, strings.Replace(bag.Metric, ".", "/", -1)+".wsp")
+	p := MetricPath(RootPath, bag.Metric)
 	
-	wf, err := Open(p)
+	var wf *WhisperFile
+	err = os.ErrNotExist
+	if !swf.missing {
+		wf, err = Open(p)
+	}
 	if err != nil {
 		// create new whisper if file not exists
 		
 		if !os.IsNotExist(err) {
 			logger.Printf("ERROR: failed to open whisper file %s, %s \n", p, err.Error())
-			return
+			return err
+		}
+		
+		if !t.allowCreate() {
+			swf.missing = true
+			return errCreateDeferred
 		}
+		swf.missing = false
 		
 		if err = os.MkdirAll(filepath.Dir(p), os.ModeDir|os.ModePerm); err != nil {
 			logger.Printf("ERROR: mkdir failed %s, %s \n", p, err.Error())
-			return
+			return err
 		}
 		
 		wf, err = Create(p, swf.schema.Retentions, swf.aggr.aggregationMethod, float32(swf.aggr.xFilesFactor))
 		if err != nil {
 			logger.Printf("ERROR: create new whisper file failed %s, %s \n", p, err)
-			return
+			return err
 		}
+		t.stat.CounterInc("metric-create", 1)
 	}
 	
 	swf.WhisperFile = wf
+	t.waitUpdate()
 	
 	l := len(bag.Data)
 	points := make([]*TimeSeriesPoint, l)
@@ -68,12 +114,17 @@ func (swf *SynsWhisperFile) Store(RootPath string, bag common.PointBag) {
 	defer func() {
 		if r := recover(); r != nil {
 			logger.Printf("Error: defer recovered UpdateMany panic %s, %s", p, fmt.Sprint(r))
+			err = fmt.Errorf("UpdateMany panic, %v", r)
 		}
 	}()
 	
 	start := time.Now()
-	wf.UpdateMany(points)
+	if err = wf.UpdateMany(points); err != nil {
+		logger.Printf("ERROR: update whisper file failed %s, %s \n", p, err)
+		return err
+	}
 	logger.Debug(fmt.Sprintf("Store %d points to %s use %s \n", l, p, time.Since(start)))
+	return nil
 }
 
 // Whisper manage hao whisper read and writer actions
@@ -87,6 +138,12 @@ type Whisper struct {
 	ChanForDB   chan *common.PointBag
 	exit        chan bool
 	wfs         map[string]*SynsWhisperFile
+	Tags        *TagIndex
+	throttle    *persistThrottle
+	// Done is called for every bag taken from ChanForDB, finished is false if
+	// it is not stored and should be retried, like its file creation is
+	// deferred or writing failed
+	Done        func(pb *common.PointBag, finished bool)
 	
 	logger      *log.Vlogger
 	stat        *statsd.BaseStat
@@ -95,17 +152,26 @@ type Whisper struct {
 
 // NewWhisper create instance of Whisper
 func NewWhisper(rPath, cPath string, ch chan *common.PointBag) *Whisper {
-	return &Whisper{
+	w := &Whisper{
 		RootPath:  rPath,
 		ConfigDir: cPath,
 		
 		ChanForDB: ch,
 		exit:      make(chan bool),
 		wfs:       make(map[string]*SynsWhisperFile),
+		Tags:      NewTagIndex(),
 		
 		logger:    log.GetLogger("whisper", log.RotateModeMonth),
 		stat:      common.GetStat("db"),
 	}
+	w.SetThrottle(0, 0)
+	return w
+}
+
+// SetThrottle limit whisper updates per second and creates per minute, 0
+// means no limit, must be called before Start
+func (w *Whisper) SetThrottle(maxUpdatesPerSecond, maxCreatesPerMinute int) {
+	w.throttle = newPersistThrottle(maxUpdatesPerSecond, maxCreatesPerMinute, w.stat)
 }
 
 func (w *Whisper) FindMetricList() []string {
@@ -130,6 +196,10 @@ func (w *Whisper) FindNodes(query string) (common.NodeList, error) {
 	}
 	nodes := make(common.NodeList, 0)
 	for k := range w.wfs {
+		if common.IsTagged(k) {
+			// tagged series are found by seriesByTag only
+			continue
+		}
 		if pattern.MatchString(k) {
 			node := common.NewNode(k, true)
 			nodes = append(nodes, node)
@@ -178,6 +248,9 @@ func (w *Whisper) Match(query string) ([]string, error) {
 	}
 	wfs := make([]string, 0)
 	for k := range w.wfs {
+		if common.IsTagged(k) {
+			continue
+		}
 		if pattern.MatchString(k) {
 			wfs = append(wfs, k)
 		}
@@ -185,6 +258,11 @@ func (w *Whisper) Match(query string) ([]string, error) {
 	return wfs, nil
 }
 
+// MatchTags find tagged series match tag expressions of seriesByTag()
+func (w *Whisper) MatchTags(exprs []string) ([]string, error) {
+	return w.Tags.Match(exprs)
+}
+
 func (w *Whisper) loadConfig() {
 	w.aggregation = NewWhisperAggregation()
 
@@ -236,6 +314,7 @@ func (w *Whisper) getSWF(metric string)  *SynsWhisperFile {
 			schema: schema,
 			aggr: aggr,
 		}
+		w.Tags.Add(metric)
 		w.stat.GaugeInc("metric-count", 1)
 		return w.wfs[metric]
 	}
@@ -251,7 +330,23 @@ func (w *Whisper) Run(i int)  {
 			//	w.logger.Printf("write pb to db %s \n", pb)
 			//}
 			swf := w.getSWF(pb.Metric)
-			swf.Store(w.RootPath, *pb)
+			if swf == nil {
+				// no schema, never can be stored
+				w.done(pb, true)
+				continue
+			}
+			err := swf.Store(w.RootPath, *pb, w.throttle)
+			if err != nil && err != errCreateDeferred {
+				w.stat.CounterInc("store-errors", 1)
+			}
+			if swf.giveUp(err) {
+				w.stat.CounterInc("store-dropped", len(pb.Data))
+				w.logger.Printf("drop %d points of %s after %d store errors, %s \n",
+					len(pb.Data), pb.Metric, maxStoreRetries, err)
+				w.done(pb, true)
+				continue
+			}
+			w.done(pb, err == nil)
 		case <- w.exit:
 			fmt.Printf("* whisper write-goroutine %d exit \n", i)
 			return
@@ -259,6 +354,12 @@ func (w *Whisper) Run(i int)  {
 	}
 }
 
+func (w *Whisper) done(pb *common.PointBag, finished bool) {
+	if w.Done != nil {
+		w.Done(pb, finished)
+	}
+}
+
 func (w *Whisper) Start() {
 	
 	w.loadConfig()
@@ -282,7 +383,7 @@ func (w *Whisper) Stop() {
 }
 
 func (w *Whisper) Open(metric string) (*WhisperFile, error) {
-	p := filepath.Join(w.RootPath, strings.Replace(metric, ".", "/", -1)+".wsp")
+	p := MetricPath(w.RootPath, metric)
 
 	wf, err := Open(p)
 	if err != nil {
@@ -293,6 +394,33 @@ func (w *Whisper) Open(metric string) (*WhisperFile, error) {
 }
 
 
+// ArchiveConfig return (secondsPerPoint, points) of archives of the schema
+// metric matches, what carbonlink get-storageschema answers
+func (w *Whisper) ArchiveConfig(metric string) ([][2]int, bool) {
+	schema, ok := w.schemas.Match(metric)
+	if !ok {
+		return nil, false
+	}
+	archives := make([][2]int, 0, len(schema.Retentions))
+	for _, r := range schema.Retentions {
+		archives = append(archives, [2]int{r.secondsPerPoint, r.numberOfPoints})
+	}
+	return archives, true
+}
+
+// GetMetadata read metadata of metric file, only aggregationMethod like carbon
+func (w *Whisper) GetMetadata(metric, key string) (string, error) {
+	if key != "aggregationMethod" {
+		return "", fmt.Errorf("Unsupported metadata key \"%s\"", key)
+	}
+	wf, err := w.Open(metric)
+	if err != nil {
+		return "", err
+	}
+	defer wf.Close()
+	return wf.aggregationMethod.String(), nil
+}
+
 func (w *Whisper) Flush() {}
 
 /* scan whisper data path, */
@@ -0,0 +1,69 @@
+package receivers
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/coder-van/v-graphite/src/common"
+	statsd "github.com/coder-van/v-stats"
+)
+
+// BackpressurePolicy decide what a receiver does when ChanPointBagsReceived is full
+type BackpressurePolicy int
+
+const (
+	// BackpressureBlock wait until there is room, slow clients down
+	BackpressureBlock BackpressurePolicy = iota
+	// BackpressureDropNewest drop the point just received
+	BackpressureDropNewest
+	// BackpressureDropOldest drop the oldest point queued to make room
+	BackpressureDropOldest
+)
+
+func ParseBackpressurePolicy(s string) (BackpressurePolicy, error) {
+	switch s {
+	case "", "block":
+		return BackpressureBlock, nil
+	case "drop-newest":
+		return BackpressureDropNewest, nil
+	case "drop-oldest":
+		return BackpressureDropOldest, nil
+	}
+	return BackpressureBlock, fmt.Errorf("Unknown backpressure policy '%s', should be one of: block, drop-newest, drop-oldest", s)
+}
+
+// pushPoint send mp to ch, following policy when ch is full, counters are
+// named after receiver name, receivers of a type share stat, return false if
+// mp itself is dropped
+func pushPoint(ch chan common.MetricPoint, policy BackpressurePolicy,
+	stat *statsd.BaseStat, name string, mp common.MetricPoint) bool {
+	select {
+	case ch <- mp:
+		return true
+	default:
+	}
+
+	switch policy {
+	case BackpressureDropNewest:
+		stat.CounterInc("backpressure-dropped-"+name, 1)
+		return false
+	case BackpressureDropOldest:
+		for {
+			select {
+			case <-ch:
+				stat.CounterInc("backpressure-dropped-"+name, 1)
+			default:
+			}
+			select {
+			case ch <- mp:
+				return true
+			default:
+			}
+		}
+	default:
+		start := time.Now()
+		ch <- mp
+		stat.CounterInc("backpressure-block-ms-"+name, int64(time.Since(start)/time.Millisecond))
+	}
+	return true
+}
@@ -0,0 +1,52 @@
+package receivers
+
+import (
+	"testing"
+
+	"github.com/coder-van/v-graphite/src/common"
+)
+
+func TestPushPoint(t *testing.T) {
+	stat := common.GetStat("test_receiver")
+	tests := []struct {
+		policy BackpressurePolicy
+		want   []string // keys left in channel of size 2 after pushing a, b, c
+		pushed bool     // whether c is pushed
+	}{
+		{BackpressureDropNewest, []string{"a", "b"}, false},
+		{BackpressureDropOldest, []string{"b", "c"}, true},
+	}
+	for _, tt := range tests {
+		ch := make(chan common.MetricPoint, 2)
+		for _, key := range []string{"a", "b", "c"} {
+			pushed := pushPoint(ch, tt.policy, stat, "test", common.MetricPoint{Key: key})
+			if pushed != (key != "c" || tt.pushed) {
+				t.Errorf("policy %d: %s pushed %v", tt.policy, key, pushed)
+			}
+		}
+		close(ch)
+		var got []string
+		for mp := range ch {
+			got = append(got, mp.Key)
+		}
+		if len(got) != len(tt.want) || got[0] != tt.want[0] || got[1] != tt.want[1] {
+			t.Errorf("policy %d: got %v, want %v", tt.policy, got, tt.want)
+		}
+	}
+
+	// block waits for room
+	ch := make(chan common.MetricPoint, 1)
+	ch <- common.MetricPoint{Key: "a"}
+	done := make(chan bool)
+	go func() {
+		pushPoint(ch, BackpressureBlock, stat, "test", common.MetricPoint{Key: "b"})
+		close(done)
+	}()
+	if mp := <-ch; mp.Key != "a" {
+		t.Fatalf("got %s, want a", mp.Key)
+	}
+	<-done
+	if mp := <-ch; mp.Key != "b" {
+		t.Fatalf("got %s, want b", mp.Key)
+	}
+}
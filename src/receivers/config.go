@@ -0,0 +1,115 @@
+package receivers
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+const (
+	defaultMaxPickleMessageSize = 64 * 1024 * 1024 // 64M, same as carbon
+)
+
+// Config of one [receivers.*] section in carbon.conf
+type Config struct {
+	Listen               string `toml:"listen"`
+	IsPickle             bool   `toml:"is-pickle"`
+	MaxPickleMessageSize uint32 `toml:"max-pickle-message-size"`
+	// block, drop-newest or drop-oldest when receive channel is full
+	Backpressure string `toml:"backpressure"`
+
+	// tcp, opentsdb and influx tcp connection limits, 0 means no limit
+	MaxConns      int `toml:"max-connections"`
+	MaxConnsPerIP int `toml:"max-connections-per-ip"`
+	IdleTimeout   int `toml:"idle-timeout"`    // seconds, default 120
+	MaxLineLength int `toml:"max-line-length"` // bytes, plaintext lines only
+
+	// points per second, 0 means no limit, statsd is not limited
+	RateLimit         float64            `toml:"rate-limit"`          // of whole receiver
+	RateLimitPerIP    float64            `toml:"rate-limit-per-ip"`   // of each source ip
+	RateLimitPrefixes map[string]float64 `toml:"rate-limit-prefixes"` // of metrics by longest prefix
+	RateLimitPolicy   string             `toml:"rate-limit-policy"`   // drop or delay
+
+	// tcp, opentsdb, influx and prometheus, tls is enabled when cert and key set
+	TLSCert         string `toml:"tls-cert"`
+	TLSKey          string `toml:"tls-key"`
+	TLSClientCA     string `toml:"tls-client-ca"`
+	TLSVerifyClient bool   `toml:"tls-verify-client"` // reject clients without cert signed by client ca
+	TLSMinVersion   string `toml:"tls-min-version"`   // 1.0, 1.1, 1.2 or 1.3, default 1.2
+
+	// unix only, e.g. listen = "unix:/var/run/carbon.sock"
+	SocketType string `toml:"socket-type"` // stream or datagram
+	SocketMode string `toml:"socket-mode"` // octal permissions of socket file, e.g. "0660"
+
+	// udp, statsd and unix datagram
+	ReadBufferSize    int `toml:"read-buffer-size"`
+	MaxLinesPerPacket int `toml:"max-lines-per-packet"`
+	SocketBufferSize  int `toml:"socket-buffer-size"` // SO_RCVBUF in bytes, 0 keeps os default
+
+	// prometheus and influx, e.g. "prom.{job}.{__name__}", "{host}.{measurement}.{field}"
+	Template string `toml:"template"`
+	// influx only, timestamp precision of tcp lines: ns, us, ms, s, m or h
+	Precision string `toml:"precision"`
+
+	// statsd only
+	FlushInterval int       `toml:"flush-interval"` // seconds
+	GaugeTTL      int       `toml:"gauge-ttl"`      // seconds, default 3600, negative means never expire
+	Percentiles   []float64 `toml:"percentiles"`    // e.g. [50, 90, 99]
+	StatsDPrefixes
+
+	// opentsdb only, tags or path
+	TagMode  string   `toml:"tag-mode"`
+	TagOrder []string `toml:"tag-order"` // path mode, values of these tags follow metric name
+}
+
+func (c *Config) String() string {
+	str := "Listen string =" + string(c.Listen)
+	str += "IsPickle  bool=" + strconv.FormatBool(c.IsPickle)
+	return str
+}
+
+// Check fill defaults for settings not set
+func (c *Config) Check() {
+	if c.MaxPickleMessageSize == 0 {
+		c.MaxPickleMessageSize = defaultMaxPickleMessageSize
+	}
+	if c.RateLimitPolicy == "" {
+		c.RateLimitPolicy = RateLimitDrop
+	}
+	if c.IdleTimeout <= 0 {
+		c.IdleTimeout = defaultIdleTimeout
+	}
+	if c.ReadBufferSize <= 0 {
+		c.ReadBufferSize = defaultUDPReadBufferSize
+	}
+	if c.MaxLinesPerPacket <= 0 {
+		c.MaxLinesPerPacket = defaultUDPMaxLinesPerPacket
+	}
+	if c.FlushInterval <= 0 {
+		c.FlushInterval = defaultStatsDFlushInterval
+	}
+	if c.GaugeTTL == 0 {
+		c.GaugeTTL = defaultStatsDGaugeTTL
+	}
+	if c.Percentiles == nil {
+		c.Percentiles = defaultStatsDPercentiles
+	}
+	if c.StatsDPrefixes == (StatsDPrefixes{}) {
+		c.StatsDPrefixes = defaultStatsDPrefixes
+	}
+	if c.SocketType == "" {
+		c.SocketType = UnixSocketStream
+	}
+	if c.TagMode == "" {
+		c.TagMode = OpenTSDBTagModeTags
+	}
+}
+
+// parseListen split listen setting like "tcp:2003" to type and address
+func parseListen(listen string) (t, addr string, err error) {
+	r := strings.SplitN(listen, ":", 2)
+	if len(r) != 2 || r[0] == "" {
+		return "", "", fmt.Errorf("bad listen setting '%s', should be type:port", listen)
+	}
+	return r[0], r[1], nil
+}
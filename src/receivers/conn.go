@@ -8,6 +8,7 @@
 package receivers
 
 import (
+	"bytes"
 	"encoding/binary"
 	"errors"
 	"io"
@@ -20,7 +21,7 @@ var (
 	// ErrPrefixLength is returned when an invalid prefix length is given.
 	ErrPrefixLength = errors.New("Invalid frame prefix length")
 	// ErrFrameTooLarge is returned from Write(b []byte) when b is larger than
-	// MaxFrameSize.
+	// MaxFrameSize, or from reads when the frame prefix exceeds MaxFrameSize.
 	ErrFrameTooLarge = errors.New("Frame too large for buffer size")
 )
 
@@ -86,6 +87,10 @@ func (f *Conn) Read(b []byte) (n int, err error) {
 	return
 }
 
+// frameChunkSize is how much ReadFrame allocates before any frame data
+// arrives, the buffer grows with the data actually read
+const frameChunkSize = 64 * 1024
+
 // ReadFrame returns the next full frame in the stream.
 func (f *Conn) ReadFrame() (frame []byte, err error) {
 	size, err := f.readSize()
@@ -93,13 +98,18 @@ func (f *Conn) ReadFrame() (frame []byte, err error) {
 		return nil, err
 	}
 
-	buf := make([]byte, size)
-	_, err = io.ReadFull(f.Conn, buf)
+	// size is from the peer, don't allocate it all before data comes
+	var buf bytes.Buffer
+	buf.Grow(min(size, frameChunkSize))
+	n, err := buf.ReadFrom(io.LimitReader(f.Conn, int64(size)))
 	if err != nil {
 		return nil, err
 	}
+	if n < int64(size) {
+		return nil, io.ErrUnexpectedEOF
+	}
 
-	return buf, nil
+	return buf.Bytes(), nil
 }
 
 func (f *Conn) readSize() (size int, err error) {
@@ -121,7 +131,7 @@ func (f *Conn) readSize() (size int, err error) {
 		return 0, err
 	}
 	if uint(size) > f.MaxFrameSize {
-		return 0, ErrPrefixLength
+		return 0, ErrFrameTooLarge
 	}
 	return size, nil
 }
@@ -0,0 +1,58 @@
+package receivers
+
+import (
+	"bytes"
+	"encoding/binary"
+	"io"
+	"net"
+	"testing"
+)
+
+func TestReadFrame(t *testing.T) {
+	client, server := net.Pipe()
+	defer server.Close()
+	c, err := NewConn(server, byte(4), binary.BigEndian)
+	if err != nil {
+		t.Fatal(err)
+	}
+	c.MaxFrameSize = 64 * 1024 * 1024
+
+	big := bytes.Repeat([]byte("x"), 3*frameChunkSize+1)
+	go func() {
+		frame := make([]byte, 4)
+		for _, data := range [][]byte{[]byte("abc"), {}, big} {
+			binary.BigEndian.PutUint32(frame, uint32(len(data)))
+			client.Write(append(frame, data...))
+		}
+		// header of a 64M frame, but only a few bytes follow
+		binary.BigEndian.PutUint32(frame, 64*1024*1024)
+		client.Write(append(frame, "abc"...))
+		client.Close()
+	}()
+
+	for _, want := range [][]byte{[]byte("abc"), {}, big} {
+		got, err := c.ReadFrame()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(got, want) {
+			t.Fatalf("got frame of %d bytes, want %d", len(got), len(want))
+		}
+	}
+	if _, err := c.ReadFrame(); err != io.ErrUnexpectedEOF {
+		t.Fatalf("truncated frame: got %v, want %v", err, io.ErrUnexpectedEOF)
+	}
+
+	// frame over MaxFrameSize is refused before reading it
+	client, server = net.Pipe()
+	defer server.Close()
+	c, _ = NewConn(server, byte(4), binary.BigEndian)
+	c.MaxFrameSize = 16
+	go func() {
+		client.Write([]byte{0, 0, 0, 17})
+		client.Close()
+	}()
+	if _, err := c.ReadFrame(); err != ErrFrameTooLarge {
+		t.Fatalf("got %v, want %v", err, ErrFrameTooLarge)
+	}
+}
@@ -0,0 +1,127 @@
+package receivers
+
+import (
+	"bufio"
+	"errors"
+	"net"
+	"sync"
+	"time"
+)
+
+const defaultIdleTimeout = 120 // seconds
+
+var errLineTooLong = errors.New("line too long")
+
+// reasons a connection is rejected by connLimiter
+const (
+	connRejectedMaxConns      = "max-conns"
+	connRejectedMaxConnsPerIP = "max-conns-per-ip"
+)
+
+// connLimiter limit concurrent connections of a receiver, total and per
+// source ip, 0 means no limit
+type connLimiter struct {
+	MaxConns      int
+	MaxConnsPerIP int
+	IdleTimeout   time.Duration // connection without data for this long is closed
+	MaxLineLength int           // bytes, longer lines are dropped, 0 means no limit
+
+	mu    sync.Mutex
+	total int
+	perIP map[string]int
+}
+
+func newConnLimiter(conf Config) *connLimiter {
+	return &connLimiter{
+		MaxConns:      conf.MaxConns,
+		MaxConnsPerIP: conf.MaxConnsPerIP,
+		IdleTimeout:   time.Duration(conf.IdleTimeout) * time.Second,
+		MaxLineLength: conf.MaxLineLength,
+		perIP:         make(map[string]int),
+	}
+}
+
+func connIP(conn net.Conn) string {
+	return addrIP(conn.RemoteAddr().String())
+}
+
+// addrIP strip port from a "host:port" address
+func addrIP(addr string) string {
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		return addr
+	}
+	return host
+}
+
+// acquire count conn in, return reason if conn is over limit, a conn
+// acquired successfully must be released
+func (l *connLimiter) acquire(conn net.Conn) string {
+	ip := connIP(conn)
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.MaxConns > 0 && l.total >= l.MaxConns {
+		return connRejectedMaxConns
+	}
+	if l.MaxConnsPerIP > 0 && l.perIP[ip] >= l.MaxConnsPerIP {
+		return connRejectedMaxConnsPerIP
+	}
+	l.total++
+	l.perIP[ip]++
+	return ""
+}
+
+func (l *connLimiter) release(conn net.Conn) {
+	ip := connIP(conn)
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.total--
+	if l.perIP[ip] <= 1 {
+		delete(l.perIP, ip)
+	} else {
+		l.perIP[ip]--
+	}
+}
+
+// setDeadline push read deadline of conn to IdleTimeout later
+func (l *connLimiter) setDeadline(conn net.Conn) {
+	if l.IdleTimeout > 0 {
+		conn.SetReadDeadline(time.Now().Add(l.IdleTimeout))
+	}
+}
+
+// readLine read a line including the '\n', a line longer than MaxLineLength
+// not counting the '\n' is skipped and errLineTooLong returned, the reader
+// is still usable then
+func (l *connLimiter) readLine(r *bufio.Reader) ([]byte, error) {
+	if l.MaxLineLength <= 0 {
+		return r.ReadBytes('\n')
+	}
+	var line []byte
+	for {
+		frag, err := r.ReadSlice('\n')
+		n := len(line) + len(frag)
+		if err == nil {
+			n-- // frag ends with '\n'
+		}
+		if n > l.MaxLineLength {
+			for err == bufio.ErrBufferFull {
+				_, err = r.ReadSlice('\n')
+			}
+			if err != nil {
+				return nil, err
+			}
+			return nil, errLineTooLong
+		}
+		line = append(line, frag...)
+		if err != bufio.ErrBufferFull {
+			return line, err
+		}
+	}
+}
+
+// isTimeout report whether err is caused by read deadline
+func isTimeout(err error) bool {
+	ne, ok := err.(net.Error)
+	return ok && ne.Timeout()
+}
@@ -0,0 +1,48 @@
+package receivers
+
+import (
+	"bufio"
+	"io"
+	"strings"
+	"testing"
+)
+
+func TestReadLine(t *testing.T) {
+	tests := []struct {
+		max   int
+		input string
+		want  []string // "" for errLineTooLong
+	}{
+		{0, "a.b 1 1\nc\n", []string{"a.b 1 1\n", "c\n"}},
+		{5, "abcde\nabcdef\nab\n", []string{"abcde\n", "", "ab\n"}},
+		{5, "abcde", []string{"abcde"}},
+		{5, "abcdef", nil},
+		// longer than the 16 bytes buffer of reader
+		{20, "01234567890123456789\n012345678901234567890\nx\n",
+			[]string{"01234567890123456789\n", "", "x\n"}},
+	}
+	for _, tt := range tests {
+		l := newConnLimiter(Config{MaxLineLength: tt.max})
+		r := bufio.NewReaderSize(strings.NewReader(tt.input), 16)
+		var got []string
+		for {
+			line, err := l.readLine(r)
+			if err == errLineTooLong {
+				got = append(got, "")
+				continue
+			}
+			if len(line) > 0 {
+				got = append(got, string(line))
+			}
+			if err == io.EOF {
+				break
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+		}
+		if strings.Join(got, "|") != strings.Join(tt.want, "|") || len(got) != len(tt.want) {
+			t.Errorf("max %d %q: got %q, want %q", tt.max, tt.input, got, tt.want)
+		}
+	}
+}
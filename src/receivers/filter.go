@@ -0,0 +1,173 @@
+package receivers
+
+/*
+Metric filter like carbon's whitelist.conf and blacklist.conf, one regexp
+a line. If whitelist.conf has any pattern, only metrics match one of them
+are accepted. Metrics match any pattern in blacklist.conf are rejected.
+Files are reloaded when changed.
+*/
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/coder-van/v-graphite/src/common"
+	statsd "github.com/coder-van/v-stats"
+	"github.com/coder-van/v-util/log"
+)
+
+type filterRule struct {
+	line    int
+	pattern *regexp.Regexp
+}
+
+// filterList is patterns of one file, nil rules means the file not exists,
+// a file without patterns is not used either
+type filterList struct {
+	path    string
+	rules   []*filterRule
+	modTime time.Time
+}
+
+func readFilterRules(filePath string) ([]*filterRule, error) {
+	file, err := os.Open(filePath)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	rules := make([]*filterRule, 0)
+	scanner := bufio.NewScanner(file)
+	n := 0
+	for scanner.Scan() {
+		n++
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		p, err := regexp.Compile(line)
+		if err != nil {
+			return nil, fmt.Errorf("bad pattern %q at %s:%d, %s", line, filePath, n, err)
+		}
+		rules = append(rules, &filterRule{line: n, pattern: p})
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	return rules, nil
+}
+
+// load reload file if changed, return true if anything changed
+func (fl *filterList) load() (bool, error) {
+	info, err := os.Stat(fl.path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			changed := fl.rules != nil
+			fl.rules = nil
+			fl.modTime = time.Time{}
+			return changed, nil
+		}
+		return false, err
+	}
+	if fl.rules != nil && info.ModTime().Equal(fl.modTime) {
+		return false, nil
+	}
+	rules, err := readFilterRules(fl.path)
+	if err != nil {
+		return false, err
+	}
+	fl.rules = rules
+	fl.modTime = info.ModTime()
+	return true, nil
+}
+
+// match return the rule matches metric, nil if none
+func (fl *filterList) match(metric string) *filterRule {
+	for _, r := range fl.rules {
+		if r.pattern.MatchString(metric) {
+			return r
+		}
+	}
+	return nil
+}
+
+// MetricFilter check metrics against whitelist and blacklist, safe for concurrent use
+type MetricFilter struct {
+	mu        sync.RWMutex
+	whitelist *filterList
+	blacklist *filterList
+
+	logger *log.Vlogger
+	stat   *statsd.BaseStat
+}
+
+func NewMetricFilter(whitelistPath, blacklistPath string) *MetricFilter {
+	return &MetricFilter{
+		whitelist: &filterList{path: whitelistPath},
+		blacklist: &filterList{path: blacklistPath},
+		logger:    log.GetLogger("filter", log.RotateModeMonth),
+		stat:      common.GetStat("filter"),
+	}
+}
+
+// Load read both files if changed, a bad file keeps its old patterns
+func (mf *MetricFilter) Load() error {
+	mf.mu.Lock()
+	defer mf.mu.Unlock()
+
+	var lastErr error
+	for _, fl := range []*filterList{mf.whitelist, mf.blacklist} {
+		changed, err := fl.load()
+		if err != nil {
+			mf.stat.OnErr("error-filter-load", err)
+			mf.logger.Printf("load %s fail, keep old patterns, %s \n", fl.path, err)
+			lastErr = err
+			continue
+		}
+		if changed {
+			if fl.rules == nil {
+				mf.logger.Printf("%s removed, not used any more \n", fl.path)
+			} else if len(fl.rules) == 0 {
+				mf.logger.Printf("no patterns in %s, not used \n", fl.path)
+			} else {
+				mf.logger.Printf("load %d patterns from %s \n", len(fl.rules), fl.path)
+			}
+		}
+	}
+	return lastErr
+}
+
+// Watch reload files on change until exit closed
+func (mf *MetricFilter) Watch(interval time.Duration, exit chan bool) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			mf.Load()
+		case <-exit:
+			return
+		}
+	}
+}
+
+// Accept report whether metric passes whitelist and blacklist
+func (mf *MetricFilter) Accept(metric string) bool {
+	mf.mu.RLock()
+	defer mf.mu.RUnlock()
+
+	if len(mf.whitelist.rules) > 0 && mf.whitelist.match(metric) == nil {
+		mf.stat.CounterInc("rejected-by-whitelist", 1)
+		return false
+	}
+	if r := mf.blacklist.match(metric); r != nil {
+		mf.stat.CounterInc(fmt.Sprintf("rejected-by-blacklist-line-%d", r.line), 1)
+		return false
+	}
+	return true
+}
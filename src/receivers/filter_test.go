@@ -0,0 +1,71 @@
+package receivers
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestMetricFilter(t *testing.T) {
+	dir, err := ioutil.TempDir("", "filter")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	white := filepath.Join(dir, "whitelist.conf")
+	black := filepath.Join(dir, "blacklist.conf")
+
+	mf := NewMetricFilter(white, black)
+	if err := mf.Load(); err != nil {
+		t.Fatal(err)
+	}
+	if !mf.Accept("any.metric") {
+		t.Error("no files should accept all")
+	}
+
+	// whitelist of comments and blank lines only is like no file
+	writeRules(t, white, "# nothing yet\n\n", 0)
+	if err := mf.Load(); err != nil {
+		t.Fatal(err)
+	}
+	if !mf.Accept("any.metric") {
+		t.Error("empty whitelist should accept all")
+	}
+
+	writeRules(t, white, "# servers only\n^servers\\.\n\n^apps\\.\n", 1)
+	writeRules(t, black, "\\.debug\\.\n", 1)
+	if err := mf.Load(); err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		metric string
+		want   bool
+	}{
+		{"servers.a.cpu", true},
+		{"apps.b.latency", true},
+		{"other.a.cpu", false},
+		{"servers.a.debug.x", false},
+	}
+	for _, tt := range tests {
+		if got := mf.Accept(tt.metric); got != tt.want {
+			t.Errorf("%s: got %v, want %v", tt.metric, got, tt.want)
+		}
+	}
+
+	// bad pattern keeps old ones
+	writeRules(t, black, "(\n", 2)
+	if err := mf.Load(); err == nil {
+		t.Error("expected error for bad pattern")
+	}
+	if mf.Accept("servers.a.debug.x") {
+		t.Error("old blacklist should be kept")
+	}
+
+	// removed whitelist is not used any more
+	os.Remove(white)
+	mf.Load()
+	if !mf.Accept("other.a.cpu") {
+		t.Error("removed whitelist still used")
+	}
+}
@@ -0,0 +1,469 @@
+package receivers
+
+/*
+InfluxDB line protocol receiver, on tcp (influx:8094) or http POST /write
+(influx-http:8086), e.g.
+
+    cpu,host=a,cpu=cpu0 usage_idle=98.5,usage_user=1i 1500000000000000000
+
+Every field makes one point named by Template, {measurement} and {field} are
+replaced by measurement and field name, {tag} by value of the tag. Tags not
+used by template are appended sorted by tag name as ".tag.value". Integer,
+float and bool (1 or 0) fields are kept, string fields are dropped.
+*/
+
+import (
+	"bufio"
+	"compress/gzip"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/coder-van/v-graphite/src/common"
+	statsd "github.com/coder-van/v-stats"
+	"github.com/coder-van/v-util/log"
+)
+
+const (
+	defaultInfluxTemplate  = "{measurement}.{field}"
+	defaultInfluxPrecision = "ns"
+	influxMaxBodySize      = 32 * 1024 * 1024
+)
+
+var (
+	errInfluxStringField  = errors.New("string field")
+	errInfluxBodyTooLarge = fmt.Errorf("body larger than %d bytes", influxMaxBodySize)
+)
+
+// influxBodyReader fail with errInfluxBodyTooLarge once more than n bytes are
+// read, io.LimitReader would cut the body silently
+type influxBodyReader struct {
+	r io.Reader
+	n int64
+}
+
+func (l *influxBodyReader) Read(p []byte) (int, error) {
+	n, err := l.r.Read(p)
+	l.n -= int64(n)
+	if l.n < 0 {
+		return n, errInfluxBodyTooLarge
+	}
+	return n, err
+}
+
+type influxField struct {
+	Name  string
+	Value float64
+	Err   error // errInfluxStringField or parse error of the value
+}
+
+type influxLine struct {
+	Measurement string
+	Tags        map[string]string
+	Fields      []influxField
+	Timestamp   int64 // seconds, 0 if not given
+}
+
+// influxPrecisionUnit return duration of one timestamp unit of precision
+func influxPrecisionUnit(precision string) (time.Duration, error) {
+	switch precision {
+	case "", "n", "ns":
+		return time.Nanosecond, nil
+	case "u", "us", "µ":
+		return time.Microsecond, nil
+	case "ms":
+		return time.Millisecond, nil
+	case "s":
+		return time.Second, nil
+	case "m":
+		return time.Minute, nil
+	case "h":
+		return time.Hour, nil
+	}
+	return 0, fmt.Errorf("bad precision '%s', should be ns, us, ms, s, m or h", precision)
+}
+
+// influxSeconds convert timestamp in unit to seconds
+func influxSeconds(ts int64, unit time.Duration) int64 {
+	if unit >= time.Second {
+		return ts * int64(unit/time.Second)
+	}
+	return ts / int64(time.Second/unit)
+}
+
+// influxSplit split s on sep which is not escaped by '\' (nor quoted if quotes)
+func influxSplit(s string, sep byte, quotes bool) []string {
+	parts := make([]string, 0, 4)
+	start, inQuote := 0, false
+	for i := 0; i < len(s); i++ {
+		switch {
+		case s[i] == '\\':
+			i++
+		case quotes && s[i] == '"':
+			inQuote = !inQuote
+		case !inQuote && s[i] == sep:
+			parts = append(parts, s[start:i])
+			start = i + 1
+		}
+	}
+	return append(parts, s[start:])
+}
+
+// influxUnescape remove '\' before comma, equal sign, space and '\'
+func influxUnescape(s string) string {
+	if strings.IndexByte(s, '\\') < 0 {
+		return s
+	}
+	buf := make([]byte, 0, len(s))
+	for i := 0; i < len(s); i++ {
+		if s[i] == '\\' && i+1 < len(s) && strings.IndexByte(`,= \`, s[i+1]) >= 0 {
+			i++
+		}
+		buf = append(buf, s[i])
+	}
+	return string(buf)
+}
+
+func parseInfluxValue(v string) (float64, error) {
+	if v == "" {
+		return 0, errors.New("empty field value")
+	}
+	if v[0] == '"' {
+		return 0, errInfluxStringField
+	}
+	switch v {
+	case "t", "T", "true", "True", "TRUE":
+		return 1, nil
+	case "f", "F", "false", "False", "FALSE":
+		return 0, nil
+	}
+	switch v[len(v)-1] {
+	case 'i':
+		i, err := strconv.ParseInt(v[:len(v)-1], 10, 64)
+		return float64(i), err
+	case 'u':
+		u, err := strconv.ParseUint(v[:len(v)-1], 10, 64)
+		return float64(u), err
+	}
+	return strconv.ParseFloat(v, 64)
+}
+
+// parseInfluxLine parse one line of line protocol, timestamp is in unit,
+// see influxPrecisionUnit
+func parseInfluxLine(line string, unit time.Duration) (*influxLine, error) {
+	// measurement and tags end at the first unescaped space, '"' is literal
+	// in them, only field values are quoted
+	i := 0
+	for ; i < len(line) && line[i] != ' '; i++ {
+		if line[i] == '\\' {
+			i++
+		}
+	}
+	if i > len(line) {
+		i = len(line)
+	}
+	sections := []string{line[:i]}
+	// drop empty sections made by repeated spaces
+	for _, s := range influxSplit(line[i:], ' ', true) {
+		if s != "" {
+			sections = append(sections, s)
+		}
+	}
+	if sections[0] == "" || len(sections) < 2 || len(sections) > 3 {
+		return nil, fmt.Errorf("bad line %#v", line)
+	}
+
+	keys := influxSplit(sections[0], ',', false)
+	l := &influxLine{
+		Measurement: influxUnescape(keys[0]),
+		Tags:        make(map[string]string, len(keys)-1),
+	}
+	if l.Measurement == "" {
+		return nil, fmt.Errorf("empty measurement in line %#v", line)
+	}
+	for _, kv := range keys[1:] {
+		pair := influxSplit(kv, '=', false)
+		if len(pair) != 2 || pair[0] == "" || pair[1] == "" {
+			return nil, fmt.Errorf("bad tag %#v in line %#v", kv, line)
+		}
+		l.Tags[influxUnescape(pair[0])] = influxUnescape(pair[1])
+	}
+
+	for _, kv := range influxSplit(sections[1], ',', true) {
+		pair := influxSplit(kv, '=', true)
+		if len(pair) < 2 || pair[0] == "" {
+			return nil, fmt.Errorf("bad field %#v in line %#v", kv, line)
+		}
+		// '=' inside a quoted string value is not split
+		value := kv[len(pair[0])+1:]
+		f := influxField{Name: influxUnescape(pair[0])}
+		f.Value, f.Err = parseInfluxValue(value)
+		l.Fields = append(l.Fields, f)
+	}
+
+	if len(sections) == 3 {
+		ts, err := strconv.ParseInt(sections[2], 10, 64)
+		if err != nil {
+			return nil, fmt.Errorf("bad timestamp %#v in line %#v", sections[2], line)
+		}
+		l.Timestamp = influxSeconds(ts, unit)
+	}
+	return l, nil
+}
+
+func NewInfluxServer(ch chan common.MetricPoint, name string) *InfluxServer {
+	return &InfluxServer{
+		Name:                  name,
+		Addr:                  "localhost:8094",
+		Template:              defaultInfluxTemplate,
+		Precision:             defaultInfluxPrecision,
+		limits:                newConnLimiter(Config{IdleTimeout: defaultIdleTimeout}),
+		ChanPointBagsReceived: ch,
+		stat:                  common.GetStat("influx_receiver"),
+		logger:                log.GetLogger("influx", log.RotateModeMonth),
+	}
+}
+
+// InfluxServer receive InfluxDB line protocol from tcp connections, or from
+// http POST /write if IsHTTP
+type InfluxServer struct {
+	Name string
+
+	Addr                  string
+	IsHTTP                bool
+	Template              string
+	Precision             string      // of tcp, http request may set it by ?precision=
+	TLSConfig             *tls.Config // nil if tls not enabled
+	limits                *connLimiter
+	limiter               *rateLimiter // nil if no rate limit
+	listener              net.Listener
+	ChanPointBagsReceived chan common.MetricPoint
+	Backpressure          BackpressurePolicy
+	logger                *log.Vlogger
+	stat                  *statsd.BaseStat
+}
+
+// handleLine parse line and pipe out its points, now is used for lines
+// without timestamp
+func (rcv *InfluxServer) handleLine(line, source string, unit time.Duration, now int64) error {
+	line = strings.TrimSpace(line)
+	if line == "" || line[0] == '#' {
+		return nil
+	}
+	l, err := parseInfluxLine(line, unit)
+	if err != nil {
+		rcv.stat.OnErr("error-influx-receiver-parse", err)
+		return err
+	}
+	if l.Timestamp == 0 {
+		l.Timestamp = now
+	}
+
+	values := make(map[string]string, len(l.Tags)+2)
+	for k, v := range l.Tags {
+		values[k] = v
+	}
+	values["measurement"] = l.Measurement
+	for _, f := range l.Fields {
+		if f.Err == errInfluxStringField {
+			rcv.stat.CounterInc("string-field-dropped", 1)
+			continue
+		}
+		if f.Err != nil {
+			err = fmt.Errorf("bad value of field %s, %s", f.Name, f.Err)
+			rcv.stat.OnErr("error-influx-receiver-parse", err)
+			continue
+		}
+		values["field"] = f.Name
+		name := templateSeriesName(rcv.Template, values)
+		if name == "" || !rcv.limiter.Allow(source, name) {
+			continue
+		}
+		rcv.stat.CounterInc("point-received", 1)
+		rcv.pipeOut(common.MetricPoint{Key: name, Value: f.Value, Timestamp: l.Timestamp})
+	}
+	return err
+}
+
+func (rcv *InfluxServer) handleConn(conn net.Conn) {
+	if conn == nil {
+		return
+	}
+	rcv.stat.GaugeInc("active_conn", 1)
+	defer rcv.stat.GaugeDec("active_conn", -1)
+	defer conn.Close()
+	defer rcv.limits.release(conn)
+
+	if err := tlsHandshake(conn); err != nil {
+		rcv.stat.CounterInc("tls-handshake-errors", 1)
+		rcv.stat.OnErr("error-influx-receiver-tls-handshake", err)
+		rcv.logger.Printf("tls handshake with %s fail, %s \n", conn.RemoteAddr(), err)
+		return
+	}
+
+	unit, _ := influxPrecisionUnit(rcv.Precision)
+	source := clientSource(conn)
+	reader := bufio.NewReader(conn)
+	for {
+		rcv.limits.setDeadline(conn)
+
+		b, err := rcv.limits.readLine(reader)
+		if err == errLineTooLong {
+			rcv.stat.CounterInc("line-too-long", 1)
+			continue
+		}
+		line := string(b)
+		if err != nil {
+			if err == io.EOF {
+				if len(line) > 0 {
+					rcv.logger.Printf("Warn unfinished line %s", line)
+				}
+			} else if isTimeout(err) {
+				rcv.stat.CounterInc("idle-timeout-closed", 1)
+			} else {
+				rcv.stat.OnErr("error-influx-receiver-readline", err)
+				rcv.logger.Printf("read error %s", err.Error())
+			}
+			return
+		}
+		rcv.handleLine(line, source, unit, time.Now().Unix())
+	}
+}
+
+func (rcv *InfluxServer) writeHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	rcv.stat.CounterInc("write-requests", 1)
+
+	unit, err := influxPrecisionUnit(r.URL.Query().Get("precision"))
+	if r.URL.Query().Get("precision") == "" {
+		unit, err = influxPrecisionUnit(rcv.Precision)
+	}
+	if err != nil {
+		influxError(w, http.StatusBadRequest, err)
+		return
+	}
+
+	var reader io.Reader = http.MaxBytesReader(w, r.Body, influxMaxBodySize)
+	if strings.Contains(r.Header.Get("Content-Encoding"), "gzip") {
+		gz, err := gzip.NewReader(reader)
+		if err != nil {
+			rcv.stat.OnErr("error-influx-receiver-gzip", err)
+			influxError(w, http.StatusBadRequest, err)
+			return
+		}
+		defer gz.Close()
+		reader = &influxBodyReader{r: gz, n: influxMaxBodySize}
+	}
+
+	now := time.Now().Unix()
+	source := requestSource(r)
+	var firstErr error
+	scanner := bufio.NewScanner(reader)
+	scanner.Buffer(make([]byte, 64*1024), influxMaxBodySize)
+	for scanner.Scan() {
+		if err := rcv.handleLine(scanner.Text(), source, unit, now); err != nil && firstErr == nil {
+			firstErr = err
+		}
+	}
+	var tooLarge *http.MaxBytesError
+	if err := scanner.Err(); err == errInfluxBodyTooLarge || errors.As(err, &tooLarge) {
+		// lines before the limit are written already
+		rcv.stat.OnErr("error-influx-receiver-too-large", errInfluxBodyTooLarge)
+		influxError(w, http.StatusRequestEntityTooLarge, errInfluxBodyTooLarge)
+		return
+	} else if err != nil {
+		rcv.stat.OnErr("error-influx-receiver-read", err)
+		influxError(w, http.StatusBadRequest, err)
+		return
+	}
+	if firstErr != nil {
+		// good lines are written already, same as influxdb partial write
+		influxError(w, http.StatusBadRequest, fmt.Errorf("partial write: %s", firstErr))
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func influxError(w http.ResponseWriter, code int, err error) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	fmt.Fprintf(w, "{\"error\":%s}\n", strconv.Quote(err.Error()))
+}
+
+func (rcv *InfluxServer) pipeOut(mp common.MetricPoint) {
+	pushPoint(rcv.ChanPointBagsReceived, rcv.Backpressure, rcv.stat, rcv.Name, mp)
+}
+
+func (rcv *InfluxServer) Start() {
+	fmt.Println("* Influx receiver starting")
+	go rcv.Listen()
+}
+
+// Listen 是阻塞的 需要调用时加 go
+func (rcv *InfluxServer) Listen() error {
+	var err error
+	rcv.listener, err = net.Listen("tcp", rcv.Addr)
+	if err != nil {
+		rcv.logger.Printf("influx listen %s failed, %s \n", rcv.Addr, err)
+		return err
+	}
+	if rcv.TLSConfig != nil {
+		rcv.listener = tls.NewListener(rcv.listener, rcv.TLSConfig)
+	}
+	listener := rcv.listener
+
+	fmt.Println("* Influx receiver started")
+	if rcv.IsHTTP {
+		mux := http.NewServeMux()
+		mux.HandleFunc("/write", rcv.writeHandler)
+		// telegraf checks /ping and creates database by /query on start
+		mux.HandleFunc("/ping", func(w http.ResponseWriter, r *http.Request) {
+			w.WriteHeader(http.StatusNoContent)
+		})
+		mux.HandleFunc("/query", func(w http.ResponseWriter, r *http.Request) {
+			w.Header().Set("Content-Type", "application/json")
+			fmt.Fprint(w, "{\"results\":[{\"statement_id\":0}]}\n")
+		})
+		err = http.Serve(listener, mux)
+		if err != nil && !strings.Contains(err.Error(), "use of closed network connection") {
+			rcv.logger.Printf("influx serve error %s \n", err)
+			return err
+		}
+		return nil
+	}
+
+	for {
+		conn, err := listener.Accept()
+		if err != nil {
+			if strings.Contains(err.Error(), "use of closed network connection") {
+				break
+			}
+			continue
+		}
+		if reason := rcv.limits.acquire(conn); reason != "" {
+			rcv.stat.CounterInc("conn-rejected-"+reason, 1)
+			rcv.logger.Debug(fmt.Sprintf("influx conn from %s rejected, %s \n", conn.RemoteAddr(), reason))
+			conn.Close()
+			continue
+		}
+		go rcv.handleConn(conn)
+	}
+	return nil
+}
+
+func (rcv *InfluxServer) Stop() {
+	fmt.Println("* Influx receiver closing")
+	if rcv.listener != nil {
+		rcv.listener.Close()
+	}
+	fmt.Println("* Influx receiver closed")
+}
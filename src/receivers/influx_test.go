@@ -0,0 +1,121 @@
+package receivers
+
+import (
+	"bytes"
+	"compress/gzip"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/coder-van/v-graphite/src/common"
+)
+
+func TestParseInfluxLine(t *testing.T) {
+	tests := []struct {
+		line      string
+		precision string
+		want      *influxLine
+	}{
+		{
+			"cpu,host=a,cpu=cpu0 usage_idle=98.5,usage_user=1i 1500000000000000000", "ns",
+			&influxLine{"cpu", map[string]string{"host": "a", "cpu": "cpu0"},
+				[]influxField{{"usage_idle", 98.5, nil}, {"usage_user", 1, nil}}, 1500000000},
+		},
+		{
+			"mem used=1u,ok=true", "ns",
+			&influxLine{"mem", map[string]string{}, []influxField{{"used", 1, nil}, {"ok", 1, nil}}, 0},
+		},
+		{
+			// quotes are literal in tags, a quoted field value may hold spaces and commas
+			`disk,path="/a\ b",say=it"s msg="x, y=z",free=2 1500000000`, "s",
+			&influxLine{"disk", map[string]string{"path": `"/a b"`, "say": `it"s`},
+				[]influxField{{"msg", 0, errInfluxStringField}, {"free", 2, nil}}, 1500000000},
+		},
+		{
+			`my\ cpu,host\=x=a\,b  idle=1  25000000`, "m",
+			&influxLine{"my cpu", map[string]string{"host=x": "a,b"}, []influxField{{"idle", 1, nil}}, 1500000000},
+		},
+		{
+			"load v=1 416666", "h",
+			&influxLine{"load", map[string]string{}, []influxField{{"v", 1, nil}}, 1499997600},
+		},
+		{
+			"load v=1 1500000000123", "ms",
+			&influxLine{"load", map[string]string{}, []influxField{{"v", 1, nil}}, 1500000000},
+		},
+	}
+	for _, tt := range tests {
+		unit, err := influxPrecisionUnit(tt.precision)
+		if err != nil {
+			t.Fatal(err)
+		}
+		got, err := parseInfluxLine(tt.line, unit)
+		if err != nil {
+			t.Errorf("%q: %s", tt.line, err)
+			continue
+		}
+		if !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("%q: got %+v, want %+v", tt.line, got, tt.want)
+		}
+	}
+
+	bad := []string{
+		"cpu",
+		" v=1",
+		"cpu v=1 x",
+		"cpu v=1 1 2",
+		"cpu,host v=1",
+		"cpu,host= v=1",
+		"cpu =1",
+		`cpu,a="x y" v=1`,
+	}
+	for _, line := range bad {
+		if _, err := parseInfluxLine(line, time.Nanosecond); err == nil {
+			t.Errorf("expected error for %q", line)
+		}
+	}
+}
+
+func TestInfluxWrite(t *testing.T) {
+	gzipped := func(data []byte) []byte {
+		var buf bytes.Buffer
+		gz := gzip.NewWriter(&buf)
+		gz.Write(data)
+		gz.Close()
+		return buf.Bytes()
+	}
+	lines := []byte("cpu,host=a value=1 1500000000000000000\n")
+	// comment lines are skipped, so only the size matters
+	comment := append(bytes.Repeat([]byte("#"), 1023), '\n')
+	tooLarge := append(lines, bytes.Repeat(comment, influxMaxBodySize/len(comment)+1)...)
+	tests := []struct {
+		name   string
+		body   []byte
+		gzip   bool
+		code   int
+		points int
+	}{
+		{"plain", lines, false, http.StatusNoContent, 1},
+		{"gzip", gzipped(lines), true, http.StatusNoContent, 1},
+		{"bad gzip", lines, true, http.StatusBadRequest, 0},
+		{"bad line", []byte("cpu value=x\n"), false, http.StatusBadRequest, 0},
+		{"too large", tooLarge, false, http.StatusRequestEntityTooLarge, 1},
+		{"gzip too large", gzipped(tooLarge), true, http.StatusRequestEntityTooLarge, 1},
+	}
+	for _, tt := range tests {
+		ch := make(chan common.MetricPoint, 10)
+		rcv := NewInfluxServer(ch, "test")
+		req := httptest.NewRequest("POST", "/write", bytes.NewReader(tt.body))
+		if tt.gzip {
+			req.Header.Set("Content-Encoding", "gzip")
+		}
+		w := httptest.NewRecorder()
+		rcv.writeHandler(w, req)
+		if w.Code != tt.code || len(ch) != tt.points {
+			t.Errorf("%s: status %d points %d, want %d %d, %s", tt.name, w.Code, len(ch),
+				tt.code, tt.points, w.Body)
+		}
+	}
+}
@@ -0,0 +1,268 @@
+package receivers
+
+/*
+OpenTSDB telnet style receiver, one command per line:
+
+    put <metric> <timestamp> <value> <tagk1=tagv1 ...>
+    version
+    exit
+
+Timestamp is in seconds or milliseconds. Tags are turned into graphite tags
+(sys.cpu.user;cpu=0;host=web01) by default. With tag mode "path" the values
+of tags in TagOrder are appended to metric as path segments, and tags not in
+TagOrder follow sorted by tag name as ".name.value", so different series
+never collide.
+*/
+
+import (
+	"bufio"
+	"crypto/tls"
+	"fmt"
+	"io"
+	"net"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/coder-van/v-graphite/src/common"
+	statsd "github.com/coder-van/v-stats"
+	"github.com/coder-van/v-util/log"
+)
+
+const (
+	OpenTSDBTagModeTags = "tags"
+	OpenTSDBTagModePath = "path"
+
+	opentsdbVersionReply = "v-graphite opentsdb receiver\n"
+)
+
+func NewOpenTSDBServer(ch chan common.MetricPoint, name string) *OpenTSDBServer {
+	s := &OpenTSDBServer{
+		Name:                  name,
+		TagMode:               OpenTSDBTagModeTags,
+		limits:                newConnLimiter(Config{IdleTimeout: defaultIdleTimeout}),
+		ChanPointBagsReceived: ch,
+		stat:                  common.GetStat("opentsdb_receiver"),
+		logger:                log.GetLogger("opentsdb", log.RotateModeMonth),
+	}
+	addr, err := net.ResolveTCPAddr("tcp", "localhost:4242")
+	if err != nil {
+		fmt.Println(err)
+	}
+	s.Addr = addr
+	return s
+}
+
+// OpenTSDBServer receive OpenTSDB put commands from TCP connections
+type OpenTSDBServer struct {
+	Name string
+
+	Addr                  *net.TCPAddr
+	TagMode               string      // tags or path
+	TagOrder              []string    // path mode only
+	TLSConfig             *tls.Config // nil if tls not enabled
+	limits                *connLimiter
+	limiter               *rateLimiter // nil if no rate limit
+	listener              net.Listener
+	ChanPointBagsReceived chan common.MetricPoint
+	Backpressure          BackpressurePolicy
+	logger                *log.Vlogger
+	stat                  *statsd.BaseStat
+}
+
+func (rcv *OpenTSDBServer) handleConn(conn net.Conn) {
+	if conn == nil {
+		return
+	}
+	rcv.stat.GaugeInc("active_conn", 1)
+	defer rcv.stat.GaugeDec("active_conn", -1)
+	defer conn.Close()
+	defer rcv.limits.release(conn)
+
+	if err := tlsHandshake(conn); err != nil {
+		rcv.stat.CounterInc("tls-handshake-errors", 1)
+		rcv.stat.OnErr("error-opentsdb-receiver-tls-handshake", err)
+		rcv.logger.Printf("tls handshake with %s fail, %s \n", conn.RemoteAddr(), err)
+		return
+	}
+
+	source := clientSource(conn)
+	reader := bufio.NewReader(conn)
+	for {
+		rcv.limits.setDeadline(conn)
+
+		b, err := rcv.limits.readLine(reader)
+		if err == errLineTooLong {
+			rcv.stat.CounterInc("line-too-long", 1)
+			continue
+		}
+		line := string(b)
+		if err != nil {
+			if err == io.EOF {
+				if len(line) > 0 {
+					rcv.logger.Printf("Warn unfinished line %s", line)
+				}
+			} else if isTimeout(err) {
+				rcv.stat.CounterInc("idle-timeout-closed", 1)
+			} else {
+				rcv.stat.OnErr("error-opentsdb-receiver-readline", err)
+				rcv.logger.Printf("read error %s", err.Error())
+			}
+			return
+		}
+
+		fields := strings.Fields(line)
+		if len(fields) == 0 {
+			continue
+		}
+		switch fields[0] {
+		case "put":
+			mp, err := rcv.parsePut(fields[1:])
+			if err != nil {
+				rcv.stat.OnErr("error-opentsdb-receiver-parse", err)
+				rcv.reply(conn, "put: illegal argument: "+err.Error()+"\n")
+				continue
+			}
+			if !rcv.limiter.Allow(source, mp.Key) {
+				continue
+			}
+			rcv.stat.CounterInc("point-received", 1)
+			rcv.pipeOut(*mp)
+		case "version":
+			rcv.reply(conn, opentsdbVersionReply)
+		case "exit":
+			return
+		default:
+			rcv.stat.OnErr("error-opentsdb-receiver-parse", fmt.Errorf("unknown command %#v", fields[0]))
+			rcv.reply(conn, "unknown command: "+fields[0]+"\n")
+		}
+	}
+}
+
+func (rcv *OpenTSDBServer) reply(conn net.Conn, msg string) {
+	conn.SetWriteDeadline(time.Now().Add(10 * time.Second))
+	if _, err := io.WriteString(conn, msg); err != nil {
+		rcv.stat.OnErr("error-opentsdb-receiver-write", err)
+	}
+}
+
+// parsePut parse args of put command: metric timestamp value tags...
+func (rcv *OpenTSDBServer) parsePut(args []string) (*common.MetricPoint, error) {
+	if len(args) < 3 {
+		return nil, fmt.Errorf("not enough arguments (need at least 3, got %d)", len(args))
+	}
+	metric := args[0]
+
+	ts, err := strconv.ParseInt(args[1], 10, 64)
+	if err != nil || ts <= 0 {
+		return nil, fmt.Errorf("invalid timestamp %#v", args[1])
+	}
+	if ts >= 1e12 { // milliseconds
+		ts /= 1000
+	}
+
+	value, err := strconv.ParseFloat(args[2], 64)
+	if err != nil {
+		return nil, fmt.Errorf("invalid value %#v", args[2])
+	}
+
+	tags := make(map[string]string, len(args)-3)
+	for _, arg := range args[3:] {
+		kv := strings.SplitN(arg, "=", 2)
+		if len(kv) != 2 || kv[0] == "" || kv[1] == "" {
+			return nil, fmt.Errorf("invalid tag %#v", arg)
+		}
+		tags[kv[0]] = kv[1]
+	}
+
+	key, err := rcv.seriesName(metric, tags)
+	if err != nil {
+		return nil, err
+	}
+	return &common.MetricPoint{Key: key, Value: value, Timestamp: ts}, nil
+}
+
+func (rcv *OpenTSDBServer) seriesName(metric string, tags map[string]string) (string, error) {
+	names := make([]string, 0, len(tags))
+	for k := range tags {
+		names = append(names, k)
+	}
+	sort.Strings(names)
+
+	if rcv.TagMode != OpenTSDBTagModePath {
+		parts := make([]string, 0, len(tags)+1)
+		parts = append(parts, metric)
+		for _, k := range names {
+			parts = append(parts, k+"="+tags[k])
+		}
+		return common.NormalizeTagged(strings.Join(parts, ";"))
+	}
+
+	segments := []string{metric}
+	used := make(map[string]bool, len(rcv.TagOrder))
+	for _, k := range rcv.TagOrder {
+		used[k] = true
+		if v, ok := tags[k]; ok {
+			segments = append(segments, sanitizePromValue(v))
+		}
+	}
+	for _, k := range names {
+		if !used[k] {
+			segments = append(segments, sanitizePromValue(k), sanitizePromValue(tags[k]))
+		}
+	}
+	return strings.Join(segments, "."), nil
+}
+
+func (rcv *OpenTSDBServer) pipeOut(mp common.MetricPoint) {
+	pushPoint(rcv.ChanPointBagsReceived, rcv.Backpressure, rcv.stat, rcv.Name, mp)
+}
+
+func (rcv *OpenTSDBServer) Start() {
+	fmt.Println("* OpenTSDB receiver starting")
+	go rcv.Listen()
+}
+
+// Listen 是阻塞的 需要调用时加 go
+func (rcv *OpenTSDBServer) Listen() error {
+	ln, err := net.ListenTCP("tcp", rcv.Addr)
+	if err != nil {
+		rcv.logger.Printf("opentsdb listen %s failed, %s \n", rcv.Addr, err)
+		return err
+	}
+	var listener net.Listener = ln
+	if rcv.TLSConfig != nil {
+		listener = tls.NewListener(ln, rcv.TLSConfig)
+	}
+	rcv.listener = listener
+	defer ln.Close()
+
+	fmt.Println("* OpenTSDB receiver started")
+	for {
+		conn, err := listener.Accept()
+		if err != nil {
+			if strings.Contains(err.Error(), "use of closed network connection") {
+				break
+			}
+			continue
+		}
+		if reason := rcv.limits.acquire(conn); reason != "" {
+			rcv.stat.CounterInc("conn-rejected-"+reason, 1)
+			rcv.logger.Debug(fmt.Sprintf("opentsdb conn from %s rejected, %s \n", conn.RemoteAddr(), reason))
+			conn.Close()
+			continue
+		}
+		go rcv.handleConn(conn)
+	}
+	return nil
+}
+
+func (rcv *OpenTSDBServer) Stop() {
+	fmt.Println("* OpenTSDB receiver closing")
+	if rcv.listener != nil {
+		rcv.listener.Close()
+		rcv.listener = nil
+	}
+	fmt.Println("* OpenTSDB receiver closed")
+}
@@ -0,0 +1,50 @@
+package receivers
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestParsePut(t *testing.T) {
+	tests := []struct {
+		mode  string
+		order []string
+		line  string
+		key   string // "" for error
+		value float64
+		ts    int64
+	}{
+		{OpenTSDBTagModeTags, nil, "sys.cpu.user 1500000000 42.5 host=web01 cpu=0",
+			"sys.cpu.user;cpu=0;host=web01", 42.5, 1500000000},
+		{OpenTSDBTagModeTags, nil, "sys.load 1500000000123 1", "sys.load", 1, 1500000000},
+		{OpenTSDBTagModePath, []string{"host"}, "sys.cpu.user 1500000000 1 host=web01 cpu=0",
+			"sys.cpu.user.web01.cpu.0", 1, 1500000000},
+		// order tag missing, illegal chars replaced
+		{OpenTSDBTagModePath, []string{"dc", "host"}, "sys.cpu.user 1500000000 1 host=web.01",
+			"sys.cpu.user.web_01", 1, 1500000000},
+		{OpenTSDBTagModeTags, nil, "sys.load 1500000000", "", 0, 0},
+		{OpenTSDBTagModeTags, nil, "sys.load x 1", "", 0, 0},
+		{OpenTSDBTagModeTags, nil, "sys.load -1 1", "", 0, 0},
+		{OpenTSDBTagModeTags, nil, "sys.load 1500000000 x", "", 0, 0},
+		{OpenTSDBTagModeTags, nil, "sys.load 1500000000 1 host", "", 0, 0},
+		{OpenTSDBTagModeTags, nil, "sys.load 1500000000 1 host=", "", 0, 0},
+	}
+	for _, tt := range tests {
+		rcv := NewOpenTSDBServer(nil, "test")
+		rcv.TagMode, rcv.TagOrder = tt.mode, tt.order
+		mp, err := rcv.parsePut(strings.Fields(tt.line))
+		if tt.key == "" {
+			if err == nil {
+				t.Errorf("%q: expected error", tt.line)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%q: %s", tt.line, err)
+			continue
+		}
+		if mp.Key != tt.key || mp.Value != tt.value || mp.Timestamp != tt.ts {
+			t.Errorf("%q: got %v, want %s %v %d", tt.line, mp, tt.key, tt.value, tt.ts)
+		}
+	}
+}
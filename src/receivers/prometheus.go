@@ -0,0 +1,204 @@
+package receivers
+
+import (
+	"crypto/tls"
+	"fmt"
+	"io/ioutil"
+	"math"
+	"net"
+	"net/http"
+	"regexp"
+	"sort"
+	"strings"
+
+	"github.com/coder-van/v-graphite/src/common"
+	"github.com/golang/protobuf/proto"
+	statsd "github.com/coder-van/v-stats"
+	"github.com/coder-van/v-util/log"
+)
+
+const (
+	defaultPromTemplate   = "prom.{__name__}"
+	promMaxCompressedSize = 16 * 1024 * 1024
+	promMaxDecodedSize    = 64 * 1024 * 1024
+	// math.Float64bits of the NaN prometheus uses to mark a series stale
+	promStaleNaN uint64 = 0x7ff0000000000002
+)
+
+var (
+	promTemplateRegexp = regexp.MustCompile(`\{([^{}]+)\}`)
+	promIllegalRegexp  = regexp.MustCompile(`[^a-zA-Z0-9_\-]`)
+)
+
+func NewPrometheusServer(ch chan common.MetricPoint, name string) *PrometheusServer {
+	return &PrometheusServer{
+		Name:                  name,
+		Addr:                  "localhost:9201",
+		Template:              defaultPromTemplate,
+		ChanPointBagsReceived: ch,
+		stat:                  common.GetStat("prometheus_receiver"),
+		logger:                log.GetLogger("prometheus", log.RotateModeMonth),
+	}
+}
+
+// PrometheusServer receive prometheus remote_write requests, POST /write
+// with snappy compressed protobuf WriteRequest body.
+//
+// Series name is built from Template, {label} is replaced by value of label,
+// "__name__" is the metric name. Labels not used by template are appended
+// sorted by label name as ".name.value", so different series never collide.
+// Illegal chars (anything but letters, digits, '_' and '-') in label values
+// are replaced with '_', and a segment left empty after replacing is removed.
+// NaN samples, including prometheus stale markers, are dropped.
+type PrometheusServer struct {
+	Name string
+
+	Addr                  string
+	Template              string
+	TLSConfig             *tls.Config  // nil if tls not enabled
+	limiter               *rateLimiter // nil if no rate limit
+	listener              net.Listener
+	ChanPointBagsReceived chan common.MetricPoint
+	Backpressure          BackpressurePolicy
+	logger                *log.Vlogger
+	stat                  *statsd.BaseStat
+}
+
+func sanitizePromValue(v string) string {
+	return promIllegalRegexp.ReplaceAllString(v, "_")
+}
+
+// promSeriesName map labels to a graphite path by template
+func promSeriesName(template string, labels []*promLabel) string {
+	values := make(map[string]string, len(labels))
+	for _, l := range labels {
+		values[l.Name] = l.Value
+	}
+	return templateSeriesName(template, values)
+}
+
+// templateSeriesName replace {name} in template with sanitized values[name],
+// values not used by template are appended sorted by name as ".name.value"
+func templateSeriesName(template string, values map[string]string) string {
+	used := make(map[string]bool)
+
+	segments := make([]string, 0)
+	for _, seg := range strings.Split(template, ".") {
+		seg = promTemplateRegexp.ReplaceAllStringFunc(seg, func(m string) string {
+			name := m[1 : len(m)-1]
+			used[name] = true
+			return sanitizePromValue(values[name])
+		})
+		if seg != "" {
+			segments = append(segments, seg)
+		}
+	}
+
+	extra := make([]string, 0)
+	for name := range values {
+		if !used[name] && values[name] != "" {
+			extra = append(extra, name)
+		}
+	}
+	sort.Strings(extra)
+	for _, name := range extra {
+		segments = append(segments, sanitizePromValue(name), sanitizePromValue(values[name]))
+	}
+	return strings.Join(segments, ".")
+}
+
+func (rcv *PrometheusServer) writeHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	rcv.stat.CounterInc("write-requests", 1)
+
+	compressed, err := ioutil.ReadAll(http.MaxBytesReader(w, r.Body, promMaxCompressedSize))
+	if err != nil {
+		rcv.stat.OnErr("error-prometheus-receiver-read", err)
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	data, err := snappyDecode(compressed, promMaxDecodedSize)
+	if err != nil {
+		rcv.stat.OnErr("error-prometheus-receiver-snappy", err)
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	var req promWriteRequest
+	if err := proto.Unmarshal(data, &req); err != nil {
+		rcv.stat.OnErr("error-prometheus-receiver-unmarshal", err)
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	ip := addrIP(r.RemoteAddr)
+	for _, ts := range req.Timeseries {
+		name := promSeriesName(rcv.Template, ts.Labels)
+		if name == "" {
+			rcv.stat.OnErr("error-prometheus-receiver-empty-name",
+				fmt.Errorf("empty name for labels %v", ts.Labels))
+			continue
+		}
+		for _, s := range ts.Samples {
+			if math.IsNaN(s.Value) {
+				if math.Float64bits(s.Value) == promStaleNaN {
+					rcv.stat.CounterInc("stale-marker-dropped", 1)
+				} else {
+					rcv.stat.CounterInc("nan-dropped", 1)
+				}
+				continue
+			}
+			if !rcv.limiter.Allow(ip, name) {
+				continue
+			}
+			rcv.stat.CounterInc("point-received", 1)
+			rcv.pipeOut(common.MetricPoint{Key: name, Value: s.Value, Timestamp: s.Timestamp / 1000})
+		}
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (rcv *PrometheusServer) pipeOut(mp common.MetricPoint) {
+	pushPoint(rcv.ChanPointBagsReceived, rcv.Backpressure, rcv.stat, rcv.Name, mp)
+}
+
+func (rcv *PrometheusServer) Start() {
+	fmt.Println("* Prometheus receiver starting")
+	go rcv.Listen()
+}
+
+// Listen 是阻塞的 需要调用时加 go
+func (rcv *PrometheusServer) Listen() error {
+	var err error
+	rcv.listener, err = net.Listen("tcp", rcv.Addr)
+	if err != nil {
+		rcv.logger.Printf("prometheus listen %s failed, %s \n", rcv.Addr, err)
+		return err
+	}
+	if rcv.TLSConfig != nil {
+		rcv.listener = tls.NewListener(rcv.listener, rcv.TLSConfig)
+	}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/write", rcv.writeHandler)
+
+	fmt.Println("* Prometheus receiver started")
+	err = http.Serve(rcv.listener, mux)
+	if err != nil && !strings.Contains(err.Error(), "use of closed network connection") {
+		rcv.logger.Printf("prometheus serve error %s \n", err)
+		return err
+	}
+	return nil
+}
+
+func (rcv *PrometheusServer) Stop() {
+	fmt.Println("* Prometheus receiver closing")
+	if rcv.listener != nil {
+		rcv.listener.Close()
+	}
+	fmt.Println("* Prometheus receiver closed")
+}
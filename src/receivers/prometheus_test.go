@@ -0,0 +1,143 @@
+package receivers
+
+import (
+	"bytes"
+	"encoding/binary"
+	"math"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/coder-van/v-graphite/src/common"
+	"github.com/golang/protobuf/proto"
+)
+
+// snappyLiteral encode data as one snappy literal, up to 64KB
+func snappyLiteral(data []byte) []byte {
+	buf := make([]byte, binary.MaxVarintLen64)
+	out := append([]byte{}, buf[:binary.PutUvarint(buf, uint64(len(data)))]...)
+	n := len(data) - 1
+	switch {
+	case len(data) == 0:
+		return out
+	case n < 60:
+		out = append(out, byte(n<<2))
+	case n < 1<<8:
+		out = append(out, 60<<2, byte(n))
+	default:
+		out = append(out, 61<<2, byte(n), byte(n>>8))
+	}
+	return append(out, data...)
+}
+
+func TestSnappyDecode(t *testing.T) {
+	tests := []struct {
+		src  []byte
+		want string // "" for error
+	}{
+		{snappyLiteral([]byte("abc")), "abc"},
+		{snappyLiteral(bytes.Repeat([]byte("x"), 300)), string(bytes.Repeat([]byte("x"), 300))},
+		// literal abc then overlapped copy of 6 at offset 3
+		{[]byte{9, 2 << 2, 'a', 'b', 'c', 2<<2 | snappyTagCopy1, 3}, "abcabcabc"},
+		{[]byte{9, 2 << 2, 'a', 'b', 'c', 2<<2 | snappyTagCopy1, 4}, ""},
+		{[]byte{4, 2 << 2, 'a', 'b', 'c'}, ""},
+		{[]byte{3, 2 << 2, 'a', 'b'}, ""},
+		{[]byte{0xff}, ""},
+	}
+	for _, tt := range tests {
+		got, err := snappyDecode(tt.src, 1024)
+		if tt.want == "" {
+			if err == nil {
+				t.Errorf("%v: expected error", tt.src)
+			}
+			continue
+		}
+		if err != nil || string(got) != tt.want {
+			t.Errorf("%v: got %q %v, want %q", tt.src, got, err, tt.want)
+		}
+	}
+	if _, err := snappyDecode(snappyLiteral([]byte("abc")), 2); err != errSnappyTooLarge {
+		t.Errorf("got %v, want %v", err, errSnappyTooLarge)
+	}
+}
+
+func TestPromSeriesName(t *testing.T) {
+	tests := []struct {
+		template string
+		values   map[string]string
+		want     string
+	}{
+		{defaultPromTemplate, map[string]string{"__name__": "up"}, "prom.up"},
+		{defaultPromTemplate, map[string]string{"__name__": "up", "job": "node", "instance": "a:9100"},
+			"prom.up.instance.a_9100.job.node"},
+		{"{job}.{__name__}", map[string]string{"__name__": "up", "job": "node"}, "node.up"},
+		// label missing leaves no empty segment
+		{"{job}.{__name__}", map[string]string{"__name__": "up"}, "up"},
+		{"prom.{__name__}", map[string]string{"__name__": "http requests/total"}, "prom.http_requests_total"},
+	}
+	for _, tt := range tests {
+		labels := make([]*promLabel, 0)
+		for name, value := range tt.values {
+			labels = append(labels, &promLabel{Name: name, Value: value})
+		}
+		if got := promSeriesName(tt.template, labels); got != tt.want {
+			t.Errorf("%s %v: got %s, want %s", tt.template, tt.values, got, tt.want)
+		}
+	}
+}
+
+func TestPrometheusWrite(t *testing.T) {
+	ch := make(chan common.MetricPoint, 10)
+	rcv := NewPrometheusServer(ch, "test")
+	req := &promWriteRequest{Timeseries: []*promTimeSeries{
+		{
+			Labels: []*promLabel{{Name: "__name__", Value: "up"}, {Name: "job", Value: "node"}},
+			Samples: []*promSample{
+				{Value: 1, Timestamp: 1500000000000},
+				{Value: math.Float64frombits(promStaleNaN), Timestamp: 1500000015000},
+				{Value: math.NaN(), Timestamp: 1500000030000},
+			},
+		},
+		{
+			Labels:  []*promLabel{{Name: "__name__", Value: "load"}},
+			Samples: []*promSample{{Value: 0.5, Timestamp: 1500000000999}},
+		},
+	}}
+	data, err := proto.Marshal(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	w := httptest.NewRecorder()
+	rcv.writeHandler(w, httptest.NewRequest("POST", "/write", bytes.NewReader(snappyLiteral(data))))
+	if w.Code != http.StatusNoContent {
+		t.Fatalf("status %d, want %d", w.Code, http.StatusNoContent)
+	}
+	close(ch)
+	want := []common.MetricPoint{
+		{Key: "prom.up.job.node", Value: 1, Timestamp: 1500000000},
+		{Key: "prom.load", Value: 0.5, Timestamp: 1500000000},
+	}
+	i := 0
+	for mp := range ch {
+		if i >= len(want) || mp != want[i] {
+			t.Errorf("point %d: got %v", i, mp)
+		}
+		i++
+	}
+	if i != len(want) {
+		t.Errorf("got %d points, want %d", i, len(want))
+	}
+
+	bad := [][]byte{
+		data, // not compressed
+		snappyLiteral([]byte{0xff, 0xff}),
+	}
+	for _, body := range bad {
+		w := httptest.NewRecorder()
+		rcv.writeHandler(w, httptest.NewRequest("POST", "/write", bytes.NewReader(body)))
+		if w.Code != http.StatusBadRequest {
+			t.Errorf("%v: status %d, want %d", body, w.Code, http.StatusBadRequest)
+		}
+	}
+}
@@ -0,0 +1,48 @@
+package receivers
+
+/*
+Messages of prometheus remote storage protocol, see
+https://github.com/prometheus/prometheus/blob/master/prompb/remote.proto
+
+Written by hand in the same shape protoc-gen-go generates, so we don't
+need protoc to build.
+*/
+
+import (
+	"github.com/golang/protobuf/proto"
+)
+
+type promSample struct {
+	Value     float64 `protobuf:"fixed64,1,opt,name=value,proto3" json:"value,omitempty"`
+	Timestamp int64   `protobuf:"varint,2,opt,name=timestamp,proto3" json:"timestamp,omitempty"` // milliseconds
+}
+
+func (m *promSample) Reset()         { *m = promSample{} }
+func (m *promSample) String() string { return proto.CompactTextString(m) }
+func (*promSample) ProtoMessage()    {}
+
+type promLabel struct {
+	Name  string `protobuf:"bytes,1,opt,name=name,proto3" json:"name,omitempty"`
+	Value string `protobuf:"bytes,2,opt,name=value,proto3" json:"value,omitempty"`
+}
+
+func (m *promLabel) Reset()         { *m = promLabel{} }
+func (m *promLabel) String() string { return proto.CompactTextString(m) }
+func (*promLabel) ProtoMessage()    {}
+
+type promTimeSeries struct {
+	Labels  []*promLabel  `protobuf:"bytes,1,rep,name=labels" json:"labels,omitempty"`
+	Samples []*promSample `protobuf:"bytes,2,rep,name=samples" json:"samples,omitempty"`
+}
+
+func (m *promTimeSeries) Reset()         { *m = promTimeSeries{} }
+func (m *promTimeSeries) String() string { return proto.CompactTextString(m) }
+func (*promTimeSeries) ProtoMessage()    {}
+
+type promWriteRequest struct {
+	Timeseries []*promTimeSeries `protobuf:"bytes,1,rep,name=timeseries" json:"timeseries,omitempty"`
+}
+
+func (m *promWriteRequest) Reset()         { *m = promWriteRequest{} }
+func (m *promWriteRequest) String() string { return proto.CompactTextString(m) }
+func (*promWriteRequest) ProtoMessage()    {}
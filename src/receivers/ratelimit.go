@@ -0,0 +1,183 @@
+package receivers
+
+import (
+	"fmt"
+	"math"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	statsd "github.com/coder-van/v-stats"
+)
+
+const (
+	RateLimitDrop  = "drop"  // points over limit are dropped
+	RateLimitDelay = "delay" // reading from the client is delayed until points are under limit
+
+	// per ip buckets not used for this long are removed
+	rateLimitIdleBucket = time.Minute
+)
+
+// tokenBucket allow rate points per second, with burst of one second
+type tokenBucket struct {
+	rate   float64
+	burst  float64
+	tokens float64
+	last   time.Time
+}
+
+func newTokenBucket(rate float64, now time.Time) *tokenBucket {
+	burst := math.Max(rate, 1)
+	return &tokenBucket{rate: rate, burst: burst, tokens: burst, last: now}
+}
+
+func (b *tokenBucket) refill(now time.Time) {
+	b.tokens += now.Sub(b.last).Seconds() * b.rate
+	if b.tokens > b.burst {
+		b.tokens = b.burst
+	}
+	b.last = now
+}
+
+// has refill and report whether there is a token, without taking it
+func (b *tokenBucket) has(now time.Time) bool {
+	b.refill(now)
+	return b.tokens >= 1
+}
+
+// reserve take a token anyway, return how long to wait before it is available
+func (b *tokenBucket) reserve(now time.Time) time.Duration {
+	b.refill(now)
+	b.tokens--
+	if b.tokens >= 0 {
+		return 0
+	}
+	return time.Duration(-b.tokens / b.rate * float64(time.Second))
+}
+
+type prefixBucket struct {
+	prefix string
+	bucket *tokenBucket
+}
+
+// rateLimiter limit points per second of a receiver, of each source ip and
+// of metric prefixes, 0 means no limit
+type rateLimiter struct {
+	Policy string
+
+	mu        sync.Mutex
+	total     *tokenBucket
+	perIPRate float64
+	perIP     map[string]*tokenBucket
+	prefixes  []prefixBucket // longest prefix first
+	lastPrune time.Time
+	stat      *statsd.BaseStat
+}
+
+// newRateLimiter build limiter from receiver config, nil if no limit set
+func newRateLimiter(conf Config, stat *statsd.BaseStat) (*rateLimiter, error) {
+	if conf.RateLimit <= 0 && conf.RateLimitPerIP <= 0 && len(conf.RateLimitPrefixes) == 0 {
+		return nil, nil
+	}
+	if conf.RateLimitPolicy != RateLimitDrop && conf.RateLimitPolicy != RateLimitDelay {
+		return nil, fmt.Errorf("bad rate-limit-policy '%s', should be drop or delay", conf.RateLimitPolicy)
+	}
+
+	now := time.Now()
+	l := &rateLimiter{
+		Policy:    conf.RateLimitPolicy,
+		perIPRate: conf.RateLimitPerIP,
+		perIP:     make(map[string]*tokenBucket),
+		lastPrune: now,
+		stat:      stat,
+	}
+	if conf.RateLimit > 0 {
+		l.total = newTokenBucket(conf.RateLimit, now)
+	}
+	for prefix, rate := range conf.RateLimitPrefixes {
+		if prefix == "" || rate <= 0 {
+			return nil, fmt.Errorf("bad rate limit %v of prefix '%s'", rate, prefix)
+		}
+		l.prefixes = append(l.prefixes, prefixBucket{prefix, newTokenBucket(rate, now)})
+	}
+	sort.Slice(l.prefixes, func(i, j int) bool {
+		return len(l.prefixes[i].prefix) > len(l.prefixes[j].prefix)
+	})
+	return l, nil
+}
+
+// buckets return buckets a point of key from ip is counted in, caller holds mu
+func (l *rateLimiter) buckets(ip, key string, now time.Time) []*tokenBucket {
+	bs := make([]*tokenBucket, 0, 3)
+	if l.total != nil {
+		bs = append(bs, l.total)
+	}
+	if l.perIPRate > 0 {
+		b, ok := l.perIP[ip]
+		if !ok {
+			b = newTokenBucket(l.perIPRate, now)
+			l.perIP[ip] = b
+		}
+		bs = append(bs, b)
+	}
+	for _, pb := range l.prefixes {
+		if strings.HasPrefix(key, pb.prefix) {
+			bs = append(bs, pb.bucket)
+			break
+		}
+	}
+
+	if now.Sub(l.lastPrune) > rateLimitIdleBucket {
+		for ip, b := range l.perIP {
+			if now.Sub(b.last) > rateLimitIdleBucket {
+				delete(l.perIP, ip)
+			}
+		}
+		l.lastPrune = now
+	}
+	return bs
+}
+
+// Allow report whether point of key from source should be accepted, source
+// is the client ip, or client certificate cn of tls clients. With delay
+// policy it sleeps until the point is under limit and always returns true,
+// so the connection calling it is read slower. Nil limiter allows all.
+func (l *rateLimiter) Allow(source, key string) bool {
+	if l == nil {
+		return true
+	}
+	now := time.Now()
+
+	l.mu.Lock()
+	bs := l.buckets(source, key, now)
+	if l.Policy == RateLimitDrop {
+		// take tokens only if every bucket has one, a point dropped by its
+		// prefix must not use up the total and per ip limits of others
+		for _, b := range bs {
+			if !b.has(now) {
+				l.mu.Unlock()
+				l.stat.CounterInc("rate-limited-dropped", 1)
+				return false
+			}
+		}
+		for _, b := range bs {
+			b.tokens--
+		}
+		l.mu.Unlock()
+		return true
+	}
+
+	var wait time.Duration
+	for _, b := range bs {
+		if w := b.reserve(now); w > wait {
+			wait = w
+		}
+	}
+	l.mu.Unlock()
+	if wait > 0 {
+		l.stat.CounterInc("rate-limited-delay-ms", int(wait/time.Millisecond))
+		time.Sleep(wait)
+	}
+	return true
+}
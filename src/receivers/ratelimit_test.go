@@ -0,0 +1,57 @@
+package receivers
+
+import (
+	"testing"
+
+	"github.com/coder-van/v-graphite/src/common"
+)
+
+func TestRateLimiter(t *testing.T) {
+	stat := common.GetStat("test_receiver")
+	tests := []struct {
+		conf  Config
+		ip    string
+		key   string
+		count int
+		want  int // allowed of count
+	}{
+		// burst of one second, then dropped
+		{Config{RateLimit: 10}, "a", "x.y", 20, 10},
+		{Config{RateLimitPerIP: 5}, "a", "x.y", 20, 5},
+		{Config{RateLimitPrefixes: map[string]float64{"x.": 3, "x.y.": 1}}, "a", "x.y.z", 5, 1},
+		{Config{RateLimit: 10, RateLimitPolicy: RateLimitDelay}, "a", "x.y", 12, 12},
+	}
+	for i, tt := range tests {
+		tt.conf.Check()
+		l, err := newRateLimiter(tt.conf, stat)
+		if err != nil {
+			t.Fatal(err)
+		}
+		allowed := 0
+		for j := 0; j < tt.count; j++ {
+			if l.Allow(tt.ip, tt.key) {
+				allowed++
+			}
+		}
+		if allowed != tt.want {
+			t.Errorf("case %d: allowed %d, want %d", i, allowed, tt.want)
+		}
+	}
+
+	// points dropped by a noisy prefix don't use up total and per ip tokens
+	conf := Config{RateLimit: 10, RateLimitPerIP: 10, RateLimitPrefixes: map[string]float64{"noisy.": 1}}
+	conf.Check()
+	l, _ := newRateLimiter(conf, stat)
+	for j := 0; j < 100; j++ {
+		l.Allow("a", "noisy.x")
+	}
+	allowed := 0
+	for j := 0; j < 20; j++ {
+		if l.Allow("a", "quiet.x") {
+			allowed++
+		}
+	}
+	if allowed != 9 {
+		t.Errorf("allowed %d quiet points after noisy ones, want 9", allowed)
+	}
+}
@@ -2,20 +2,35 @@ package receivers
 
 import "fmt"
 import (
+	"github.com/coder-van/v-graphite/src/cache"
 	"github.com/coder-van/v-graphite/src/common"
+	statsd "github.com/coder-van/v-stats"
 	"net"
+	"os"
+	"strconv"
+	"time"
 )
 
+const DefaultChannelSize = 1024 * 1024
+
+// RulesCheckInterval is how often filter and rewrite files are checked for changes
+const RulesCheckInterval = 60 * time.Second
+
 type InterfaceReceiver interface {
 	Start()
 	Stop()
 }
 
-func New() *ReceiverManager {
+func New(channelSize int) *ReceiverManager {
+	if channelSize <= 0 {
+		channelSize = DefaultChannelSize
+	}
 	return &ReceiverManager{
 		receivers:             make([]InterfaceReceiver, 0),
-		ChanPointBagsReceived: make(chan common.MetricPoint, 1024*1024),
+		ChanPointBagsReceived: make(chan common.MetricPoint, channelSize),
 		exit: make(chan bool, 2),
+		done:                  make(chan bool),
+		stat:                  common.GetStat("receiver"),
 	}
 }
 
@@ -23,41 +38,168 @@ type ReceiverManager struct {
 	receivers             []InterfaceReceiver
 	ChanPointBagsReceived chan common.MetricPoint
 	exit                  chan bool
+	done                  chan bool // closed when Run returns
+	running               bool
 	CachePB               func(common.MetricPoint)
+	TimeWindow            *common.TimestampWindow // nil accepts any timestamp
+	Filter                *MetricFilter
+	Rewriter              *RewriteRules
+	Aggregate             func(common.MetricPoint) bool // return false if point should not go to cache
+	WAL                   *cache.WAL                    // nil if write-ahead log disabled
+	stat                  *statsd.BaseStat
 }
 
 
+// Run is blocking, ChanPointBagsReceived is never closed, as connections
+// still open and api writes may send to it after Stop
 func (rm *ReceiverManager) Run() {
-	defer close(rm.exit)
-	defer close(rm.ChanPointBagsReceived)
-	
+	defer close(rm.done)
+
 	if rm.CachePB == nil {
 		panic(" ReceiverManager CachePB func can't be nil")
 	}
+	stopWatch := make(chan bool)
+	defer close(stopWatch)
+	if rm.Filter != nil {
+		go rm.Filter.Watch(RulesCheckInterval, stopWatch)
+	}
+	if rm.Rewriter != nil {
+		go rm.Rewriter.Watch(RulesCheckInterval, stopWatch)
+	}
+
 	for _, r := range rm.receivers {
 		r.Start()
 	}
 
+	rm.stat.GaugeUpdate("channel-size", cap(rm.ChanPointBagsReceived))
+	ticker := time.NewTicker(time.Second)
+	defer ticker.Stop()
+
 	var pb common.MetricPoint
 	for {
 		select {
+		case <-ticker.C:
+			rm.stat.GaugeUpdate("channel-depth", len(rm.ChanPointBagsReceived))
+			if rm.WAL != nil {
+				rm.WAL.Tick(time.Now())
+			}
 		case <-rm.exit:
+			// receivers are stopped, points already queued still go to cache
+			for len(rm.ChanPointBagsReceived) > 0 {
+				rm.handle(<-rm.ChanPointBagsReceived)
+			}
 			fmt.Println("* ReceiveManage stopped")
 			return
 
 		case pb = <-rm.ChanPointBagsReceived:
-			rm.CachePB(pb)
+			rm.handle(pb)
 		}
 	}
-	return
+}
+
+// handle pass a received point through timestamp window, filter, rewrite and
+// aggregation to cache
+func (rm *ReceiverManager) handle(pb common.MetricPoint) {
+	if !rm.checkTimestamp(&pb) {
+		return
+	}
+	if rm.Filter != nil && !rm.Filter.Accept(pb.Key) {
+		return
+	}
+	if !rm.rewrite(&pb) {
+		return
+	}
+	if rm.Aggregate != nil && !rm.Aggregate(pb) {
+		return
+	}
+	rm.AddToCache(pb)
+}
+
+// AddToCache log point to wal and add it to cache, points aggregator emits go
+// here as well
+func (rm *ReceiverManager) AddToCache(pb common.MetricPoint) {
+	if rm.WAL == nil {
+		rm.CachePB(pb)
+		return
+	}
+	rm.WAL.Write(pb, rm.CachePB) // errors are counted, point still goes to cache
+}
+
+// LoadRewriteRules enable rewrite rules from file, file not exist means no rules for now
+func (rm *ReceiverManager) LoadRewriteRules(path string) error {
+	rr := NewRewriteRules(path)
+	if err := rr.Load(); err != nil {
+		return err
+	}
+	rm.Rewriter = rr
+	return nil
+}
+
+// LoadFilter enable whitelist and blacklist, files not exist means no filter for now
+func (rm *ReceiverManager) LoadFilter(whitelistPath, blacklistPath string) error {
+	mf := NewMetricFilter(whitelistPath, blacklistPath)
+	if err := mf.Load(); err != nil {
+		return err
+	}
+	rm.Filter = mf
+	return nil
+}
+
+// checkTimestamp drop points out of TimeWindow, rejects are counted by reason
+func (rm *ReceiverManager) checkTimestamp(pb *common.MetricPoint) bool {
+	if rm.TimeWindow == nil {
+		return true
+	}
+	ts := pb.Timestamp
+	reason := rm.TimeWindow.Check(pb, time.Now().Unix())
+	if pb.Timestamp != ts {
+		rm.stat.CounterInc("timestamp-millis-converted", 1)
+	}
+	if reason != "" {
+		rm.stat.CounterInc("rejected-timestamp-"+reason, 1)
+		return false
+	}
+	return true
+}
+
+// rewrite apply rewrite rules to point, false if the new name is invalid
+func (rm *ReceiverManager) rewrite(pb *common.MetricPoint) bool {
+	if rm.Rewriter == nil {
+		return true
+	}
+	key := rm.Rewriter.Apply(pb.Key)
+	if key == pb.Key {
+		return true
+	}
+	key, err := common.NormalizeTagged(key)
+	if err != nil || key == "" {
+		rm.stat.OnErr("error-rewrite-bad-name", fmt.Errorf("rewrite %s to bad name", pb.Key))
+		return false
+	}
+	pb.Key = key
+	return true
 }
 
 func (rm *ReceiverManager) RegisterReceiver(r InterfaceReceiver) {
 	rm.receivers = append(rm.receivers, r)
 }
 
-func (rm *ReceiverManager) CreateNewReceiver(name, t, port string, isPocket bool) (InterfaceReceiver, error) {
-	if t == "tcp" {
+func (rm *ReceiverManager) CreateNewReceiver(name string, conf Config) (InterfaceReceiver, error) {
+	conf.Check()
+	t, port, err := parseListen(conf.Listen)
+	if err != nil {
+		return nil, err
+	}
+	policy, err := ParseBackpressurePolicy(conf.Backpressure)
+	if err != nil {
+		return nil, err
+	}
+	tlsConfig, err := conf.TLSConfig()
+	if err != nil {
+		return nil, err
+	}
+	switch t {
+	case "tcp":
 		s := NewTCPServer(rm.ChanPointBagsReceived, name)
 		if port > "0" && port != "2003" {
 			addr, err := net.ResolveTCPAddr("tcp", "localhost:"+string(port))
@@ -66,9 +208,146 @@ func (rm *ReceiverManager) CreateNewReceiver(name, t, port string, isPocket bool
 			}
 			s.Addr = addr
 		}
-		if isPocket == false {
-			s.IsPickle = false
+		s.IsPickle = conf.IsPickle
+		s.maxPickleMessageSize = conf.MaxPickleMessageSize
+		s.limits = newConnLimiter(conf)
+		if s.limiter, err = newRateLimiter(conf, s.stat); err != nil {
+			return nil, err
 		}
+		s.Backpressure = policy
+		s.TLSConfig = tlsConfig
+		return s, nil
+	case "udp":
+		if tlsConfig != nil {
+			return nil, fmt.Errorf("tls is not supported by udp receiver %s", name)
+		}
+		s := NewUDPServer(rm.ChanPointBagsReceived, name)
+		if port > "0" && port != "2003" {
+			addr, err := net.ResolveUDPAddr("udp", "localhost:"+string(port))
+			if err != nil {
+				return nil, err
+			}
+			s.Addr = addr
+		}
+		s.ReadBufferSize = conf.ReadBufferSize
+		s.MaxLinesPerPacket = conf.MaxLinesPerPacket
+		s.SocketBufferSize = conf.SocketBufferSize
+		if s.limiter, err = newRateLimiter(conf, s.stat); err != nil {
+			return nil, err
+		}
+		s.Backpressure = policy
+		return s, nil
+	case "unix":
+		if tlsConfig != nil {
+			return nil, fmt.Errorf("tls is not supported by unix receiver %s", name)
+		}
+		if port == "" {
+			return nil, fmt.Errorf("socket path of unix receiver %s is empty", name)
+		}
+		if conf.SocketType != UnixSocketStream && conf.SocketType != UnixSocketDatagram {
+			return nil, fmt.Errorf("bad socket-type '%s' of unix receiver %s", conf.SocketType, name)
+		}
+		s := NewUnixServer(rm.ChanPointBagsReceived, name, port)
+		s.IsDatagram = conf.SocketType == UnixSocketDatagram
+		if conf.SocketMode != "" {
+			mode, err := strconv.ParseUint(conf.SocketMode, 8, 32)
+			if err != nil || mode > 0777 {
+				return nil, fmt.Errorf("bad socket-mode '%s' of unix receiver %s", conf.SocketMode, name)
+			}
+			s.Mode = os.FileMode(mode)
+		}
+		s.ReadBufferSize = conf.ReadBufferSize
+		s.MaxLinesPerPacket = conf.MaxLinesPerPacket
+		s.SocketBufferSize = conf.SocketBufferSize
+		if s.limiter, err = newRateLimiter(conf, s.stat); err != nil {
+			return nil, err
+		}
+		s.Backpressure = policy
+		return s, nil
+	case "statsd":
+		if tlsConfig != nil {
+			return nil, fmt.Errorf("tls is not supported by statsd receiver %s", name)
+		}
+		s := NewStatsDServer(rm.ChanPointBagsReceived, name)
+		if port > "0" {
+			addr, err := net.ResolveUDPAddr("udp", "localhost:"+string(port))
+			if err != nil {
+				return nil, err
+			}
+			s.Addr = addr
+		}
+		for _, p := range conf.Percentiles {
+			if p <= 0 || p > 100 {
+				return nil, fmt.Errorf("bad percentile %v of statsd receiver %s", p, name)
+			}
+		}
+		s.ReadBufferSize = conf.ReadBufferSize
+		s.SocketBufferSize = conf.SocketBufferSize
+		s.FlushInterval = time.Duration(conf.FlushInterval) * time.Second
+		s.GaugeTTL = 0
+		if conf.GaugeTTL > 0 {
+			s.GaugeTTL = time.Duration(conf.GaugeTTL) * time.Second
+		}
+		s.Percentiles = conf.Percentiles
+		s.Prefixes = conf.StatsDPrefixes
+		s.Backpressure = policy
+		return s, nil
+	case "opentsdb":
+		if conf.TagMode != OpenTSDBTagModeTags && conf.TagMode != OpenTSDBTagModePath {
+			return nil, fmt.Errorf("bad tag-mode '%s' of opentsdb receiver %s", conf.TagMode, name)
+		}
+		s := NewOpenTSDBServer(rm.ChanPointBagsReceived, name)
+		if port > "0" {
+			addr, err := net.ResolveTCPAddr("tcp", "localhost:"+string(port))
+			if err != nil {
+				return nil, err
+			}
+			s.Addr = addr
+		}
+		s.TagMode = conf.TagMode
+		s.TagOrder = conf.TagOrder
+		s.limits = newConnLimiter(conf)
+		if s.limiter, err = newRateLimiter(conf, s.stat); err != nil {
+			return nil, err
+		}
+		s.Backpressure = policy
+		s.TLSConfig = tlsConfig
+		return s, nil
+	case "influx", "influx-http":
+		s := NewInfluxServer(rm.ChanPointBagsReceived, name)
+		if port > "0" {
+			s.Addr = "localhost:" + port
+		}
+		s.IsHTTP = t == "influx-http"
+		s.limits = newConnLimiter(conf)
+		if conf.Template != "" {
+			s.Template = conf.Template
+		}
+		if conf.Precision != "" {
+			if _, err := influxPrecisionUnit(conf.Precision); err != nil {
+				return nil, err
+			}
+			s.Precision = conf.Precision
+		}
+		if s.limiter, err = newRateLimiter(conf, s.stat); err != nil {
+			return nil, err
+		}
+		s.Backpressure = policy
+		s.TLSConfig = tlsConfig
+		return s, nil
+	case "prometheus":
+		s := NewPrometheusServer(rm.ChanPointBagsReceived, name)
+		if port > "0" {
+			s.Addr = "localhost:" + port
+		}
+		if conf.Template != "" {
+			s.Template = conf.Template
+		}
+		if s.limiter, err = newRateLimiter(conf, s.stat); err != nil {
+			return nil, err
+		}
+		s.Backpressure = policy
+		s.TLSConfig = tlsConfig
 		return s, nil
 	}
 	return nil, fmt.Errorf("%s","server type  from config error")
@@ -76,13 +355,20 @@ func (rm *ReceiverManager) CreateNewReceiver(name, t, port string, isPocket bool
 
 func (rm *ReceiverManager) Start (){
 	fmt.Println("* ReceiverManager starting")
+	rm.running = true
 	go rm.Run()
 }
 
+// Stop receivers first, points they flush when stopping like statsd
+// aggregates go to cache before Stop returns
 func (rm *ReceiverManager) Stop() {
-	rm.exit <- true
 	fmt.Println("* ReceiveManage stopping")
 	for _, r := range rm.receivers {
 		r.Stop()
 	}
+	if rm.running {
+		rm.exit <- true
+		<-rm.done
+		rm.running = false
+	}
 }
@@ -0,0 +1,54 @@
+package receivers
+
+import (
+	"io/ioutil"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/coder-van/v-graphite/src/cache"
+	"github.com/coder-van/v-graphite/src/common"
+)
+
+func TestHandleWAL(t *testing.T) {
+	dir, err := ioutil.TempDir("", "wal")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	wal, err := cache.NewWAL(dir, 0, 0, cache.WALFsyncNever)
+	if err != nil {
+		t.Fatal(err)
+	}
+	c := cache.New(0)
+	rm := New(10)
+	rm.WAL = wal
+	rm.CachePB = c.Add
+	// inputs of agg.* are only aggregated, not kept
+	rm.Aggregate = func(mp common.MetricPoint) bool {
+		if strings.HasPrefix(mp.Key, "agg.") {
+			rm.AddToCache(common.MetricPoint{Key: "sum", Value: mp.Value, Timestamp: mp.Timestamp})
+			return false
+		}
+		return true
+	}
+
+	now := time.Now().Unix()
+	rm.handle(common.MetricPoint{Key: "agg.a", Value: 1, Timestamp: now})
+	rm.handle(common.MetricPoint{Key: "raw.a", Value: 2, Timestamp: now})
+	wal.Close()
+
+	// replay gives what went to cache, not the aggregated inputs
+	replayed := cache.New(0)
+	replayed.RestoreAll(dir, nil)
+	for _, key := range []string{"agg.a", "raw.a", "sum"} {
+		if got, want := replayed.Points(key) != nil, c.Points(key) != nil; got != want {
+			t.Errorf("%s: replayed %v, cached %v", key, got, want)
+		}
+	}
+	if replayed.Size() != 2 {
+		t.Errorf("replayed %d points, want 2", replayed.Size())
+	}
+}
@@ -0,0 +1,175 @@
+package receivers
+
+/*
+Rewrite rules change metric names before they go to cache, read from
+rewrite-rules.conf, one section a rule, applied in order of the file:
+
+    [collectd]
+    pattern = ^collectd\.([a-z0-9]+)_([a-z0-9]+)\.
+    replacement = servers.\1.\2.
+    lowercase = true   # lowercase the name after replacement
+    last = true        # stop at this rule if it matches
+
+Replacement may use \1 like carbon, or $1 / ${1} like go regexp.
+*/
+
+import (
+	"fmt"
+	"os"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/alyu/configparser"
+	"github.com/coder-van/v-graphite/src/common"
+	statsd "github.com/coder-van/v-stats"
+	"github.com/coder-van/v-util/log"
+)
+
+var carbonGroupRegexp = regexp.MustCompile(`\\(\d+)`)
+
+type RewriteRule struct {
+	Name        string
+	Pattern     *regexp.Regexp
+	Replacement string
+	Lowercase   bool
+	Last        bool
+}
+
+// RewriteRules is reloaded when file changes, safe for concurrent use
+type RewriteRules struct {
+	mu      sync.RWMutex
+	rules   []*RewriteRule
+	path    string
+	modTime time.Time
+
+	logger *log.Vlogger
+	stat   *statsd.BaseStat
+}
+
+func NewRewriteRules(path string) *RewriteRules {
+	return &RewriteRules{
+		rules:  make([]*RewriteRule, 0),
+		path:   path,
+		logger: log.GetLogger("rewrite", log.RotateModeMonth),
+		stat:   common.GetStat("rewrite"),
+	}
+}
+
+func ReadRewriteRules(filePath string) ([]*RewriteRule, error) {
+	config, err := configparser.Read(filePath)
+	if err != nil {
+		return nil, err
+	}
+	sections, err := config.AllSections()
+	if err != nil {
+		return nil, err
+	}
+
+	rules := make([]*RewriteRule, 0)
+	for _, s := range sections {
+		name := strings.Trim(strings.SplitN(s.String(), "\n", 2)[0], " []")
+		if name == "" || name == "global" || strings.HasPrefix(name, "#") {
+			continue
+		}
+
+		rule := &RewriteRule{Name: name}
+		patternStr := s.ValueOf("pattern")
+		if patternStr == "" {
+			return nil, fmt.Errorf("empty pattern for rewrite rule [%s]", name)
+		}
+		rule.Pattern, err = regexp.Compile(patternStr)
+		if err != nil {
+			return nil, fmt.Errorf("failed to parse pattern %q for rewrite rule [%s]: %s",
+				patternStr, name, err.Error())
+		}
+		rule.Replacement = carbonGroupRegexp.ReplaceAllString(s.ValueOf("replacement"), "$${$1}")
+
+		for _, opt := range []string{"lowercase", "last"} {
+			v := s.ValueOf(opt)
+			if v == "" {
+				continue
+			}
+			b, err := strconv.ParseBool(v)
+			if err != nil {
+				return nil, fmt.Errorf("failed to parse %s %q for rewrite rule [%s]", opt, v, name)
+			}
+			if opt == "lowercase" {
+				rule.Lowercase = b
+			} else {
+				rule.Last = b
+			}
+		}
+		rules = append(rules, rule)
+	}
+	return rules, nil
+}
+
+// Load read rules file if it changed since last load, a bad file keeps the old rules
+func (rr *RewriteRules) Load() error {
+	info, err := os.Stat(rr.path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			rr.mu.Lock()
+			rr.rules = make([]*RewriteRule, 0)
+			rr.modTime = time.Time{}
+			rr.mu.Unlock()
+			return nil
+		}
+		return err
+	}
+	if info.ModTime().Equal(rr.modTime) {
+		return nil
+	}
+
+	rules, err := ReadRewriteRules(rr.path)
+	if err != nil {
+		rr.stat.OnErr("error-rewrite-rules-load", err)
+		rr.logger.Printf("load rewrite rules %s fail, keep old rules, %s \n", rr.path, err)
+		return err
+	}
+
+	rr.mu.Lock()
+	rr.rules = rules
+	rr.modTime = info.ModTime()
+	rr.mu.Unlock()
+	rr.logger.Printf("load %d rewrite rules from %s \n", len(rules), rr.path)
+	return nil
+}
+
+// Watch reload rules on change until exit closed
+func (rr *RewriteRules) Watch(interval time.Duration, exit chan bool) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			rr.Load()
+		case <-exit:
+			return
+		}
+	}
+}
+
+// Apply rewrite metric by rules in order
+func (rr *RewriteRules) Apply(metric string) string {
+	rr.mu.RLock()
+	defer rr.mu.RUnlock()
+
+	for _, rule := range rr.rules {
+		if !rule.Pattern.MatchString(metric) {
+			continue
+		}
+		metric = rule.Pattern.ReplaceAllString(metric, rule.Replacement)
+		if rule.Lowercase {
+			metric = strings.ToLower(metric)
+		}
+		rr.stat.CounterInc("rule-"+rule.Name+"-hits", 1)
+		if rule.Last {
+			break
+		}
+	}
+	return metric
+}
@@ -0,0 +1,84 @@
+package receivers
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// writeRules write content to path, mtime is moved on so reload sees it
+func writeRules(t *testing.T, path, content string, age int) {
+	if err := ioutil.WriteFile(path, []byte(content), 0644); err != nil {
+		t.Fatal(err)
+	}
+	mtime := time.Now().Add(time.Duration(age) * time.Second)
+	if err := os.Chtimes(path, mtime, mtime); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestRewriteRules(t *testing.T) {
+	dir, err := ioutil.TempDir("", "rewrite")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "rewrite-rules.conf")
+
+	rr := NewRewriteRules(path)
+	if err := rr.Load(); err != nil {
+		t.Fatal(err)
+	}
+	if got := rr.Apply("collectd.Web01_cpu.idle"); got != "collectd.Web01_cpu.idle" {
+		t.Errorf("no rules changed metric to %s", got)
+	}
+
+	writeRules(t, path, `[collectd]
+pattern = ^collectd\.([A-Za-z0-9]+)_([a-z0-9]+)\.
+replacement = servers.\1.\2.
+lowercase = true
+last = true
+
+[servers]
+pattern = ^servers\.
+replacement = hosts.
+
+[idle]
+pattern = \.idle$
+replacement = ${0}_time
+`, 1)
+	if err := rr.Load(); err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		metric string
+		want   string
+	}{
+		// last stops at first rule
+		{"collectd.Web01_cpu.idle", "servers.web01.cpu.idle"},
+		{"servers.a.idle", "hosts.a.idle_time"},
+		{"apps.b.count", "apps.b.count"},
+	}
+	for _, tt := range tests {
+		if got := rr.Apply(tt.metric); got != tt.want {
+			t.Errorf("%s: got %s, want %s", tt.metric, got, tt.want)
+		}
+	}
+
+	// bad file keeps old rules
+	writeRules(t, path, "[bad]\npattern = (\n", 2)
+	if err := rr.Load(); err == nil {
+		t.Error("expected error for bad pattern")
+	}
+	if got := rr.Apply("servers.a.x"); got != "hosts.a.x" {
+		t.Errorf("old rules not kept, got %s", got)
+	}
+
+	os.Remove(path)
+	rr.Load()
+	if got := rr.Apply("servers.a.x"); got != "servers.a.x" {
+		t.Errorf("removed rules still used, got %s", got)
+	}
+}
@@ -0,0 +1,372 @@
+package receivers
+
+/*
+StatsD receiver, listen udp and aggregate statsd metrics in its own registry,
+points are flushed to cache every FlushInterval.
+
+    <name>:<value>|c[|@<rate>]   counter, value is divided by sample rate
+    <name>:[+-]<value>|g         gauge, a leading sign changes current value
+    <name>:<value>|ms[|@<rate>]  timer, count is divided by sample rate
+    <name>:<value>|h             histogram, same as timer
+    <name>:<value>|s             set, count of unique values
+
+One line may carry several values like "name:1|c:2|ms", one packet may
+carry several lines. Gauges not updated for GaugeTTL are not sent any more.
+*/
+
+import (
+	"bytes"
+	"fmt"
+	"math"
+	"net"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/coder-van/v-graphite/src/common"
+	statsd "github.com/coder-van/v-stats"
+	"github.com/coder-van/v-stats/metrics"
+	"github.com/coder-van/v-util/log"
+)
+
+const (
+	defaultStatsDFlushInterval = 10
+	defaultStatsDGaugeTTL      = 3600
+	statsdReservoirSize        = 1028
+	// timer values are kept as int64 in samples, scale to keep 3 decimals
+	statsdTimerScale = 1000.0
+)
+
+var (
+	defaultStatsDPercentiles = []float64{50, 90, 99}
+	statsdIllegalRegexp      = regexp.MustCompile(`[^a-zA-Z0-9_\-.;=]`)
+)
+
+// StatsDPrefixes are name prefixes of each kind of statsd metric, empty
+// parts are skipped, e.g. stats.timers.<name>.mean
+type StatsDPrefixes struct {
+	Global  string `toml:"prefix"`
+	Counter string `toml:"prefix-counter"`
+	Gauge   string `toml:"prefix-gauge"`
+	Timer   string `toml:"prefix-timer"`
+	Set     string `toml:"prefix-set"`
+}
+
+var defaultStatsDPrefixes = StatsDPrefixes{
+	Global:  "stats",
+	Counter: "counters",
+	Gauge:   "gauges",
+	Timer:   "timers",
+	Set:     "sets",
+}
+
+type statsdCounter struct {
+	value float64
+}
+
+type statsdSet struct {
+	values map[string]bool
+}
+
+type statsdGauge struct {
+	value   float64
+	updated int64 // unix time
+}
+
+// statsdTimer keep sampled values in h, count is scaled by sample rate
+type statsdTimer struct {
+	h     metrics.Histogram
+	count float64
+}
+
+func NewStatsDServer(ch chan common.MetricPoint, name string) *StatsDServer {
+	s := &StatsDServer{
+		Name:                  name,
+		ReadBufferSize:        defaultUDPReadBufferSize,
+		FlushInterval:         defaultStatsDFlushInterval * time.Second,
+		GaugeTTL:              defaultStatsDGaugeTTL * time.Second,
+		Percentiles:           defaultStatsDPercentiles,
+		Prefixes:              defaultStatsDPrefixes,
+		registry:              metrics.NewRegistry(),
+		exit:                  make(chan bool),
+		ChanPointBagsReceived: ch,
+		stat:                  common.GetStat("statsd_receiver"),
+		logger:                log.GetLogger("statsd", log.RotateModeMonth),
+	}
+	addr, err := net.ResolveUDPAddr("udp", "localhost:8125")
+	if err != nil {
+		fmt.Println(err)
+	}
+	s.Addr = addr
+	return s
+}
+
+// StatsDServer receive statsd protocol from udp
+type StatsDServer struct {
+	Name string
+
+	Addr             *net.UDPAddr
+	ReadBufferSize   int
+	SocketBufferSize int // kernel receive buffer of socket, 0 keeps os default
+	FlushInterval    time.Duration
+	GaugeTTL         time.Duration // 0 means gauges are sent forever
+	Percentiles      []float64     // e.g. 90 for 90th percentile
+	Prefixes         StatsDPrefixes
+
+	mu       sync.Mutex // guards registry and metrics in it
+	registry metrics.Registry
+	conn     *net.UDPConn
+	exit     chan bool
+	done     chan bool // closed when flushLoop returns, nil if not started
+
+	ChanPointBagsReceived chan common.MetricPoint
+	Backpressure          BackpressurePolicy
+	logger                *log.Vlogger
+	stat                  *statsd.BaseStat
+}
+
+func (rcv *StatsDServer) handlePacket(data []byte) {
+	rcv.stat.CounterInc("datagram-received", 1)
+	for _, line := range bytes.Split(data, []byte{'\n'}) {
+		line = bytes.TrimSpace(line)
+		if len(line) == 0 {
+			continue
+		}
+		if err := rcv.handleLine(string(line)); err != nil {
+			rcv.stat.OnErr("error-statsd-receiver-parse", err)
+		}
+	}
+}
+
+func (rcv *StatsDServer) handleLine(line string) error {
+	bits := strings.Split(line, ":")
+	if len(bits) < 2 || bits[0] == "" {
+		return fmt.Errorf("bad statsd line %#v", line)
+	}
+	key := sanitizeStatsDKey(bits[0])
+
+	for _, bit := range bits[1:] {
+		fields := strings.Split(bit, "|")
+		if len(fields) < 2 {
+			return fmt.Errorf("bad statsd line %#v", line)
+		}
+		rate := 1.0
+		if len(fields) > 2 && strings.HasPrefix(fields[2], "@") {
+			r, err := strconv.ParseFloat(fields[2][1:], 64)
+			if err != nil || r <= 0 || r > 1 {
+				return fmt.Errorf("bad sample rate in statsd line %#v", line)
+			}
+			rate = r
+		}
+		if err := rcv.update(key, fields[0], fields[1], rate); err != nil {
+			return fmt.Errorf("%s, statsd line %#v", err, line)
+		}
+		rcv.stat.CounterInc("point-received", 1)
+	}
+	return nil
+}
+
+func (rcv *StatsDServer) update(key, valueStr, typ string, rate float64) error {
+	rcv.mu.Lock()
+	defer rcv.mu.Unlock()
+
+	if typ == "s" {
+		m := rcv.registry.GetOrRegister("s:"+key, func() *statsdSet {
+			return &statsdSet{values: make(map[string]bool)}
+		})
+		m.(*statsdSet).values[valueStr] = true
+		return nil
+	}
+
+	value, err := strconv.ParseFloat(valueStr, 64)
+	if err != nil || math.IsNaN(value) || math.IsInf(value, 0) {
+		return fmt.Errorf("bad value %#v", valueStr)
+	}
+
+	switch typ {
+	case "c":
+		m := rcv.registry.GetOrRegister("c:"+key, func() *statsdCounter { return &statsdCounter{} })
+		m.(*statsdCounter).value += value / rate
+	case "g":
+		m := rcv.registry.GetOrRegister("g:"+key, func() *statsdGauge { return &statsdGauge{} }).(*statsdGauge)
+		if valueStr[0] == '+' || valueStr[0] == '-' {
+			m.value += value
+		} else {
+			m.value = value
+		}
+		m.updated = time.Now().Unix()
+	case "ms", "h":
+		m := rcv.registry.GetOrRegister("t:"+key, func() *statsdTimer {
+			return &statsdTimer{h: metrics.NewHistogram(metrics.NewUniformSample(statsdReservoirSize))}
+		}).(*statsdTimer)
+		m.h.Update(int64(value * statsdTimerScale))
+		m.count += 1 / rate
+	default:
+		return fmt.Errorf("unknown type %#v", typ)
+	}
+	return nil
+}
+
+func sanitizeStatsDKey(key string) string {
+	key = strings.Replace(key, " ", "_", -1)
+	key = strings.Replace(key, "/", "-", -1)
+	return statsdIllegalRegexp.ReplaceAllString(key, "")
+}
+
+func (rcv *StatsDServer) metricName(typePrefix, name, suffix string) string {
+	parts := make([]string, 0, 4)
+	for _, p := range []string{rcv.Prefixes.Global, typePrefix, name, suffix} {
+		if p != "" {
+			parts = append(parts, p)
+		}
+	}
+	return strings.Join(parts, ".")
+}
+
+func percentileName(p float64) string {
+	return strings.Replace(strconv.FormatFloat(p, 'f', -1, 64), ".", "_", -1)
+}
+
+// Flush make points of all metrics, counters, timers and sets are reset,
+// gauges keep their value like statsd does until not updated for GaugeTTL
+func (rcv *StatsDServer) Flush(now int64) []common.MetricPoint {
+	seconds := rcv.FlushInterval.Seconds()
+	gaugeTTL := int64(rcv.GaugeTTL / time.Second)
+	ps := make([]float64, len(rcv.Percentiles))
+	for i, p := range rcv.Percentiles {
+		ps[i] = p / 100.0
+	}
+
+	points := make([]common.MetricPoint, 0)
+	add := func(key string, v float64) {
+		points = append(points, common.MetricPoint{Key: key, Value: v, Timestamp: now})
+	}
+
+	rcv.mu.Lock()
+	old := rcv.registry
+	rcv.registry = metrics.NewRegistry()
+	old.Each(func(k string, i interface{}) {
+		name := k[2:]
+		switch m := i.(type) {
+		case *statsdCounter:
+			add(rcv.metricName(rcv.Prefixes.Counter, name, "count"), m.value)
+			add(rcv.metricName(rcv.Prefixes.Counter, name, "rate"), m.value/seconds)
+		case *statsdGauge:
+			if gaugeTTL > 0 && now-m.updated >= gaugeTTL {
+				return
+			}
+			add(rcv.metricName(rcv.Prefixes.Gauge, name, ""), m.value)
+			rcv.registry.Register(k, m)
+		case *statsdTimer:
+			h := m.h.Snapshot()
+			if h.Count() == 0 {
+				return
+			}
+			add(rcv.metricName(rcv.Prefixes.Timer, name, "count"), m.count)
+			add(rcv.metricName(rcv.Prefixes.Timer, name, "count_ps"), m.count/seconds)
+			add(rcv.metricName(rcv.Prefixes.Timer, name, "sum"), float64(h.Sum())/statsdTimerScale)
+			add(rcv.metricName(rcv.Prefixes.Timer, name, "lower"), float64(h.Min())/statsdTimerScale)
+			add(rcv.metricName(rcv.Prefixes.Timer, name, "upper"), float64(h.Max())/statsdTimerScale)
+			add(rcv.metricName(rcv.Prefixes.Timer, name, "mean"), h.Mean()/statsdTimerScale)
+			add(rcv.metricName(rcv.Prefixes.Timer, name, "std"), h.StdDev()/statsdTimerScale)
+			for j, v := range h.Percentiles(ps) {
+				add(rcv.metricName(rcv.Prefixes.Timer, name, "upper_"+percentileName(rcv.Percentiles[j])),
+					v/statsdTimerScale)
+			}
+		case *statsdSet:
+			add(rcv.metricName(rcv.Prefixes.Set, name, "count"), float64(len(m.values)))
+		}
+	})
+	rcv.mu.Unlock()
+
+	sort.Slice(points, func(i, j int) bool { return points[i].Key < points[j].Key })
+	return points
+}
+
+func (rcv *StatsDServer) flushLoop() {
+	defer close(rcv.done)
+	ticker := time.NewTicker(rcv.FlushInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			rcv.flushOut()
+		case <-rcv.exit:
+			return
+		}
+	}
+}
+
+func (rcv *StatsDServer) flushOut() {
+	points := rcv.Flush(time.Now().Unix())
+	for _, mp := range points {
+		rcv.pipeOut(mp)
+	}
+	rcv.stat.CounterInc("point-flushed", len(points))
+}
+
+func (rcv *StatsDServer) pipeOut(mp common.MetricPoint) {
+	pushPoint(rcv.ChanPointBagsReceived, rcv.Backpressure, rcv.stat, rcv.Name, mp)
+}
+
+func (rcv *StatsDServer) Start() {
+	fmt.Println("* StatsD receiver starting")
+	rcv.done = make(chan bool)
+	go rcv.flushLoop()
+	go rcv.Listen()
+}
+
+// Listen 是阻塞的 需要调用时加 go
+func (rcv *StatsDServer) Listen() error {
+	var err error
+	rcv.conn, err = net.ListenUDP("udp", rcv.Addr)
+	if err != nil {
+		rcv.logger.Printf("statsd listen %s failed, %s \n", rcv.Addr, err)
+		return err
+	}
+	defer rcv.conn.Close()
+
+	if rcv.SocketBufferSize > 0 {
+		if err = rcv.conn.SetReadBuffer(rcv.SocketBufferSize); err != nil {
+			rcv.logger.Printf("statsd set socket buffer failed, %s \n", err)
+		}
+	}
+	buf := make([]byte, rcv.ReadBufferSize+1)
+
+	fmt.Println("* StatsD receiver started")
+	for {
+		n, _, err := rcv.conn.ReadFromUDP(buf)
+		if err != nil {
+			if strings.Contains(err.Error(), "use of closed network connection") {
+				break
+			}
+			rcv.stat.OnErr("error-statsd-receiver-read", err)
+			continue
+		}
+		if n > rcv.ReadBufferSize {
+			rcv.stat.CounterInc("datagram-oversized", 1)
+			continue
+		}
+		rcv.handlePacket(buf[:n])
+	}
+	return nil
+}
+
+func (rcv *StatsDServer) Stop() {
+	fmt.Println("* StatsD receiver closing")
+	if rcv.conn != nil {
+		rcv.conn.Close()
+	}
+	if rcv.done != nil {
+		close(rcv.exit)
+		<-rcv.done
+		rcv.done = nil
+	}
+	// last flush is done here, not in flushLoop, so it is queued before
+	// ReceiverManager stops reading
+	rcv.flushOut()
+	fmt.Println("* StatsD receiver closed")
+}
@@ -0,0 +1,80 @@
+package receivers
+
+import (
+	"testing"
+	"time"
+)
+
+func TestStatsDFlush(t *testing.T) {
+	rcv := NewStatsDServer(nil, "test")
+	rcv.Percentiles = []float64{90}
+	lines := []string{
+		"hits:1|c",
+		"hits:2|c|@0.5",
+		"load:5|g",
+		"load:+2|g",
+		"api.latency:10|ms|@0.1",
+		"api.latency:20|ms|@0.1",
+		"users:a|s",
+		"users:b|s:c|s",
+		"users:a|s",
+	}
+	for _, line := range lines {
+		if err := rcv.handleLine(line); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	now := time.Now().Unix()
+	want := map[string]float64{
+		"stats.counters.hits.count":         5,
+		"stats.counters.hits.rate":          0.5,
+		"stats.gauges.load":                 7,
+		"stats.timers.api.latency.count":    20,
+		"stats.timers.api.latency.count_ps": 2,
+		"stats.timers.api.latency.sum":      30,
+		"stats.timers.api.latency.lower":    10,
+		"stats.timers.api.latency.upper":    20,
+		"stats.timers.api.latency.mean":     15,
+		"stats.timers.api.latency.std":      5,
+		"stats.timers.api.latency.upper_90": 20,
+		"stats.sets.users.count":            3,
+	}
+	points := rcv.Flush(now)
+	if len(points) != len(want) {
+		t.Fatalf("got %d points, want %d: %v", len(points), len(want), points)
+	}
+	for _, p := range points {
+		if v, ok := want[p.Key]; !ok || v != p.Value || p.Timestamp != now {
+			t.Errorf("got %s %v %d, want %v %d", p.Key, p.Value, p.Timestamp, v, now)
+		}
+	}
+
+	// only gauges are kept, until not updated for GaugeTTL
+	points = rcv.Flush(now + 10)
+	if len(points) != 1 || points[0].Key != "stats.gauges.load" || points[0].Value != 7 {
+		t.Fatalf("got %v, want gauge only", points)
+	}
+	if points = rcv.Flush(now + int64(rcv.GaugeTTL/time.Second)); len(points) != 0 {
+		t.Fatalf("got %v, want gauge expired", points)
+	}
+}
+
+func TestStatsDBadLines(t *testing.T) {
+	rcv := NewStatsDServer(nil, "test")
+	lines := []string{
+		"hits",
+		":1|c",
+		"hits:1",
+		"hits:x|c",
+		"hits:1|c|@0",
+		"hits:1|c|@2",
+		"hits:1|q",
+		"hits:NaN|g",
+	}
+	for _, line := range lines {
+		if err := rcv.handleLine(line); err == nil {
+			t.Errorf("expected error for %q", line)
+		}
+	}
+}
@@ -2,10 +2,11 @@ package receivers
 
 import (
 	"bufio"
+	"crypto/tls"
+	"encoding/binary"
 	"fmt"
 	"io"
 	"net"
-	"time"
 
 	"github.com/coder-van/v-graphite/src/common"
 	"strings"
@@ -17,6 +18,8 @@ func NewTCPServer(ch chan common.MetricPoint, name string) *TCPServer {
 	s := &TCPServer{
 		Name:                  name,
 		IsPickle:              true,
+		maxPickleMessageSize:  defaultMaxPickleMessageSize,
+		limits:                newConnLimiter(Config{IdleTimeout: defaultIdleTimeout}),
 		ChanPointBagsReceived: ch,
 		stat:                  common.GetStat("tcp_receiver"),
 		logger: log.GetLogger("tcp", log.RotateModeMonth),
@@ -36,8 +39,12 @@ type TCPServer struct {
 	Addr                  *net.TCPAddr
 	IsPickle              bool
 	maxPickleMessageSize  uint32
-	listener              *net.TCPListener
+	TLSConfig             *tls.Config // nil if tls not enabled
+	limits                *connLimiter
+	limiter               *rateLimiter // nil if no rate limit
+	listener              net.Listener
 	ChanPointBagsReceived chan common.MetricPoint // 收到的数据都写入channel
+	Backpressure          BackpressurePolicy
 	logger                *log.Vlogger
 	stat                  *statsd.BaseStat
 }
@@ -51,20 +58,27 @@ func (rcv *TCPServer) handleByteArray(conn net.Conn) {
 	defer rcv.stat.GaugeDec("active_conn", -1)
 	defer conn.Close()
 
+	source := clientSource(conn)
 	reader := bufio.NewReader(conn)
 
 	for {
-		conn.SetReadDeadline(time.Now().Add(2 * time.Minute))
+		rcv.limits.setDeadline(conn)
 
-		line, err := reader.ReadBytes('\n')
+		line, err := rcv.limits.readLine(reader)
 		rcv.logger.Debug(
 			fmt.Sprintf("tcp received %s \n", string(line)))
 		
+		if err == errLineTooLong {
+			rcv.stat.CounterInc("line-too-long", 1)
+			continue
+		}
 		if err != nil {
 			if err == io.EOF {
 				if len(line) > 0 {
 					rcv.logger.Printf("Warn unfinished line %s", string(line))
 				}
+			} else if isTimeout(err) {
+				rcv.stat.CounterInc("idle-timeout-closed", 1)
 			} else {
 				rcv.stat.OnErr("error-tcp-receiver-readline", err)
 				rcv.logger.Printf("read error %s", err.Error())
@@ -75,7 +89,7 @@ func (rcv *TCPServer) handleByteArray(conn net.Conn) {
 		if len(line) > 0 { // skip empty lines
 			if mp, err := common.ParseFromStr(string(line)); err != nil {
 				rcv.stat.OnErr("error-tcp-receiver-ParseFromStr", err)
-			} else {
+			} else if rcv.limiter.Allow(source, mp.Key) {
 				rcv.stat.CounterInc("point-received", 1)
 				rcv.pipeOut(*mp)
 			}
@@ -84,38 +98,86 @@ func (rcv *TCPServer) handleByteArray(conn net.Conn) {
 
 }
 
-//func (rcv *TCPServer) handlePickle(conn net.Conn) {
-//	rcv.stat.GaugeInc("active_conn", 1)
-//	defer rcv.stat.GaugeDec("active_conn", -1)
-//	defer conn.Close()
-//
-//	c, _ := NewConn(conn, byte(4), binary.BigEndian)
-//	c.MaxFrameSize = uint(rcv.maxPickleMessageSize)
-//	for {
-//		conn.SetReadDeadline(time.Now().Add(2 * time.Minute))
-//		data, err := c.ReadFrame()
-//		if err != nil {
-//			rcv.stat.OnErr("error-tcp-receiver-ReadFrame", err)
-//			return
-//		}
-//		fmt.Println(data)
-//
-//		mps, err := common.ParseFromBytes(data)
-//
-//		if err != nil {
-//			rcv.stat.OnErr("error-tcp-receiver-ParseFromBytes", err)
-//			return
-//		}
-//
-//		for _, pointBag := range mps {
-//			rcv.stat.CounterInc("point-received", 1)
-//			rcv.pipeOut(pointBag)
-//		}
-//	}
-//}
+func (rcv *TCPServer) handlePickle(conn net.Conn) {
+	if conn == nil {
+		return
+	}
+	rcv.stat.GaugeInc("active_conn", 1)
+	defer rcv.stat.GaugeDec("active_conn", -1)
+	defer conn.Close()
+
+	var frames, points, errs int
+	defer func() {
+		if errs > 0 {
+			rcv.stat.CounterInc("pickle-conns-with-errors", 1)
+		}
+		rcv.logger.Debug(fmt.Sprintf("pickle conn %s closed, frames %d points %d errors %d \n",
+			conn.RemoteAddr(), frames, points, errs))
+	}()
+
+	source := clientSource(conn)
+	c, _ := NewConn(conn, byte(4), binary.BigEndian)
+	c.MaxFrameSize = uint(rcv.maxPickleMessageSize)
+	for {
+		rcv.limits.setDeadline(conn)
+		data, err := c.ReadFrame()
+		if err != nil {
+			if err == io.EOF {
+				return
+			}
+			if isTimeout(err) {
+				rcv.stat.CounterInc("idle-timeout-closed", 1)
+				return
+			}
+			// stream can't be resynced after a bad frame header, drop the connection
+			errs++
+			rcv.stat.CounterInc("pickle-frame-errors", 1)
+			rcv.stat.OnErr("error-tcp-receiver-ReadFrame", err)
+			rcv.logger.Printf("pickle conn %s read frame error %s \n", conn.RemoteAddr(), err.Error())
+			return
+		}
+		frames++
+		rcv.stat.CounterInc("pickle-frames", 1)
+
+		mps, err := common.ParseFromBytes(data)
+		if err != nil {
+			// frame boundary is still known, skip the bad frame only
+			errs++
+			rcv.stat.CounterInc("pickle-unpickle-errors", 1)
+			rcv.stat.OnErr("error-tcp-receiver-ParseFromBytes", err)
+			rcv.logger.Printf("pickle conn %s bad frame %s \n", conn.RemoteAddr(), err.Error())
+			continue
+		}
+
+		for _, pointBag := range mps {
+			if !rcv.limiter.Allow(source, pointBag.Key) {
+				continue
+			}
+			points++
+			rcv.stat.CounterInc("point-received", 1)
+			rcv.pipeOut(pointBag)
+		}
+	}
+}
+
+// handleConn finish tls handshake if any before handle the connection
+func (rcv *TCPServer) handleConn(conn net.Conn, handler func(net.Conn)) {
+	defer rcv.limits.release(conn)
+	if err := tlsHandshake(conn); err != nil {
+		rcv.stat.CounterInc("tls-handshake-errors", 1)
+		rcv.stat.OnErr("error-tcp-receiver-tls-handshake", err)
+		rcv.logger.Printf("tls handshake with %s fail, %s \n", conn.RemoteAddr(), err)
+		conn.Close()
+		return
+	}
+	if cn := ClientCN(conn); cn != "" {
+		rcv.logger.Debug(fmt.Sprintf("tls client %s connected from %s \n", cn, conn.RemoteAddr()))
+	}
+	handler(conn)
+}
 
 func (rcv *TCPServer) pipeOut(mp common.MetricPoint) {
-	rcv.ChanPointBagsReceived <- mp
+	pushPoint(rcv.ChanPointBagsReceived, rcv.Backpressure, rcv.stat, rcv.Name, mp)
 }
 
 
@@ -126,23 +188,27 @@ func (rcv *TCPServer) Start() {
 
 // Listen 是阻塞的 需要调用时加 go
 func (rcv *TCPServer) Listen() error {
-	var err error
-	rcv.listener, err = net.ListenTCP("tcp", rcv.Addr)
+	ln, err := net.ListenTCP("tcp", rcv.Addr)
 	if err != nil {
 		// TODO 直接退出
 		return err
 	}
-	defer rcv.listener.Close()
+	var listener net.Listener = ln
+	if rcv.TLSConfig != nil {
+		listener = tls.NewListener(ln, rcv.TLSConfig)
+	}
+	rcv.listener = listener
+	defer ln.Close()
 
 	handler := rcv.handleByteArray
-	//if rcv.IsPickle {
-	//	handler = rcv.handlePickle
-	//}
+	if rcv.IsPickle {
+		handler = rcv.handlePickle
+	}
 	
 	fmt.Println("* Tcp receiver started")
 	for {
 
-		conn, err := rcv.listener.Accept()
+		conn, err := listener.Accept()
 		if err != nil {
 			if strings.Contains(err.Error(), "use of closed network connection") {
 				break
@@ -150,7 +216,13 @@ func (rcv *TCPServer) Listen() error {
 			// fmt.Fprintf(os.Stdout, "Error: %s", err.Error())
 			continue
 		}
-		go handler(conn)
+		if reason := rcv.limits.acquire(conn); reason != "" {
+			rcv.stat.CounterInc("conn-rejected-"+reason, 1)
+			rcv.logger.Debug(fmt.Sprintf("tcp conn from %s rejected, %s \n", conn.RemoteAddr(), reason))
+			conn.Close()
+			continue
+		}
+		go rcv.handleConn(conn, handler)
 
 	}
 	return nil
@@ -158,7 +230,9 @@ func (rcv *TCPServer) Listen() error {
 
 func (rcv *TCPServer) Stop() {
 	fmt.Println("* Tcp receiver closing")
-	rcv.listener.Close()
-	rcv.listener = nil
+	if rcv.listener != nil {
+		rcv.listener.Close()
+		rcv.listener = nil
+	}
 	fmt.Println("* Tcp receiver closed")
 }
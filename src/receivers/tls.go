@@ -0,0 +1,111 @@
+package receivers
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"time"
+)
+
+var tlsVersions = map[string]uint16{
+	"1.0": tls.VersionTLS10,
+	"1.1": tls.VersionTLS11,
+	"1.2": tls.VersionTLS12,
+	"1.3": tls.VersionTLS13,
+}
+
+const tlsHandshakeTimeout = 10 * time.Second
+
+// TLSConfig build tls config of receiver, nil if tls not enabled
+func (c *Config) TLSConfig() (*tls.Config, error) {
+	if c.TLSCert == "" && c.TLSKey == "" {
+		if c.TLSClientCA != "" || c.TLSVerifyClient {
+			return nil, fmt.Errorf("tls-client-ca and tls-verify-client need tls-cert and tls-key")
+		}
+		return nil, nil
+	}
+
+	cert, err := tls.LoadX509KeyPair(c.TLSCert, c.TLSKey)
+	if err != nil {
+		return nil, fmt.Errorf("load tls cert %s key %s fail, %s", c.TLSCert, c.TLSKey, err)
+	}
+	conf := &tls.Config{
+		Certificates: []tls.Certificate{cert},
+		MinVersion:   tls.VersionTLS12,
+	}
+
+	if c.TLSMinVersion != "" {
+		v, ok := tlsVersions[c.TLSMinVersion]
+		if !ok {
+			return nil, fmt.Errorf("unknown tls-min-version '%s', should be one of: 1.0, 1.1, 1.2, 1.3", c.TLSMinVersion)
+		}
+		conf.MinVersion = v
+	}
+
+	if c.TLSClientCA != "" {
+		pem, err := ioutil.ReadFile(c.TLSClientCA)
+		if err != nil {
+			return nil, fmt.Errorf("read tls client ca %s fail, %s", c.TLSClientCA, err)
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("no certificate found in tls client ca %s", c.TLSClientCA)
+		}
+		conf.ClientCAs = pool
+		conf.ClientAuth = tls.VerifyClientCertIfGiven
+	}
+	if c.TLSVerifyClient {
+		if conf.ClientCAs == nil {
+			return nil, fmt.Errorf("tls-verify-client needs tls-client-ca")
+		}
+		conf.ClientAuth = tls.RequireAndVerifyClientCert
+	}
+	return conf, nil
+}
+
+// tlsHandshake finish handshake of a tls connection, so bad clients are
+// rejected before any read. Plain connections are returned as is.
+func tlsHandshake(conn net.Conn) error {
+	tc, ok := conn.(*tls.Conn)
+	if !ok {
+		return nil
+	}
+	tc.SetDeadline(time.Now().Add(tlsHandshakeTimeout))
+	defer tc.SetDeadline(time.Time{})
+	return tc.Handshake()
+}
+
+// ClientCN return common name of the verified client certificate,
+// empty if connection is not tls or client sent no certificate
+func ClientCN(conn net.Conn) string {
+	tc, ok := conn.(*tls.Conn)
+	if !ok {
+		return ""
+	}
+	state := tc.ConnectionState()
+	if len(state.VerifiedChains) == 0 || len(state.VerifiedChains[0]) == 0 {
+		return ""
+	}
+	return state.VerifiedChains[0][0].Subject.CommonName
+}
+
+// clientSource identify the client of conn for rate limits per client, it is
+// the common name of verified client certificate if any, so clients sharing
+// an ip or moving between ips keep their own limit, the ip otherwise
+func clientSource(conn net.Conn) string {
+	if cn := ClientCN(conn); cn != "" {
+		return "cn:" + cn
+	}
+	return connIP(conn)
+}
+
+// requestSource is clientSource of a http request
+func requestSource(r *http.Request) string {
+	if r.TLS != nil && len(r.TLS.VerifiedChains) > 0 && len(r.TLS.VerifiedChains[0]) > 0 {
+		return "cn:" + r.TLS.VerifiedChains[0][0].Subject.CommonName
+	}
+	return addrIP(r.RemoteAddr)
+}
@@ -0,0 +1,137 @@
+package receivers
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"io/ioutil"
+	"math/big"
+	"net"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// writeCert create a key and a cert signed by parent, self signed if parent
+// is nil, pem files are written to dir/name.crt and dir/name.key
+func writeCert(t *testing.T, dir, name string, ca bool, parent *x509.Certificate, parentKey *ecdsa.PrivateKey) (*x509.Certificate, *ecdsa.PrivateKey) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber:          big.NewInt(time.Now().UnixNano()),
+		Subject:               pkix.Name{CommonName: name},
+		DNSNames:              []string{name},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		IsCA:                  ca,
+		BasicConstraintsValid: true,
+		KeyUsage:              x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+	}
+	if parent == nil {
+		parent, parentKey = tmpl, key
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, parent, &key.PublicKey, parentKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, _ := x509.ParseCertificate(der)
+	keyDer, _ := x509.MarshalECPrivateKey(key)
+	ioutil.WriteFile(filepath.Join(dir, name+".crt"), pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0600)
+	ioutil.WriteFile(filepath.Join(dir, name+".key"), pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDer}), 0600)
+	return cert, key
+}
+
+func TestTLSConfig(t *testing.T) {
+	dir, err := ioutil.TempDir("", "tls")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	ca, caKey := writeCert(t, dir, "ca", true, nil, nil)
+	writeCert(t, dir, "localhost", false, ca, caKey)
+	writeCert(t, dir, "client1", false, ca, caKey)
+	f := func(name string) string { return filepath.Join(dir, name) }
+
+	bad := []Config{
+		{TLSClientCA: f("ca.crt")},
+		{TLSCert: f("localhost.crt"), TLSKey: f("none.key")},
+		{TLSCert: f("localhost.crt"), TLSKey: f("localhost.key"), TLSMinVersion: "2.0"},
+		{TLSCert: f("localhost.crt"), TLSKey: f("localhost.key"), TLSVerifyClient: true},
+		{TLSCert: f("localhost.crt"), TLSKey: f("localhost.key"), TLSClientCA: f("localhost.key")},
+	}
+	for _, c := range bad {
+		if _, err := c.TLSConfig(); err == nil {
+			t.Errorf("expected error for %+v", c)
+		}
+	}
+	if conf, err := (&Config{}).TLSConfig(); conf != nil || err != nil {
+		t.Errorf("no tls: got %v %v", conf, err)
+	}
+
+	c := Config{TLSCert: f("localhost.crt"), TLSKey: f("localhost.key"),
+		TLSClientCA: f("ca.crt"), TLSVerifyClient: true}
+	serverConf, err := c.TLSConfig()
+	if err != nil {
+		t.Fatal(err)
+	}
+	roots := x509.NewCertPool()
+	roots.AddCert(ca)
+	clientCert, err := tls.LoadX509KeyPair(f("client1.crt"), f("client1.key"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		certs []tls.Certificate
+		cn    string // "" for handshake failure
+	}{
+		{[]tls.Certificate{clientCert}, "client1"},
+		{nil, ""},
+	}
+	for _, tt := range tests {
+		sc, cc := net.Pipe()
+		server := tls.Server(sc, serverConf)
+		client := tls.Client(cc, &tls.Config{RootCAs: roots, ServerName: "localhost", Certificates: tt.certs})
+		go func() {
+			client.Handshake()
+			// read so the server side can finish a failed handshake
+			client.Read(make([]byte, 1))
+			client.Close()
+		}()
+		err := tlsHandshake(server)
+		if tt.cn == "" {
+			if err == nil {
+				t.Error("client without cert should be rejected")
+			}
+		} else if err != nil || ClientCN(server) != tt.cn || clientSource(server) != "cn:"+tt.cn {
+			t.Errorf("got %v cn %q source %q, want %q", err, ClientCN(server), clientSource(server), tt.cn)
+		}
+		server.Close()
+	}
+	if ClientCN(&net.TCPConn{}) != "" {
+		t.Error("plain connection has no cn")
+	}
+
+	// http requests are limited by cn too
+	req := httptest.NewRequest("POST", "/write", nil)
+	if got := requestSource(req); got != "192.0.2.1" {
+		t.Errorf("plain request: got source %q", got)
+	}
+	clientX509, err := x509.ParseCertificate(clientCert.Certificate[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.TLS = &tls.ConnectionState{VerifiedChains: [][]*x509.Certificate{{clientX509, ca}}}
+	if got := requestSource(req); got != "cn:client1" {
+		t.Errorf("tls request: got source %q", got)
+	}
+}
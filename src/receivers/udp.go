@@ -0,0 +1,136 @@
+package receivers
+
+import (
+	"bytes"
+	"fmt"
+	"net"
+	"strings"
+
+	"github.com/coder-van/v-graphite/src/common"
+	statsd "github.com/coder-van/v-stats"
+	"github.com/coder-van/v-util/log"
+)
+
+const (
+	defaultUDPReadBufferSize    = 64 * 1024 // max size of a udp datagram
+	defaultUDPMaxLinesPerPacket = 1000
+)
+
+func NewUDPServer(ch chan common.MetricPoint, name string) *UDPServer {
+	s := &UDPServer{
+		Name:                  name,
+		ReadBufferSize:        defaultUDPReadBufferSize,
+		MaxLinesPerPacket:     defaultUDPMaxLinesPerPacket,
+		ChanPointBagsReceived: ch,
+		stat:                  common.GetStat("udp_receiver"),
+		logger:                log.GetLogger("udp", log.RotateModeMonth),
+	}
+	addr, err := net.ResolveUDPAddr("udp", "localhost:2003")
+	if err != nil {
+		fmt.Println(err)
+	}
+	s.Addr = addr
+	return s
+}
+
+// UDPServer receive metrics in plaintext protocol from udp datagrams,
+// one datagram may carry several lines
+type UDPServer struct {
+	Name string
+
+	Addr                  *net.UDPAddr
+	ReadBufferSize        int          // datagram bigger than this is truncated by kernel, so dropped
+	MaxLinesPerPacket     int          // datagram has more lines than this is dropped
+	SocketBufferSize      int          // kernel receive buffer of socket, 0 keeps os default
+	limiter               *rateLimiter // nil if no rate limit
+	conn                  *net.UDPConn
+	ChanPointBagsReceived chan common.MetricPoint
+	Backpressure          BackpressurePolicy
+	logger                *log.Vlogger
+	stat                  *statsd.BaseStat
+}
+
+func (rcv *UDPServer) handlePacket(data []byte, ip string) {
+	rcv.stat.CounterInc("datagram-received", 1)
+
+	lines := bytes.Split(data, []byte{'\n'})
+	// trailing newline gives an empty last line
+	if len(lines) > 0 && len(bytes.TrimSpace(lines[len(lines)-1])) == 0 {
+		lines = lines[:len(lines)-1]
+	}
+	if rcv.MaxLinesPerPacket > 0 && len(lines) > rcv.MaxLinesPerPacket {
+		rcv.stat.CounterInc("datagram-dropped", 1)
+		rcv.logger.Debug(fmt.Sprintf("udp datagram dropped, %d lines over limit %d \n",
+			len(lines), rcv.MaxLinesPerPacket))
+		return
+	}
+
+	for _, line := range lines {
+		if len(bytes.TrimSpace(line)) == 0 { // skip empty lines
+			continue
+		}
+		if mp, err := common.ParseFromStr(string(line)); err != nil {
+			rcv.stat.OnErr("error-udp-receiver-ParseFromStr", err)
+		} else if rcv.limiter.Allow(ip, mp.Key) {
+			rcv.stat.CounterInc("point-received", 1)
+			rcv.pipeOut(*mp)
+		}
+	}
+}
+
+func (rcv *UDPServer) pipeOut(mp common.MetricPoint) {
+	pushPoint(rcv.ChanPointBagsReceived, rcv.Backpressure, rcv.stat, rcv.Name, mp)
+}
+
+func (rcv *UDPServer) Start() {
+	fmt.Println("* Udp receiver starting")
+	go rcv.Listen()
+}
+
+// Listen 是阻塞的 需要调用时加 go
+func (rcv *UDPServer) Listen() error {
+	var err error
+	rcv.conn, err = net.ListenUDP("udp", rcv.Addr)
+	if err != nil {
+		rcv.logger.Printf("udp listen %s failed, %s \n", rcv.Addr, err)
+		return err
+	}
+	defer rcv.conn.Close()
+
+	if rcv.SocketBufferSize > 0 {
+		if err = rcv.conn.SetReadBuffer(rcv.SocketBufferSize); err != nil {
+			rcv.logger.Printf("udp set socket buffer failed, %s \n", err)
+		}
+	}
+
+	// one more byte to know the datagram was truncated
+	buf := make([]byte, rcv.ReadBufferSize+1)
+
+	fmt.Println("* Udp receiver started")
+	for {
+		n, addr, err := rcv.conn.ReadFromUDP(buf)
+		if err != nil {
+			if strings.Contains(err.Error(), "use of closed network connection") {
+				break
+			}
+			rcv.stat.OnErr("error-udp-receiver-read", err)
+			continue
+		}
+
+		if n > rcv.ReadBufferSize {
+			rcv.stat.CounterInc("datagram-oversized", 1)
+			continue
+		}
+
+		rcv.handlePacket(buf[:n], addr.IP.String())
+	}
+	return nil
+}
+
+func (rcv *UDPServer) Stop() {
+	fmt.Println("* Udp receiver closing")
+	if rcv.conn != nil {
+		rcv.conn.Close()
+	}
+	fmt.Println("* Udp receiver closed")
+}
@@ -0,0 +1,43 @@
+package receivers
+
+import (
+	"testing"
+
+	"github.com/coder-van/v-graphite/src/common"
+)
+
+func TestUDPHandlePacket(t *testing.T) {
+	tests := []struct {
+		data     string
+		maxLines int
+		want     []string
+	}{
+		{"a.b 1 1500000000\nc.d 2 1500000000\n", 0, []string{"a.b", "c.d"}},
+		{"a.b 1 1500000000", 0, []string{"a.b"}},
+		// empty and bad lines are skipped, good ones still go
+		{"\na.b 1 1500000000\n\nbad\nc.d 2 1500000000\r\n", 0, []string{"a.b", "c.d"}},
+		{"a.b 1 1500000000\nc.d 2 1500000000\n", 2, []string{"a.b", "c.d"}},
+		// more lines than limit drops the whole datagram
+		{"a.b 1 1500000000\nc.d 2 1500000000\ne.f 3 1500000000\n", 2, nil},
+	}
+	for _, tt := range tests {
+		ch := make(chan common.MetricPoint, 10)
+		rcv := NewUDPServer(ch, "test")
+		rcv.MaxLinesPerPacket = tt.maxLines
+		rcv.handlePacket([]byte(tt.data), "127.0.0.1")
+		close(ch)
+		var got []string
+		for mp := range ch {
+			got = append(got, mp.Key)
+		}
+		if len(got) != len(tt.want) {
+			t.Errorf("%q: got %v, want %v", tt.data, got, tt.want)
+			continue
+		}
+		for i := range got {
+			if got[i] != tt.want[i] {
+				t.Errorf("%q: got %v, want %v", tt.data, got, tt.want)
+			}
+		}
+	}
+}
@@ -0,0 +1,233 @@
+package receivers
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/coder-van/v-graphite/src/common"
+	statsd "github.com/coder-van/v-stats"
+	"github.com/coder-van/v-util/log"
+)
+
+const (
+	UnixSocketStream   = "stream"
+	UnixSocketDatagram = "datagram"
+)
+
+func NewUnixServer(ch chan common.MetricPoint, name string, path string) *UnixServer {
+	return &UnixServer{
+		Name:                  name,
+		Path:                  path,
+		ReadBufferSize:        defaultUDPReadBufferSize,
+		MaxLinesPerPacket:     defaultUDPMaxLinesPerPacket,
+		ChanPointBagsReceived: ch,
+		stat:                  common.GetStat("unix_receiver"),
+		logger:                log.GetLogger("unix", log.RotateModeMonth),
+	}
+}
+
+// UnixServer receive metrics in plaintext protocol from a unix domain socket,
+// stream socket is read line by line like tcp, datagram socket like udp
+type UnixServer struct {
+	Name string
+
+	Path              string
+	IsDatagram        bool
+	Mode              os.FileMode // permissions of socket file, 0 to keep what umask gives
+	ReadBufferSize    int         // datagram only
+	MaxLinesPerPacket int         // datagram only
+	SocketBufferSize  int         // datagram only, kernel receive buffer, 0 keeps os default
+
+	limiter               *rateLimiter // nil if no rate limit, all clients share ip ""
+	listener              *net.UnixListener
+	conn                  *net.UnixConn
+	ChanPointBagsReceived chan common.MetricPoint
+	Backpressure          BackpressurePolicy
+	logger                *log.Vlogger
+	stat                  *statsd.BaseStat
+}
+
+// removeStaleSocket remove socket file left by a process not exit cleanly,
+// refuse to remove the path if it is not a socket
+func removeStaleSocket(path string) error {
+	fi, err := os.Lstat(path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return err
+	}
+	if fi.Mode()&os.ModeSocket == 0 {
+		return fmt.Errorf("%s exists and is not a socket", path)
+	}
+	return os.Remove(path)
+}
+
+func (rcv *UnixServer) handleLine(line []byte) {
+	if len(bytes.TrimSpace(line)) == 0 { // skip empty lines
+		return
+	}
+	if mp, err := common.ParseFromStr(string(line)); err != nil {
+		rcv.stat.OnErr("error-unix-receiver-ParseFromStr", err)
+	} else if rcv.limiter.Allow("", mp.Key) {
+		rcv.stat.CounterInc("point-received", 1)
+		rcv.pipeOut(*mp)
+	}
+}
+
+func (rcv *UnixServer) handleConn(conn net.Conn) {
+	rcv.stat.GaugeInc("active_conn", 1)
+	defer rcv.stat.GaugeDec("active_conn", -1)
+	defer conn.Close()
+
+	reader := bufio.NewReader(conn)
+	for {
+		conn.SetReadDeadline(time.Now().Add(2 * time.Minute))
+
+		line, err := reader.ReadBytes('\n')
+		if err != nil {
+			if err == io.EOF {
+				if len(line) > 0 {
+					rcv.logger.Printf("Warn unfinished line %s", string(line))
+				}
+			} else {
+				rcv.stat.OnErr("error-unix-receiver-readline", err)
+				rcv.logger.Printf("read error %s", err.Error())
+			}
+			return
+		}
+		rcv.handleLine(line)
+	}
+}
+
+func (rcv *UnixServer) handlePacket(data []byte) {
+	rcv.stat.CounterInc("datagram-received", 1)
+
+	lines := bytes.Split(data, []byte{'\n'})
+	if len(lines) > 0 && len(bytes.TrimSpace(lines[len(lines)-1])) == 0 {
+		lines = lines[:len(lines)-1]
+	}
+	if rcv.MaxLinesPerPacket > 0 && len(lines) > rcv.MaxLinesPerPacket {
+		rcv.stat.CounterInc("datagram-dropped", 1)
+		return
+	}
+	for _, line := range lines {
+		rcv.handleLine(line)
+	}
+}
+
+func (rcv *UnixServer) pipeOut(mp common.MetricPoint) {
+	pushPoint(rcv.ChanPointBagsReceived, rcv.Backpressure, rcv.stat, rcv.Name, mp)
+}
+
+func (rcv *UnixServer) Start() {
+	fmt.Println("* Unix receiver starting")
+	go rcv.Listen()
+}
+
+// Listen 是阻塞的 需要调用时加 go
+func (rcv *UnixServer) Listen() error {
+	if err := removeStaleSocket(rcv.Path); err != nil {
+		rcv.logger.Printf("unix socket %s can't be cleaned up, %s \n", rcv.Path, err)
+		return err
+	}
+	if rcv.IsDatagram {
+		return rcv.listenDatagram()
+	}
+
+	addr := &net.UnixAddr{Name: rcv.Path, Net: "unix"}
+	ln, err := net.ListenUnix("unix", addr)
+	if err != nil {
+		rcv.logger.Printf("unix listen %s failed, %s \n", rcv.Path, err)
+		return err
+	}
+	rcv.listener = ln
+	defer ln.Close()
+	if err := rcv.chmod(); err != nil {
+		return err
+	}
+
+	fmt.Println("* Unix receiver started")
+	for {
+		conn, err := ln.Accept()
+		if err != nil {
+			if strings.Contains(err.Error(), "use of closed network connection") {
+				break
+			}
+			continue
+		}
+		go rcv.handleConn(conn)
+	}
+	return nil
+}
+
+func (rcv *UnixServer) listenDatagram() error {
+	addr := &net.UnixAddr{Name: rcv.Path, Net: "unixgram"}
+	conn, err := net.ListenUnixgram("unixgram", addr)
+	if err != nil {
+		rcv.logger.Printf("unixgram listen %s failed, %s \n", rcv.Path, err)
+		return err
+	}
+	rcv.conn = conn
+	defer conn.Close()
+	if err := rcv.chmod(); err != nil {
+		return err
+	}
+	if rcv.SocketBufferSize > 0 {
+		if err = conn.SetReadBuffer(rcv.SocketBufferSize); err != nil {
+			rcv.logger.Printf("unixgram set socket buffer failed, %s \n", err)
+		}
+	}
+
+	// one more byte to know the datagram was truncated
+	buf := make([]byte, rcv.ReadBufferSize+1)
+
+	fmt.Println("* Unix receiver started")
+	for {
+		n, _, err := conn.ReadFromUnix(buf)
+		if err != nil {
+			if strings.Contains(err.Error(), "use of closed network connection") {
+				break
+			}
+			rcv.stat.OnErr("error-unix-receiver-read", err)
+			continue
+		}
+		if n > rcv.ReadBufferSize {
+			rcv.stat.CounterInc("datagram-oversized", 1)
+			continue
+		}
+		rcv.handlePacket(buf[:n])
+	}
+	return nil
+}
+
+func (rcv *UnixServer) chmod() error {
+	if rcv.Mode == 0 {
+		return nil
+	}
+	if err := os.Chmod(rcv.Path, rcv.Mode); err != nil {
+		rcv.logger.Printf("chmod unix socket %s failed, %s \n", rcv.Path, err)
+		return err
+	}
+	return nil
+}
+
+func (rcv *UnixServer) Stop() {
+	fmt.Println("* Unix receiver closing")
+	if rcv.listener != nil {
+		rcv.listener.Close()
+	}
+	if rcv.conn != nil {
+		rcv.conn.Close()
+	}
+	if err := removeStaleSocket(rcv.Path); err != nil {
+		rcv.logger.Printf("unix socket %s can't be removed, %s \n", rcv.Path, err)
+	}
+	fmt.Println("* Unix receiver closed")
+}
@@ -0,0 +1,60 @@
+package receivers
+
+import (
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/coder-van/v-graphite/src/common"
+)
+
+func TestUnixHandlePacket(t *testing.T) {
+	ch := make(chan common.MetricPoint, 10)
+	rcv := NewUnixServer(ch, "test", "")
+	rcv.MaxLinesPerPacket = 3
+	rcv.handlePacket([]byte("a.b 1 1500000000\n\nbad\n"))
+	// over limit, dropped
+	rcv.handlePacket([]byte("a.b 1 1500000000\nc.d 2 1500000000\ne.f 3 1500000000\ng.h 4 1500000000\n"))
+	close(ch)
+	var got []string
+	for mp := range ch {
+		got = append(got, mp.Key)
+	}
+	if len(got) != 1 || got[0] != "a.b" {
+		t.Errorf("got %v, want [a.b]", got)
+	}
+}
+
+func TestRemoveStaleSocket(t *testing.T) {
+	dir, err := ioutil.TempDir("", "unix")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	if err := removeStaleSocket(filepath.Join(dir, "none.sock")); err != nil {
+		t.Errorf("missing socket: %s", err)
+	}
+
+	sock := filepath.Join(dir, "stale.sock")
+	ln, err := net.ListenUnix("unix", &net.UnixAddr{Name: sock, Net: "unix"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	ln.SetUnlinkOnClose(false)
+	ln.Close()
+	if err := removeStaleSocket(sock); err != nil {
+		t.Errorf("stale socket: %s", err)
+	}
+	if _, err := os.Stat(sock); !os.IsNotExist(err) {
+		t.Errorf("stale socket not removed")
+	}
+
+	file := filepath.Join(dir, "file")
+	ioutil.WriteFile(file, nil, 0644)
+	if err := removeStaleSocket(file); err == nil {
+		t.Error("regular file should not be removed")
+	}
+}
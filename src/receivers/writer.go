@@ -0,0 +1,58 @@
+package receivers
+
+import (
+	"errors"
+
+	"github.com/coder-van/v-graphite/src/common"
+	statsd "github.com/coder-van/v-stats"
+)
+
+// Writer put points received outside of receivers, like api /metrics/write,
+// to ChanPointBagsReceived, so they go through the same rate limits,
+// backpressure, timestamp window, filter, rewrite, wal and aggregation
+type Writer struct {
+	Name         string
+	ch           chan common.MetricPoint
+	Backpressure BackpressurePolicy
+	limiter      *rateLimiter // nil if no rate limit
+	stat         *statsd.BaseStat
+}
+
+var (
+	// ErrRateLimited is returned by Writer.Write when rate limit drops the point
+	ErrRateLimited = errors.New("rate limited")
+	// ErrDropped is returned by Writer.Write when backpressure drops the point
+	ErrDropped = errors.New("dropped by backpressure")
+)
+
+// NewWriter build a writer with rate limit and backpressure settings of conf
+func (rm *ReceiverManager) NewWriter(name string, conf Config) (*Writer, error) {
+	conf.Check()
+	policy, err := ParseBackpressurePolicy(conf.Backpressure)
+	if err != nil {
+		return nil, err
+	}
+	w := &Writer{
+		Name:         name,
+		ch:           rm.ChanPointBagsReceived,
+		Backpressure: policy,
+		stat:         common.GetStat(name + "_receiver"),
+	}
+	if w.limiter, err = newRateLimiter(conf, w.stat); err != nil {
+		return nil, err
+	}
+	return w, nil
+}
+
+// Write return ErrRateLimited or ErrDropped if point from remoteAddr is
+// dropped by rate limit or backpressure
+func (w *Writer) Write(remoteAddr string, mp common.MetricPoint) error {
+	if !w.limiter.Allow(addrIP(remoteAddr), mp.Key) {
+		return ErrRateLimited
+	}
+	w.stat.CounterInc("point-received", 1)
+	if !pushPoint(w.ch, w.Backpressure, w.stat, w.Name, mp) {
+		return ErrDropped
+	}
+	return nil
+}
@@ -43,7 +43,9 @@ func main() {
 		carbon.Stop()
 	}()
 
-	carbon.Start()
+	if err := carbon.Start(); err != nil {
+		log.Fatalln("Carbon start failed,", err)
+	}
 	
 	<-exitCh
 	time.Sleep(time.Second*time.Duration(2))